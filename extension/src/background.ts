@@ -1,24 +1,43 @@
-import { WSMessage, DEFAULT_CONFIG, ExtensionConfig } from "./types";
+import { WSMessage, DEFAULT_CONFIG, ExtensionConfig, CmdResumeResult, Capability, EventAck, EventHello } from "./types";
+import { ConnectionHandlers, ServerConnection, openNative, openWebSocket } from "./transport";
 
-let ws: WebSocket | null = null;
+let conn: ServerConnection | null = null;
 let reconnectTimer: ReturnType<typeof setTimeout> | null = null;
 let connected = false;
 
 const RECONNECT_INTERVAL = 5000;
 
+// server 因插件版本过低拒绝连接时使用的关闭码，收到后不再自动重连
+const CLOSE_VERSION_REJECTED = 4001;
+
+// 本插件支持的能力，随 EVENT_HELLO 上报
+const CAPABILITIES: Capability[] = ["attachments", "cancel", "model_selection", "conversations", "resume", "ack"];
+
+// 已收到并确认的指令 ack_id，用于忽略 server 的重投
+const received = new Set<string>();
+const RECEIVED_LIMIT = 200;
+
+// content script 检测到的 Google 账号
+let account = "";
+
+// 进行中的任务 -> 断线期间产生的最新一条回复（PROCESSING 为累计全文，只需保留最新一条）
+// 重连后通过 EVENT_RESUME 上报，server 确认恢复后补发
+const inFlight = new Map<string, WSMessage | null>();
+// 断线期间最新的 EVENT_STATUS，恢复完成后补发
+let pendingStatus: WSMessage | null = null;
+
 // 从 storage 读取配置
 async function getConfig(): Promise<ExtensionConfig> {
   const result = await chrome.storage.local.get("config");
   return result.config || DEFAULT_CONFIG;
 }
 
-// 建立 WebSocket 连接
+// 建立与 server 的连接（WebSocket 或 native messaging）
 async function connect(): Promise<void> {
   // 清理旧连接
-  if (ws) {
-    ws.onclose = null;
-    ws.close();
-    ws = null;
+  if (conn) {
+    conn.close();
+    conn = null;
   }
   if (reconnectTimer) {
     clearTimeout(reconnectTimer);
@@ -26,40 +45,53 @@ async function connect(): Promise<void> {
   }
 
   const config = await getConfig();
-  console.log(`[BG] connecting to ${config.wsUrl}`);
-
-  try {
-    ws = new WebSocket(config.wsUrl);
-  } catch (err) {
-    console.error("[BG] WebSocket creation failed:", err);
-    scheduleReconnect();
-    return;
-  }
+  const handlers: ConnectionHandlers = {
+    onOpen: () => {
+      connected = true;
+      console.log("[BG] connected");
+      sendHello();
 
-  ws.onopen = () => {
-    connected = true;
-    console.log("[BG] WebSocket connected");
+      if (inFlight.size > 0) {
+        const tasks = [...inFlight.keys()];
+        console.log(`[BG] resuming tasks: ${tasks.join(", ")}`);
+        sendToServer({ type: "EVENT_RESUME", payload: { tasks } });
+      } else {
+        flushStatus();
+      }
+    },
+    onMessage: handleServerMessage,
+    onClose: (code, reason) => {
+      connected = false;
+      conn = null;
+      if (code === CLOSE_VERSION_REJECTED) {
+        console.error(`[BG] connection rejected by server: ${reason}`);
+        return;
+      }
+      console.log(`[BG] disconnected${reason ? `: ${reason}` : ""}`);
+      scheduleReconnect();
+    },
   };
 
-  ws.onmessage = (event: MessageEvent) => {
-    try {
-      const msg: WSMessage = JSON.parse(event.data);
-      handleServerMessage(msg);
-    } catch (err) {
-      console.error("[BG] invalid message:", err);
+  try {
+    if (config.transport === "native") {
+      console.log("[BG] connecting via native messaging host");
+      conn = openNative(handlers);
+    } else {
+      console.log(`[BG] connecting to ${config.wsUrl}`);
+      conn = openWebSocket(withToken(config), handlers);
     }
-  };
-
-  ws.onclose = () => {
-    connected = false;
-    ws = null;
-    console.log("[BG] WebSocket disconnected");
+  } catch (err) {
+    console.error("[BG] connection failed:", err);
     scheduleReconnect();
-  };
+  }
+}
 
-  ws.onerror = (err) => {
-    console.error("[BG] WebSocket error:", err);
-  };
+// 浏览器的 WebSocket 无法设置请求头，Token 通过查询参数传递
+function withToken(config: ExtensionConfig): string {
+  if (!config.token) return config.wsUrl;
+  const url = new URL(config.wsUrl);
+  url.searchParams.set("token", config.token);
+  return url.toString();
 }
 
 // 定时重连
@@ -74,32 +106,146 @@ function scheduleReconnect(): void {
 
 // 发送消息到 Server
 function sendToServer(msg: WSMessage): void {
-  if (ws && ws.readyState === WebSocket.OPEN) {
-    ws.send(JSON.stringify(msg));
+  if (conn && conn.isOpen()) {
+    conn.send(msg);
   } else {
-    console.error("[BG] cannot send, WebSocket not connected");
+    console.error("[BG] cannot send, not connected");
   }
 }
 
+// 将 content script 的消息发给 Server，断线时暂存进行中任务的回复与最新状态
+function deliver(msg: WSMessage): void {
+  const taskId = msg.reply_to;
+  if (!conn || !conn.isOpen()) {
+    if (taskId && inFlight.has(taskId)) {
+      inFlight.set(taskId, msg);
+    } else if (msg.type === "EVENT_STATUS") {
+      pendingStatus = msg;
+    } else {
+      console.error("[BG] cannot send, not connected");
+    }
+    return;
+  }
+
+  conn.send(msg);
+  if (taskId && isFinal(msg)) {
+    inFlight.delete(taskId);
+  }
+}
+
+// 任务的最后一条消息：DONE 或 EVENT_ERROR
+function isFinal(msg: WSMessage): boolean {
+  return msg.type === "EVENT_ERROR" || (msg.type === "EVENT_REPLY" && msg.payload?.status === "DONE");
+}
+
+// 补发断线期间暂存的状态
+// 上报插件版本、浏览器、账号与能力列表
+function sendHello(): void {
+  const hello: EventHello = {
+    type: "EVENT_HELLO",
+    payload: {
+      version: chrome.runtime.getManifest().version,
+      browser: browserName(),
+      account,
+      capabilities: CAPABILITIES,
+    },
+  };
+  sendToServer(hello);
+}
+
+// 从 User-Agent 中提取浏览器名称与版本
+function browserName(): string {
+  const match = navigator.userAgent.match(/(Edg|OPR|Chrome|Firefox)\/[\d.]+/);
+  return match ? match[0] : navigator.userAgent;
+}
+
+function flushStatus(): void {
+  if (pendingStatus) {
+    const status = pendingStatus;
+    pendingStatus = null;
+    deliver(status);
+  }
+}
+
+// 处理 EVENT_RESUME 的答复：补发已恢复任务的暂存回复，停止被拒绝的任务
+function handleResumeResult(msg: CmdResumeResult): void {
+  for (const taskId of msg.payload.resumed) {
+    const pending = inFlight.get(taskId);
+    if (pending) {
+      inFlight.set(taskId, null);
+      deliver(pending);
+    }
+  }
+  for (const taskId of msg.payload.rejected) {
+    console.log(`[BG] task ${taskId} was not resumed, cancelling`);
+    inFlight.delete(taskId);
+    forwardCancel({ type: "CMD_CANCEL", id: taskId });
+  }
+  flushStatus();
+}
+
 // 处理服务端消息
 function handleServerMessage(msg: WSMessage): void {
   console.log(`[BG] received: type=${msg.type}`);
 
+  // 重投的指令（确认在途中丢失）：重新确认，不重复执行
+  if (msg.ack_id && received.has(msg.ack_id)) {
+    console.log(`[BG] duplicate ${msg.type} ${msg.id}, ignoring`);
+    ack(msg);
+    return;
+  }
+
   switch (msg.type) {
     case "PING":
       sendToServer({ type: "PONG" });
       break;
 
+    // 记录后立即确认：打开 tab、切换对话可能耗时较长，转发失败由 forwardToContentScript 以 EVENT_ERROR 上报
     case "CMD_SEND_MESSAGE":
+      if (msg.id) inFlight.set(msg.id, null);
+      markReceived(msg);
+      ack(msg);
+      forwardToContentScript(msg);
+      break;
+
+    case "CMD_DELETE_CONVERSATION":
+      markReceived(msg);
+      ack(msg);
       forwardToContentScript(msg);
       break;
 
+    case "CMD_RESUME_RESULT":
+      handleResumeResult(msg as CmdResumeResult);
+      break;
+
+    case "CMD_CANCEL":
+      markReceived(msg);
+      forwardCancel(msg);
+      ack(msg);
+      break;
+
     default:
       console.log(`[BG] unknown message type: ${msg.type}`);
   }
 }
 
-// 转发指令到 Content Script
+// 记录收到的指令，超出上限时淘汰最早的记录
+function markReceived(msg: WSMessage): void {
+  if (!msg.ack_id) return;
+  received.add(msg.ack_id);
+  if (received.size > RECEIVED_LIMIT) {
+    received.delete(received.values().next().value!);
+  }
+}
+
+// 以 EVENT_ACK 确认指令已送达
+function ack(msg: WSMessage): void {
+  if (!msg.ack_id) return;
+  const event: EventAck = { type: "EVENT_ACK", reply_to: msg.id!, payload: { ack_id: msg.ack_id } };
+  sendToServer(event);
+}
+
+// 转发指令到 Content Script，转发失败时以 EVENT_ERROR 上报
 async function forwardToContentScript(msg: WSMessage): Promise<void> {
   try {
     // 查找 Gemini tab
@@ -131,14 +277,21 @@ async function forwardToContentScript(msg: WSMessage): Promise<void> {
     }
 
     if (!tab?.id) {
-      sendToServer({
+      deliver({
         type: "EVENT_ERROR",
         reply_to: msg.id,
-        payload: { error: "cannot find or create Gemini tab" },
+        payload: { error: "cannot find or create Gemini tab", code: "tab_not_found" },
       });
       return;
     }
 
+    // 指定了已有对话时，先将 tab 导航到该对话（页面跳转会重新注入 content script）
+    const conversationId = (msg.payload?.conversation_id as string) || "";
+    if (conversationId && !tab.url?.includes(`/app/${conversationId}`)) {
+      console.log(`[BG] navigating tab to conversation ${conversationId}`);
+      await navigateTab(tab.id, `https://gemini.google.com/app/${conversationId}`);
+    }
+
     // 转发给 content script
     const response = await chrome.tabs.sendMessage(tab.id, {
       action: "sendMessage",
@@ -148,14 +301,42 @@ async function forwardToContentScript(msg: WSMessage): Promise<void> {
     console.log("[BG] content script response:", response);
   } catch (err) {
     console.error("[BG] forward to content script failed:", err);
-    sendToServer({
+    deliver({
       type: "EVENT_ERROR",
       reply_to: msg.id,
-      payload: { error: `forward failed: ${err}` },
+      payload: { error: `forward failed: ${err}`, code: "forward_failed" },
     });
   }
 }
 
+// 转发取消指令到所有 Gemini tab，由正在处理该任务的 content script 响应
+async function forwardCancel(msg: WSMessage): Promise<void> {
+  const tabs = await chrome.tabs.query({ url: "https://gemini.google.com/*" });
+  for (const tab of tabs) {
+    if (!tab.id) continue;
+    chrome.tabs.sendMessage(tab.id, { action: "cancel", data: msg }).catch((err) => {
+      console.warn(`[BG] forward cancel to tab ${tab.id} failed:`, err);
+    });
+  }
+}
+
+// 导航 tab 并等待页面加载完成
+async function navigateTab(tabId: number, url: string): Promise<void> {
+  await new Promise<void>((resolve) => {
+    const listener = (id: number, info: chrome.tabs.TabChangeInfo) => {
+      if (id === tabId && info.status === "complete") {
+        chrome.tabs.onUpdated.removeListener(listener);
+        resolve();
+      }
+    };
+    chrome.tabs.onUpdated.addListener(listener);
+    chrome.tabs.update(tabId, { url });
+  });
+
+  // 额外等待，确保 content script 注入完成且对话内容渲染完毕
+  await new Promise((resolve) => setTimeout(resolve, 2000));
+}
+
 // 监听来自 content script 和 popup 的消息
 chrome.runtime.onMessage.addListener((message, _sender, sendResponse) => {
   if (message.action === "reconnect") {
@@ -165,7 +346,15 @@ chrome.runtime.onMessage.addListener((message, _sender, sendResponse) => {
     sendResponse({ connected });
   } else if (message.action === "wsReply") {
     // Content Script 回传的消息，转发给 Server
-    sendToServer(message.data as WSMessage);
+    deliver(message.data as WSMessage);
+    sendResponse({ ok: true });
+  } else if (message.action === "account") {
+    // 账号变化时重新上报 EVENT_HELLO
+    const current = (message.data as string) || "";
+    if (current !== account) {
+      account = current;
+      if (connected) sendHello();
+    }
     sendResponse({ ok: true });
   }
   return true; // 保持 sendResponse 可用
@@ -1,4 +1,4 @@
-import type {InternalMessage, WSMessage} from "./types";
+import type {Attachment, ErrorCode, InternalMessage, WSMessage} from "./types";
 import {Overlay} from "./overlay";
 import * as cheerio from 'cheerio';
 import TurndownService from 'turndown';
@@ -22,6 +22,28 @@ async function pollConnectionStatus(): Promise<void> {
 pollConnectionStatus();
 setInterval(pollConnectionStatus, 3000);
 
+// 定期检查登录状态，登录失效时主动上报，server 将本 worker 标记为降级
+let loginRequiredReported = false;
+function checkLoginState(): void {
+  reportAccount();
+  const loginRequired = isLoginRequired();
+  if (loginRequired && !loginRequiredReported) {
+    sendDegraded("login_required");
+  }
+  loginRequiredReported = loginRequired;
+}
+setInterval(checkLoginState, 10000);
+
+// 将页面上登录的 Google 账号告知 background，随 EVENT_HELLO 上报
+let reportedAccount: string | null = null;
+function reportAccount(): void {
+  const account = detectAccount();
+  if (account === reportedAccount) return;
+  reportedAccount = account;
+  chrome.runtime.sendMessage({ action: "account", data: account });
+}
+reportAccount();
+
 // ========== DOM 操作工具函数 ==========
 
 /**
@@ -58,6 +80,25 @@ function findInputElement(): HTMLElement | null {
   return null;
 }
 
+/**
+ * 检测 Gemini 登录是否已失效（跳转到登录页或页面显示登录按钮）
+ */
+function isLoginRequired(): boolean {
+  if (window.location.hostname === "accounts.google.com") return true;
+  return !!document.querySelector(
+    'a[href*="accounts.google.com/ServiceLogin"], a[href*="accounts.google.com/v3/signin"], a[data-test-id="sign-in-button"]'
+  );
+}
+
+/**
+ * 从页面右上角的账号按钮中提取当前登录的 Google 账号邮箱，未登录时返回空
+ */
+function detectAccount(): string {
+  const button = document.querySelector('a[aria-label*="@"][href*="accounts.google.com"]');
+  const match = button?.getAttribute("aria-label")?.match(/[\w.+-]+@[\w-]+(\.[\w-]+)+/);
+  return match ? match[0] : "";
+}
+
 /**
  * 模拟输入文本到输入框
  * 使用剪贴板粘贴方式，最接近人类操作习惯
@@ -213,20 +254,33 @@ function extractTextWithoutThinking(el: HTMLElement): string {
   return text.trim();
 }
 
+const MODEL_RESPONSE_SELECTORS = [
+  'model-response',
+  '[data-message-author-role="model"]',
+  '[data-message-author-role="assistant"]',
+];
+
+/**
+ * 统计当前页面上 model 回复的数量（用于在已有对话中区分新旧回复）
+ */
+function countModelResponses(): number {
+  for (const selector of MODEL_RESPONSE_SELECTORS) {
+    const count = document.querySelectorAll(selector).length;
+    if (count > 0) return count;
+  }
+  return 0;
+}
+
 /**
  * 获取最后一个 model 回复的文本内容
+ * @param minCount 发送前已存在的回复数量，只有出现新回复时才返回内容
  */
-function getLastModelResponse(): Array<string> {
+function getLastModelResponse(minCount = 0): Array<string> {
   // 获取所有 model 回复，取最后一个
-  const modelSelectors = [
-    'model-response',
-    '[data-message-author-role="model"]',
-    '[data-message-author-role="assistant"]',
-  ];
-
-  for (const selector of modelSelectors) {
+  for (const selector of MODEL_RESPONSE_SELECTORS) {
     const allResponses = document.querySelectorAll<HTMLElement>(selector);
     if (allResponses.length > 0) {
+      if (allResponses.length <= minCount) return ["", ""];
       const last = allResponses[allResponses.length - 1];
       const h = last.innerHTML;
       // 优先从 .markdown 获取纯回复文本（不含思考过程）
@@ -252,12 +306,12 @@ function getLastModelResponse(): Array<string> {
 }
 
 /**
- * 检测是否正在生成中
+ * 查找停止生成按钮（仅在生成中显示）
  */
-function isGenerating(): boolean {
+function findStopButton(): HTMLElement | null {
   // 检测 Gemini 的停止按钮（正在生成时显示 .stop 类）
-  const stopBtn = document.querySelector('button.send-button.stop:not([aria-disabled="true"])');
-  if (stopBtn) return true;
+  const stopBtn = document.querySelector<HTMLElement>('button.send-button.stop:not([aria-disabled="true"])');
+  if (stopBtn) return stopBtn;
 
   // 备用：检测 aria-label
   const stopSelectors = [
@@ -266,10 +320,18 @@ function isGenerating(): boolean {
     'button[aria-label="Stop"]',
   ];
   for (const selector of stopSelectors) {
-    if (document.querySelector(selector)) return true;
+    const btn = document.querySelector<HTMLElement>(selector);
+    if (btn) return btn;
   }
 
-  return false;
+  return null;
+}
+
+/**
+ * 检测是否正在生成中
+ */
+function isGenerating(): boolean {
+  return findStopButton() !== null;
 }
 
 // ========== 新对话 & 模型选择 ==========
@@ -341,16 +403,29 @@ function getCurrentModelName(): string {
   return "";
 }
 
+// 各模式对应的模型选择器文案关键字（小写），与 server 端 modeKeywords 保持一致
+const MODE_KEYWORDS: Record<string, string[]> = {
+  pro: ["pro"],
+  flash: ["flash", "fast", "快速"],
+  thinking: ["thinking", "思考"],
+};
+
+function modeMatches(label: string, mode: string): boolean {
+  const text = label.toLowerCase();
+  const keywords = MODE_KEYWORDS[mode] || [mode.toLowerCase()];
+  return keywords.some((kw) => text.includes(kw));
+}
+
 /**
- * 确保选择了 Pro 模型
- * 如果当前已是 Pro，直接返回；否则打开选择器切换
+ * 确保选择了指定模式的模型（pro/flash/thinking）
+ * 如果当前已是该模式，直接返回；否则打开选择器切换
  */
-async function ensureProModel(): Promise<void> {
+async function ensureModel(mode: string): Promise<void> {
   const currentModel = getCurrentModelName();
-  console.log("[Content] current model:", currentModel);
+  console.log("[Content] current model:", currentModel, "wanted mode:", mode);
 
-  if (currentModel.toLowerCase().includes("pro")) {
-    console.log("[Content] already using Pro model");
+  if (modeMatches(currentModel, mode)) {
+    console.log(`[Content] already using ${mode} model`);
     return;
   }
 
@@ -366,21 +441,21 @@ async function ensureProModel(): Promise<void> {
   simulateClick(menuButton);
   await randomDelay(400, 700);
 
-  // 在下拉菜单中查找包含 "Pro" 的选项
+  // 在下拉菜单中查找匹配该模式的选项
   const menuItems = document.querySelectorAll<HTMLElement>(
     '.mat-mdc-menu-panel button, .mat-mdc-menu-panel [role="menuitem"], .cdk-overlay-pane button'
   );
   for (const item of menuItems) {
     const text = item.textContent?.trim() || "";
-    if (text.includes("Pro") && !text.includes("Ultra")) {
-      console.log("[Content] selecting Pro model:", text);
+    if (modeMatches(text, mode) && !text.includes("Ultra")) {
+      console.log(`[Content] selecting ${mode} model:`, text);
       simulateClick(item);
       await randomDelay(400, 700);
       return;
     }
   }
 
-  console.log("[Content] Pro option not found in menu, closing menu");
+  console.log(`[Content] ${mode} option not found in menu, closing menu`);
   // 关闭菜单（按 Escape）
   document.dispatchEvent(new KeyboardEvent("keydown", { key: "Escape", bubbles: true }));
 }
@@ -601,45 +676,204 @@ async function clickCopyAndGetMarkdown(htmlContent: string): Promise<string | nu
         return null;
     }
 }
+// ========== 附件上传 ==========
+
+// 输入区中已上传附件的预览元素
+const ATTACHMENT_PREVIEW_SELECTORS = [
+  "uploader-file-preview",
+  'img[data-test-id="uploaded-img"]',
+  ".file-preview-container",
+  ".attachment-preview-wrapper",
+];
+
+// 附件仍在上传中的指示元素
+const ATTACHMENT_LOADING_SELECTORS = [
+  "uploader-file-preview mat-progress-spinner",
+  "uploader-file-preview .loading",
+  ".file-preview-container .loading",
+];
+
+function countAttachmentPreviews(): number {
+  for (const selector of ATTACHMENT_PREVIEW_SELECTORS) {
+    const count = document.querySelectorAll(selector).length;
+    if (count > 0) return count;
+  }
+  return 0;
+}
+
+function isAttachmentUploading(): boolean {
+  return ATTACHMENT_LOADING_SELECTORS.some((s) => document.querySelector(s) !== null);
+}
+
+/**
+ * 等待附件预览数量达到 expected 且全部上传完成
+ */
+async function waitForAttachmentPreviews(expected: number, timeoutMs: number): Promise<boolean> {
+  const start = Date.now();
+  while (Date.now() - start < timeoutMs) {
+    if (countAttachmentPreviews() >= expected && !isAttachmentUploading()) {
+      return true;
+    }
+    await sleep(300);
+  }
+  return false;
+}
+
+function attachmentToFile(att: Attachment): File {
+  const binary = atob(att.data);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return new File([bytes], att.name, { type: att.mime_type });
+}
+
+/**
+ * 将附件上传到输入框：优先模拟粘贴文件，失败时模拟拖放
+ */
+async function uploadAttachments(inputEl: HTMLElement, attachments: Attachment[]): Promise<boolean> {
+  const files = attachments.map(attachmentToFile);
+  const expected = countAttachmentPreviews() + files.length;
+
+  const buildTransfer = (): DataTransfer => {
+    const dataTransfer = new DataTransfer();
+    files.forEach((f) => dataTransfer.items.add(f));
+    return dataTransfer;
+  };
+
+  // 策略1：粘贴文件
+  simulateClick(inputEl);
+  inputEl.focus();
+  inputEl.dispatchEvent(
+    new ClipboardEvent("paste", {
+      clipboardData: buildTransfer(),
+      bubbles: true,
+      cancelable: true,
+    })
+  );
+  if (await waitForAttachmentPreviews(expected, 15000)) {
+    console.log("[Content] attachments uploaded via paste:", files.length);
+    return true;
+  }
+
+  // 策略2：拖放到输入框
+  console.log("[Content] paste upload not detected, trying drag and drop");
+  const dataTransfer = buildTransfer();
+  for (const type of ["dragenter", "dragover", "drop"]) {
+    inputEl.dispatchEvent(new DragEvent(type, { dataTransfer, bubbles: true, cancelable: true }));
+    await randomDelay(50, 150);
+  }
+  return waitForAttachmentPreviews(expected, 15000);
+}
+
 // ========== 核心消息处理 ==========
 
+// 当前正在处理的发送任务，供 CMD_CANCEL 中止
+interface ActiveTask {
+  id: string;
+  keepConversation: boolean;
+  cancelled: boolean;
+  pollTimer?: ReturnType<typeof setInterval>;
+}
+
+let activeTask: ActiveTask | null = null;
+
+/**
+ * 任务结束（完成、失败或进入收尾阶段）后清除当前任务，之后的 CMD_CANCEL 不再生效
+ */
+function endActiveTask(taskId: string): void {
+  if (activeTask?.id === taskId) {
+    if (activeTask.pollTimer) clearInterval(activeTask.pollTimer);
+    activeTask = null;
+  }
+}
+
+/**
+ * 判断任务是否已被 CMD_CANCEL 中止，中止后由 handleCancel 负责收尾
+ */
+function isCancelled(taskId: string): boolean {
+  return activeTask?.id !== taskId || activeTask.cancelled;
+}
+
 /**
  * 处理来自 Server 的发送消息指令
  */
 async function handleSendMessage(wsMsg: WSMessage): Promise<void> {
   const taskId = wsMsg.id || "";
-  const payload = wsMsg.payload as { prompt: string; conversation_id: string } | undefined;
+  const payload = wsMsg.payload as
+    | {
+        prompt: string;
+        conversation_id: string;
+        keep_conversation?: boolean;
+        mode?: string;
+        attachments?: Attachment[];
+      }
+    | undefined;
 
-  if (!payload?.prompt) {
-    sendError(taskId, "no prompt in payload");
+  if (!payload?.prompt && !payload?.attachments?.length) {
+    sendError(taskId, "no prompt in payload", "invalid_payload");
     return;
   }
 
+  activeTask = { id: taskId, keepConversation: !!payload.keep_conversation, cancelled: false };
+
   // 上报忙碌状态
   sendStatus("busy");
   overlay.setTaskStatus("processing", "准备中...");
-  console.log("[Content] sending prompt:", payload.prompt.substring(0, 50) + "...");
+  console.log("[Content] sending prompt:", (payload.prompt || "").substring(0, 50) + "...");
 
-  // 0. 如果没有 conversation_id，先创建新对话并选择 Pro 模型
+  // 0. 如果没有 conversation_id，先创建新对话；
+  //    否则确认 background 已将页面导航到指定对话
   if (!payload.conversation_id) {
     overlay.setTaskStatus("processing", "创建新对话...");
     await startNewConversation();
-    await ensureProModel();
+  } else if (getConversationId() !== payload.conversation_id) {
+    overlay.setTaskStatus("error", "对话未打开");
+    endActiveTask(taskId);
+    sendError(taskId, `conversation ${payload.conversation_id} is not open`, "conversation_not_open");
+    sendStatus("idle");
+    return;
   }
 
+  // 按 server 指定的模式选择模型（未指定时保持 Pro 的默认行为）
+  await ensureModel(payload.mode || "pro");
+
+  // 记录发送前已有的回复数量，避免把上一轮回复当作本轮结果
+  const baseline = countModelResponses();
+
   overlay.setTaskStatus("processing", "发送中...");
 
   // 1. 定位输入框
   const inputEl = findInputElement();
   if (!inputEl) {
-    overlay.setTaskStatus("error", "找不到输入框");
-    sendError(taskId, "cannot find input element");
+    endActiveTask(taskId);
+    if (isLoginRequired()) {
+      overlay.setTaskStatus("error", "需要登录");
+      sendError(taskId, "Gemini login required", "login_required");
+    } else {
+      overlay.setTaskStatus("error", "找不到输入框");
+      sendError(taskId, "cannot find input element", "input_not_found");
+    }
     sendStatus("idle");
     return;
   }
 
-  // 2. 模拟输入
-  simulateInput(inputEl, payload.prompt);
+  // 2. 先上传附件，再模拟输入
+  if (payload.attachments?.length) {
+    overlay.setTaskStatus("processing", "上传附件...");
+    if (!(await uploadAttachments(inputEl, payload.attachments))) {
+      if (isCancelled(taskId)) return;
+      overlay.setTaskStatus("error", "附件上传失败");
+      endActiveTask(taskId);
+      sendError(taskId, "attachment upload failed", "attachment_upload_failed");
+      sendStatus("idle");
+      return;
+    }
+  }
+  if (isCancelled(taskId)) return;
+  if (payload.prompt) {
+    simulateInput(inputEl, payload.prompt);
+  }
 
   // 3. 等待发送按钮变为可用并点击（输入后按钮可能需要一些时间才会启用）
   let sent = false;
@@ -666,37 +900,104 @@ async function handleSendMessage(wsMsg: WSMessage): Promise<void> {
         bubbles: true,
       })
     );
+
+    // Enter 也未能发送时输入框仍保留文本
+    await randomDelay(800, 1200);
+    if (payload.prompt && inputEl.textContent?.trim() && !isGenerating()) {
+      overlay.setTaskStatus("error", "找不到发送按钮");
+      endActiveTask(taskId);
+      sendError(taskId, "send button not found", "send_button_missing");
+      sendStatus("idle");
+      return;
+    }
   }
 
   overlay.setTaskStatus("processing", "等待回复...");
 
   // 4. 等待并监听回复
   await randomDelay(1500, 2500); // 等待 Gemini 开始生成
-  watchForReply(taskId);
+  if (isCancelled(taskId)) return;
+  const maxWait = payload.timeout ? payload.timeout * 1000 : DEFAULT_REPLY_TIMEOUT;
+  watchForReply(taskId, baseline, !!payload.keep_conversation, maxWait);
+}
+
+/**
+ * 处理取消指令：点击停止按钮、停止监听、按需删除对话后上报 idle
+ */
+async function handleCancel(taskId: string): Promise<void> {
+  if (!activeTask || activeTask.id !== taskId || activeTask.cancelled) {
+    console.log(`[Content] cancel ignored, task ${taskId} is not running`);
+    return;
+  }
+
+  const task = activeTask;
+  task.cancelled = true;
+  if (task.pollTimer) clearInterval(task.pollTimer);
+  overlay.setTaskStatus("processing", "取消中...");
+
+  const stopBtn = findStopButton();
+  if (stopBtn) {
+    simulateClick(stopBtn);
+    await randomDelay(500, 1000);
+  }
+
+  if (!task.keepConversation && isInExistingConversation()) {
+    overlay.setTaskStatus("processing", "删除对话...");
+    await deleteCurrentConversation().catch(() => {});
+  }
+
+  endActiveTask(taskId);
+  sendError(taskId, "task cancelled", "cancelled");
+  overlay.setTaskStatus("idle");
+  sendStatus("idle");
+}
+
+/**
+ * 处理删除对话指令：background 已将页面导航到该对话
+ */
+async function handleDeleteConversation(wsMsg: WSMessage): Promise<void> {
+  const taskId = wsMsg.id || "";
+  const conversationId = (wsMsg.payload?.conversation_id as string) || "";
+
+  if (!conversationId || getConversationId() !== conversationId) {
+    sendError(taskId, `conversation ${conversationId} is not open`, "conversation_not_open");
+    return;
+  }
+
+  sendStatus("busy");
+  overlay.setTaskStatus("processing", "删除对话...");
+  await deleteCurrentConversation();
+  sendReply(taskId, "", "DONE");
+  overlay.setTaskStatus("idle");
+  sendStatus("idle");
 }
 
+// 指令未指定 timeout 时等待回复的最长时间（毫秒）
+const DEFAULT_REPLY_TIMEOUT = 120000;
+
 /**
  * 使用轮询方式监听回复（比 MutationObserver 更稳定）
+ * maxWait 为等待回复的最长时间（毫秒），由 server 按同步请求 / 异步任务 / 批处理的超时下发
  */
-function watchForReply(taskId: string): void {
+function watchForReply(taskId: string, baseline: number, keepConversation: boolean, maxWait: number): void {
   let lastText = "";
   let stableCount = 0;
   const STABLE_THRESHOLD = 3; // 文本连续 3 次不变 && 非生成中 => DONE
   const POLL_INTERVAL = 1000; // 每秒检查
-  const MAX_WAIT = 120000; // 最长等待 2 分钟
   const startTime = Date.now();
 
   const pollTimer = setInterval(() => {
     const elapsed = Date.now() - startTime;
-    if (elapsed > MAX_WAIT) {
+    if (elapsed > maxWait) {
       clearInterval(pollTimer);
+      endActiveTask(taskId);
       overlay.setTaskStatus("error", "超时");
-      sendError(taskId, "response timeout");
+      sendError(taskId, "response timeout", "response_timeout");
       sendStatus("idle");
       return;
     }
 
-    const currentTextAndHtml = getLastModelResponse();
+    const currentTextAndHtml = getLastModelResponse(baseline);
     const currentText = currentTextAndHtml[0];
     const currentHtml = currentTextAndHtml[1];
     const generating = isGenerating();
@@ -713,19 +1014,24 @@ function watchForReply(taskId: string): void {
       if (stableCount >= STABLE_THRESHOLD) {
         // 稳定了，先点击复制按钮获取 Markdown 内容，再发送 DONE
         clearInterval(pollTimer);
+        endActiveTask(taskId);
         overlay.setTaskStatus("processing", "复制内容...");
         clickCopyAndGetMarkdown(currentHtml).then(async (markdown) => {
           const finalText = markdown || currentText;
-          // 先删除对话，再发送 DONE
-          overlay.setTaskStatus("processing", "删除对话...");
-          await deleteCurrentConversation();
+          // 先删除对话，再发送 DONE（固定会话保留对话供后续轮次使用）
+          if (!keepConversation) {
+            overlay.setTaskStatus("processing", "删除对话...");
+            await deleteCurrentConversation();
+          }
           sendReply(taskId, finalText, "DONE");
           overlay.setTaskStatus("idle");
           sendStatus("idle");
         }).catch(async () => {
           // 即使复制失败也用 DOM 提取的文本兜底
-          overlay.setTaskStatus("processing", "删除对话...");
-          await deleteCurrentConversation().catch(() => {});
+          if (!keepConversation) {
+            overlay.setTaskStatus("processing", "删除对话...");
+            await deleteCurrentConversation().catch(() => {});
+          }
           sendReply(taskId, currentText, "DONE");
           overlay.setTaskStatus("idle");
           sendStatus("idle");
@@ -735,29 +1041,34 @@ function watchForReply(taskId: string): void {
       stableCount = 0;
     }
   }, POLL_INTERVAL);
+  if (activeTask?.id === taskId) {
+    activeTask.pollTimer = pollTimer;
+  }
 }
 
 // ========== 消息发送工具 ==========
 
 function sendReply(taskId: string, text: string, status: "PROCESSING" | "DONE"): void {
   const conversationId = getConversationId();
+  // 上报网页端实际使用的模型，server 据此确定响应中的 model 字段
+  const model = getCurrentModelName();
   chrome.runtime.sendMessage({
     action: "wsReply",
     data: {
       reply_to: taskId,
       type: "EVENT_REPLY",
-      payload: { text, status, conversation_id: conversationId },
+      payload: { text, status, conversation_id: conversationId, model },
     },
   });
 }
 
-function sendError(taskId: string, error: string): void {
+function sendError(taskId: string, error: string, code: ErrorCode): void {
   chrome.runtime.sendMessage({
     action: "wsReply",
     data: {
       reply_to: taskId,
       type: "EVENT_ERROR",
-      payload: { error },
+      payload: { error, code },
     },
   });
 }
@@ -773,6 +1084,17 @@ function sendStatus(status: "idle" | "busy"): void {
   });
 }
 
+function sendDegraded(reason: "login_required" | "rate_limited_by_gemini"): void {
+  console.log(`[Content] reporting degraded: ${reason}`);
+  chrome.runtime.sendMessage({
+    action: "wsReply",
+    data: {
+      type: "EVENT_DEGRADED",
+      payload: { reason },
+    },
+  });
+}
+
 function sleep(ms: number): Promise<void> {
   return new Promise((resolve) => setTimeout(resolve, ms));
 }
@@ -812,10 +1134,19 @@ function simulateClick(el: HTMLElement): void {
 
 chrome.runtime.onMessage.addListener(
   (message: InternalMessage, _sender, sendResponse) => {
-    if (message.action === "sendMessage") {
+    if (message.action === "cancel") {
+      const wsMsg = message.data as WSMessage;
+      console.log("[Content] received cancel:", wsMsg.id);
+      handleCancel(wsMsg.id || "");
+      sendResponse({ received: true });
+    } else if (message.action === "sendMessage") {
       const wsMsg = message.data as WSMessage;
       console.log("[Content] received command:", wsMsg.type, wsMsg.id);
-      handleSendMessage(wsMsg);
+      if (wsMsg.type === "CMD_DELETE_CONVERSATION") {
+        handleDeleteConversation(wsMsg);
+      } else {
+        handleSendMessage(wsMsg);
+      }
       sendResponse({ received: true });
     }
     return true;
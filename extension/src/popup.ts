@@ -1,6 +1,8 @@
 import { DEFAULT_CONFIG, ExtensionConfig } from "./types";
 
 const wsUrlInput = document.getElementById("wsUrl") as HTMLInputElement;
+const tokenInput = document.getElementById("token") as HTMLInputElement;
+const transportSelect = document.getElementById("transport") as HTMLSelectElement;
 const saveBtn = document.getElementById("saveBtn") as HTMLButtonElement;
 const messageEl = document.getElementById("message") as HTMLDivElement;
 const statusDot = document.getElementById("statusDot") as HTMLSpanElement;
@@ -11,12 +13,16 @@ async function loadConfig(): Promise<void> {
   const result = await chrome.storage.local.get("config");
   const config: ExtensionConfig = result.config || DEFAULT_CONFIG;
   wsUrlInput.value = config.wsUrl;
+  tokenInput.value = config.token || "";
+  transportSelect.value = config.transport || "websocket";
 }
 
 // 保存配置
 async function saveConfig(): Promise<void> {
   const config: ExtensionConfig = {
     wsUrl: wsUrlInput.value.trim() || DEFAULT_CONFIG.wsUrl,
+    token: tokenInput.value.trim(),
+    transport: transportSelect.value as ExtensionConfig["transport"],
   };
 
   await chrome.storage.local.set({ config });
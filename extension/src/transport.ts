@@ -0,0 +1,70 @@
+import { WSMessage } from "./types";
+
+// native messaging host 名称，需先以 server -install-native-host <插件 ID> 注册
+export const NATIVE_HOST_NAME = "com.kodatao.gemini_web_proxy";
+
+// 与 server 的连接：WebSocket（默认）或经 native messaging host 中转，两者承载同一套消息协议
+export interface ServerConnection {
+  send(msg: WSMessage): void;
+  isOpen(): boolean;
+  // 主动关闭，不触发 onClose
+  close(): void;
+}
+
+export interface ConnectionHandlers {
+  onOpen(): void;
+  onMessage(msg: WSMessage): void;
+  // code 为 WebSocket 关闭码，native messaging 断开时为 undefined
+  onClose(code?: number, reason?: string): void;
+}
+
+// 建立 WebSocket 连接
+export function openWebSocket(url: string, handlers: ConnectionHandlers): ServerConnection {
+  const ws = new WebSocket(url);
+
+  ws.onopen = () => handlers.onOpen();
+  ws.onmessage = (event: MessageEvent) => {
+    try {
+      handlers.onMessage(JSON.parse(event.data));
+    } catch (err) {
+      console.error("[BG] invalid message:", err);
+    }
+  };
+  ws.onclose = (event: CloseEvent) => handlers.onClose(event.code, event.reason);
+  ws.onerror = (err) => {
+    console.error("[BG] WebSocket error:", err);
+  };
+
+  return {
+    send: (msg) => ws.send(JSON.stringify(msg)),
+    isOpen: () => ws.readyState === WebSocket.OPEN,
+    close: () => {
+      ws.onclose = null;
+      ws.close();
+    },
+  };
+}
+
+// 启动 native messaging host 并建立连接，host 负责与 server 之间的转发与认证
+export function openNative(handlers: ConnectionHandlers): ServerConnection {
+  const port = chrome.runtime.connectNative(NATIVE_HOST_NAME);
+  let open = true;
+
+  port.onMessage.addListener((msg: WSMessage) => handlers.onMessage(msg));
+  port.onDisconnect.addListener(() => {
+    open = false;
+    handlers.onClose(undefined, chrome.runtime.lastError?.message);
+  });
+
+  // connectNative 没有连接成功事件，host 启动失败时会立即触发 onDisconnect
+  setTimeout(() => open && handlers.onOpen(), 0);
+
+  return {
+    send: (msg) => port.postMessage(msg),
+    isOpen: () => open,
+    close: () => {
+      open = false;
+      port.disconnect();
+    },
+  };
+}
@@ -4,6 +4,7 @@ export interface WSMessage {
   reply_to?: string;
   type: string;
   payload?: Record<string, unknown>;
+  ack_id?: string; // 需要以 EVENT_ACK 确认的指令投递 ID，重投时不变
 }
 
 // 服务端 -> 插件 指令
@@ -12,6 +13,39 @@ export interface CmdSendMessage extends WSMessage {
   payload: {
     prompt: string;
     conversation_id: string;
+    keep_conversation?: boolean; // 为 true 时完成后不删除对话
+    mode?: string; // 期望的网页端模型模式：pro/flash/thinking
+    attachments?: Attachment[]; // 输入 prompt 前需上传的附件
+    timeout?: number; // 等待回复的最长时间（秒），未指定时为 120 秒
+  };
+}
+
+// 随 CMD_SEND_MESSAGE 下发的附件
+export interface Attachment {
+  name: string;
+  mime_type: string;
+  data: string; // base64
+}
+
+export interface CmdDeleteConversation extends WSMessage {
+  type: "CMD_DELETE_CONVERSATION";
+  payload: {
+    conversation_id: string;
+  };
+}
+
+// 中止正在处理的任务：点击停止、清理对话后以 EVENT_ERROR 结束并上报 idle
+export interface CmdCancel extends WSMessage {
+  type: "CMD_CANCEL";
+  id: string;
+}
+
+// 对 EVENT_RESUME 的答复：resumed 中的任务继续上报回复，rejected 中的任务已在 server 端结束，需停止并清理
+export interface CmdResumeResult extends WSMessage {
+  type: "CMD_RESUME_RESULT";
+  payload: {
+    resumed: string[];
+    rejected: string[];
   };
 }
 
@@ -23,6 +57,7 @@ export interface EventReply extends WSMessage {
     text: string;
     status: "PROCESSING" | "DONE";
     conversation_id: string;
+    model?: string; // 网页端实际使用的模型（选择器文案）
   };
 }
 
@@ -31,6 +66,67 @@ export interface EventError extends WSMessage {
   reply_to: string;
   payload: {
     error: string;
+    code: ErrorCode; // server 据此映射 HTTP 状态码与 OpenAI error.type/code
+  };
+}
+
+// EVENT_ERROR 错误码
+export type ErrorCode =
+  | "invalid_payload"
+  | "conversation_not_open"
+  | "input_not_found"
+  | "login_required"
+  | "rate_limited_by_gemini"
+  | "send_button_missing"
+  | "attachment_upload_failed"
+  | "response_timeout"
+  | "cancelled"
+  | "tab_not_found"
+  | "forward_failed";
+
+// 插件主动上报 Gemini 额度用尽或登录失效，server 据此将 worker 标记为降级
+export interface EventDegraded extends WSMessage {
+  type: "EVENT_DEGRADED";
+  payload: {
+    reason: "login_required" | "rate_limited_by_gemini";
+  };
+}
+
+// 连接建立后首先上报插件版本、浏览器、登录账号与能力列表
+// server 据此拒绝需要插件不具备能力的请求；版本低于 server 要求时以关闭码 4001 断开
+export interface EventHello extends WSMessage {
+  type: "EVENT_HELLO";
+  payload: {
+    version: string;
+    browser: string;
+    account: string;
+    capabilities: Capability[];
+  };
+}
+
+// 插件能力
+export type Capability =
+  | "attachments"
+  | "cancel"
+  | "model_selection"
+  | "conversations"
+  | "resume"
+  | "ack";
+
+// 确认收到带 ack_id 的指令，server 未在 ack_timeout 内收到确认会重投同一指令
+export interface EventAck extends WSMessage {
+  type: "EVENT_ACK";
+  reply_to: string;
+  payload: {
+    ack_id: string;
+  };
+}
+
+// 重连后上报断开前仍在进行中的任务，server 将其重新绑定到当前连接
+export interface EventResume extends WSMessage {
+  type: "EVENT_RESUME";
+  payload: {
+    tasks: string[];
   };
 }
 
@@ -43,6 +139,8 @@ export interface InternalMessage {
 // 插件配置
 export interface ExtensionConfig {
   wsUrl: string;
+  token?: string; // 插件 Token，握手时以 ?token= 发送，对应 server 的 websocket.token
+  transport?: "websocket" | "native"; // 连接方式，native 经 native messaging host 中转（无法连接本地端口时使用）
 }
 
 export const DEFAULT_CONFIG: ExtensionConfig = {
@@ -1,16 +1,31 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server    ServerConfig    `yaml:"server"`
-	Database  DatabaseConfig  `yaml:"database"`
-	WebSocket WebSocketConfig `yaml:"websocket"`
-	APIKey    string          `yaml:"api_key"` // 可选，为空则不验证
+	Server      ServerConfig     `yaml:"server"`
+	Database    DatabaseConfig   `yaml:"database"`
+	WebSocket   WebSocketConfig  `yaml:"websocket"`
+	Native      NativeConfig     `yaml:"native"`
+	Queue       QueueConfig      `yaml:"queue"`
+	Attachments AttachmentConfig `yaml:"attachments"`
+	Repair      RepairConfig     `yaml:"repair"`
+	Limits      LimitsConfig     `yaml:"limits"`
+	Jobs        JobsConfig       `yaml:"jobs"`
+	Batch       BatchConfig      `yaml:"batch"`
+	Models      []ModelConfig    `yaml:"models"`  // 可接受的模型列表，第一个为默认模型
+	APIKey      string           `yaml:"api_key"` // 可选，为空则不验证
+
+	// ModelAliases 模型别名表：别名 -> models 中的模型 ID（如 gpt-4o -> gemini-pro）
+	ModelAliases map[string]string `yaml:"model_aliases"`
 }
 
 type ServerConfig struct {
@@ -25,6 +40,84 @@ type DatabaseConfig struct {
 type WebSocketConfig struct {
 	PingInterval int `yaml:"ping_interval"`
 	PongTimeout  int `yaml:"pong_timeout"`
+
+	// ResumeTimeout 插件断开后等待其重连并恢复进行中任务的时间（秒），0 表示断开即判定任务失败
+	ResumeTimeout int `yaml:"resume_timeout"`
+
+	// Token 插件连接 /ws 时需提供的 token（?token= 或 Authorization: Bearer），与 API Key 相互独立
+	// 必须设置，为空时由 EnsureWSToken 生成并保存到 TokenFile
+	Token string `yaml:"token"`
+	// AllowedOrigins 允许的握手 Origin，支持 * 通配（如 chrome-extension://*），为空则不校验；配置后不带 Origin 的连接同样被拒绝
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// AckTimeout 等待插件以 EVENT_ACK 确认指令的时间（秒），超时后重投；0 表示不要求确认
+	AckTimeout int `yaml:"ack_timeout"`
+	// AckRetries 指令未被确认时的最大重投次数，仍未确认则请求以 extension_unresponsive 失败
+	AckRetries int `yaml:"ack_retries"`
+
+	// MinExtensionVersion 插件最低版本，低于该版本或未上报 EVENT_HELLO 的插件不会被分配任务，为空则不限制
+	MinExtensionVersion string `yaml:"min_extension_version"`
+}
+
+// NativeConfig native messaging 传输配置：插件无法连接本地 WebSocket 时，经 native messaging host 中转
+// host 由浏览器启动，通过 Listen 地址连接 server，token 与 websocket.token 相同
+type NativeConfig struct {
+	Listen string `yaml:"listen"` // 供 host 连接的本地地址（如 127.0.0.1:6544），为空则不启用
+}
+
+// QueueConfig 请求排队配置：所有 worker 忙碌时请求进入 FIFO 队列等待
+type QueueConfig struct {
+	MaxSize int `yaml:"max_size"` // 最大排队数，0 表示不排队（直接返回 429）
+	MaxWait int `yaml:"max_wait"` // 最长等待时间（秒）
+}
+
+// AttachmentConfig 附件（图片/文件）配置：附件解码后保存在 Dir 中并随指令发送给插件上传
+type AttachmentConfig struct {
+	Dir          string   `yaml:"dir"`           // 附件保存目录
+	MaxSize      int      `yaml:"max_size"`      // 单个附件最大大小（MB）
+	MaxCount     int      `yaml:"max_count"`     // 单次请求最多附件数
+	AllowedTypes []string `yaml:"allowed_types"` // 允许的 MIME 类型
+}
+
+// RepairConfig 回复格式不符合要求（工具调用无法解析、JSON 输出校验失败）时的纠正重试配置
+type RepairConfig struct {
+	MaxRetries int `yaml:"max_retries"` // 携带错误说明重新询问的最大次数，0 表示不重试
+}
+
+// LimitsConfig Gemini 网页端额度用尽、登录失效的识别配置
+// 插件回复（DONE）较短且包含任一特征文本时视为对应的提示页面而非正常回答，匹配不区分大小写
+type LimitsConfig struct {
+	UsageLimitSignatures []string `yaml:"usage_limit_signatures"` // 额度用尽提示的特征文本
+	LoginSignatures      []string `yaml:"login_signatures"`       // 登录失效提示的特征文本
+	RetryAfter           int      `yaml:"retry_after"`            // 额度用尽时建议客户端的重试间隔（秒）
+}
+
+// JobsConfig 异步任务（/v1/jobs）配置：任务在后台执行，完成后可回调通知
+type JobsConfig struct {
+	Timeout         int    `yaml:"timeout"`          // 单个任务等待插件回复的超时（秒），随指令下发给插件，不受同步请求的 120s 限制
+	CallbackSecret  string `yaml:"callback_secret"`  // 回调请求的 HMAC-SHA256 签名密钥，为空则不签名
+	CallbackRetries int    `yaml:"callback_retries"` // 回调失败后的最大重试次数
+
+	// AllowPrivateCallbacks 允许回调地址指向回环、内网等非公网地址（如本机的 webhook 服务），默认拒绝以防 SSRF
+	AllowPrivateCallbacks bool `yaml:"allow_private_callbacks"`
+}
+
+// BatchConfig 批处理（/v1/files + /v1/batches）配置：批处理逐个排队执行，批内请求按间隔依次发送
+type BatchConfig struct {
+	Dir         string `yaml:"dir"`           // 输入/输出文件保存目录
+	MaxFileSize int    `yaml:"max_file_size"` // 上传文件最大大小（MB）
+	Interval    int    `yaml:"interval"`      // 相邻两个请求之间的间隔（秒），避免过快触发网页端限流
+	Timeout     int    `yaml:"timeout"`       // 单个请求等待插件回复的超时（秒），随指令下发给插件
+}
+
+// ModelConfig 模型目录中的一项，对应 /v1/models 返回的模型
+type ModelConfig struct {
+	ID      string `yaml:"id"`
+	OwnedBy string `yaml:"owned_by"`
+	Mode    string `yaml:"mode"` // Gemini 网页端模式：pro/flash/thinking，为空则不切换
+
+	// Fallback 该模型额度用尽时依次改用的模型 ID（如 gemini-pro -> gemini-flash），为空则直接返回 429
+	Fallback []string `yaml:"fallback,omitempty"`
 }
 
 // Default 返回默认配置
@@ -33,10 +126,91 @@ func Default() *Config {
 		Server:   ServerConfig{Port: 6543, Mode: "release"},
 		Database: DatabaseConfig{Path: "./data.db"},
 		WebSocket: WebSocketConfig{
-			PingInterval: 30,
-			PongTimeout:  10,
+			PingInterval:   30,
+			PongTimeout:    10,
+			ResumeTimeout:  30,
+			AckTimeout:     10,
+			AckRetries:     2,
+			AllowedOrigins: []string{"chrome-extension://*"},
+		},
+		Queue: QueueConfig{
+			MaxSize: 20,
+			MaxWait: 120,
+		},
+		Attachments: AttachmentConfig{
+			Dir:      "./attachments",
+			MaxSize:  20,
+			MaxCount: 10,
+			AllowedTypes: []string{
+				"image/png", "image/jpeg", "image/webp", "image/gif", "image/heic",
+				"application/pdf", "text/plain", "text/csv", "text/markdown",
+			},
 		},
+		Repair: RepairConfig{MaxRetries: 2},
+		Limits: LimitsConfig{
+			UsageLimitSignatures: []string{
+				"you've reached your limit",
+				"you have reached your limit",
+				"reached your usage limit",
+				"已达到使用上限",
+				"已达到上限",
+			},
+			LoginSignatures: []string{
+				"sign in to continue",
+				"sign in to gemini",
+				"登录以继续",
+			},
+			RetryAfter: 3600,
+		},
+		Jobs: JobsConfig{
+			Timeout:         1800,
+			CallbackRetries: 3,
+		},
+		Batch: BatchConfig{
+			Dir:         "./batches",
+			MaxFileSize: 100,
+			Interval:    5,
+			Timeout:     1800,
+		},
+		Models: []ModelConfig{
+			{ID: "gemini", OwnedBy: "google", Mode: "pro"},
+			{ID: "gemini-pro", OwnedBy: "google", Mode: "pro"},
+			{ID: "gemini-flash", OwnedBy: "google", Mode: "flash"},
+			{ID: "gemini-thinking", OwnedBy: "google", Mode: "thinking"},
+		},
+	}
+}
+
+// TokenFile 未配置 websocket.token 时生成的插件 token 的保存位置（与数据库同目录）
+func (c *Config) TokenFile() string {
+	return filepath.Join(filepath.Dir(c.Database.Path), "ws_token")
+}
+
+// EnsureWSToken 未配置插件 token 时读取 TokenFile 中保存的 token，不存在则随机生成并保存
+// 返回 true 表示 token 来自 TokenFile
+func (c *Config) EnsureWSToken() (bool, error) {
+	if c.WebSocket.Token != "" {
+		return false, nil
+	}
+	path := c.TokenFile()
+	if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) != "" {
+		c.WebSocket.Token = strings.TrimSpace(string(data))
+		return true, nil
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return false, err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return false, err
 	}
+	c.WebSocket.Token = token
+	return true, nil
 }
 
 // Load 从文件加载配置，以默认值为基础覆盖
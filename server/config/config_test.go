@@ -66,6 +66,65 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.WebSocket.PongTimeout != 10 {
 		t.Errorf("expected default pong_timeout 10, got %d", cfg.WebSocket.PongTimeout)
 	}
+	if cfg.Queue.MaxSize != 20 || cfg.Queue.MaxWait != 120 {
+		t.Errorf("expected default queue 20/120s, got %d/%ds", cfg.Queue.MaxSize, cfg.Queue.MaxWait)
+	}
+	if len(cfg.Models) == 0 || cfg.Models[0].ID != "gemini" {
+		t.Errorf("expected default model catalog starting with gemini, got %v", cfg.Models)
+	}
+	if cfg.Repair.MaxRetries != 2 {
+		t.Errorf("expected default repair max_retries 2, got %d", cfg.Repair.MaxRetries)
+	}
+	if cfg.Limits.RetryAfter != 3600 || len(cfg.Limits.UsageLimitSignatures) == 0 || len(cfg.Limits.LoginSignatures) == 0 {
+		t.Errorf("unexpected default limits config: %+v", cfg.Limits)
+	}
+	if len(cfg.WebSocket.AllowedOrigins) != 1 || cfg.WebSocket.Token != "" {
+		t.Errorf("unexpected default websocket auth config: %+v", cfg.WebSocket)
+	}
+	if cfg.WebSocket.ResumeTimeout != 30 {
+		t.Errorf("expected default resume timeout 30, got %d", cfg.WebSocket.ResumeTimeout)
+	}
+	if cfg.Batch.Dir != "./batches" || cfg.Batch.Interval != 5 || cfg.Batch.MaxFileSize != 100 {
+		t.Errorf("unexpected default batch config: %+v", cfg.Batch)
+	}
+	if cfg.Jobs.Timeout != 1800 || cfg.Jobs.CallbackRetries != 3 {
+		t.Errorf("unexpected default jobs config: %+v", cfg.Jobs)
+	}
+	if cfg.Attachments.Dir != "./attachments" || cfg.Attachments.MaxSize != 20 || len(cfg.Attachments.AllowedTypes) == 0 {
+		t.Errorf("unexpected default attachments config: %+v", cfg.Attachments)
+	}
+}
+
+func TestLoadModels(t *testing.T) {
+	content := `
+models:
+  - id: my-model
+    owned_by: me
+    mode: flash
+model_aliases:
+  gpt-4o: my-model
+`
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// 配置文件中的模型列表整体替换默认列表
+	if len(cfg.Models) != 1 || cfg.Models[0].ID != "my-model" || cfg.Models[0].OwnedBy != "me" {
+		t.Errorf("expected models [my-model], got %v", cfg.Models)
+	}
+	if cfg.Models[0].Mode != "flash" {
+		t.Errorf("expected mode flash, got %s", cfg.Models[0].Mode)
+	}
+	if cfg.ModelAliases["gpt-4o"] != "my-model" {
+		t.Errorf("expected alias gpt-4o -> my-model, got %v", cfg.ModelAliases)
+	}
 }
 
 func TestLoadFileNotFound(t *testing.T) {
@@ -74,3 +133,30 @@ func TestLoadFileNotFound(t *testing.T) {
 		t.Error("expected error for nonexistent file")
 	}
 }
+
+func TestEnsureWSToken(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Path = filepath.Join(t.TempDir(), "data.db")
+
+	// 未配置时生成并保存，再次调用读取同一个 token
+	generated, err := cfg.EnsureWSToken()
+	if err != nil || !generated || len(cfg.WebSocket.Token) < 32 {
+		t.Fatalf("expected a generated token, got %q (%v)", cfg.WebSocket.Token, err)
+	}
+	if info, err := os.Stat(cfg.TokenFile()); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected token file with 0600, got %v (%v)", info, err)
+	}
+	again := Default()
+	again.Database.Path = cfg.Database.Path
+	if _, err := again.EnsureWSToken(); err != nil || again.WebSocket.Token != cfg.WebSocket.Token {
+		t.Errorf("expected the saved token %q, got %q", cfg.WebSocket.Token, again.WebSocket.Token)
+	}
+
+	// 已配置的 token 不被替换
+	configured := Default()
+	configured.Database.Path = cfg.Database.Path
+	configured.WebSocket.Token = "ext-secret"
+	if generated, _ := configured.EnsureWSToken(); generated || configured.WebSocket.Token != "ext-secret" {
+		t.Errorf("configured token was replaced: %q", configured.WebSocket.Token)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandRedelivery(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.AckTimeout = 1
+	hub.cfg.AckRetries = 2
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+	sendHello(t, conn, HelloPayload{Version: "0.2.0", Capabilities: []string{CapAck}})
+	time.Sleep(100 * time.Millisecond)
+
+	if err := hub.SendCommand(hub.GetClient(), &WSMessage{ID: "task-1", Type: "CMD_SEND_MESSAGE"}); err != nil {
+		t.Fatalf("send command: %v", err)
+	}
+	first := readUntil(t, conn, "CMD_SEND_MESSAGE")
+	if first.AckID == "" {
+		t.Fatal("expected the command to carry an ack_id")
+	}
+
+	// 未确认的指令以同一 ack_id 重投
+	second := readUntil(t, conn, "CMD_SEND_MESSAGE")
+	if second.AckID != first.AckID || second.ID != "task-1" {
+		t.Fatalf("expected redelivery of the same command, got %+v", second)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"ack_id": first.AckID})
+	conn.WriteJSON(WSMessage{ReplyTo: "task-1", Type: "EVENT_ACK", Payload: payload})
+	time.Sleep(100 * time.Millisecond)
+
+	hub.mu.RLock()
+	pending := len(hub.acks)
+	hub.mu.RUnlock()
+	if pending != 0 {
+		t.Errorf("expected no pending acks, got %d", pending)
+	}
+	conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err == nil && msg.Type == "CMD_SEND_MESSAGE" {
+		t.Errorf("acknowledged command should not be redelivered")
+	}
+}
+
+func TestChatUnacknowledgedCommand(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	hub.cfg.AckTimeout = 1
+	hub.cfg.AckRetries = 0
+
+	// 插件声明支持 ack，但从不确认
+	conn := dialWS(t, server)
+	defer conn.Close()
+	sendHello(t, conn, HelloPayload{Version: "0.2.0", Capabilities: []string{CapAck, CapModelSelection}})
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}]}`))
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "extension_unresponsive") {
+		t.Fatalf("expected 503 extension_unresponsive, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected a fast failure, took %s", elapsed)
+	}
+	if workers := hub.Workers(); workers[0].TaskID != "" {
+		t.Errorf("expected the worker to be released, got task %s", workers[0].TaskID)
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// AdminHandler 提供运维查询接口（worker 列表、统计等）
+type AdminHandler struct {
+	Hub    *Hub
+	Chat   *ChatHandler
+	apiKey string // API Key，为空则不验证
+}
+
+// NewAdminHandler 创建 AdminHandler 实例
+func NewAdminHandler(hub *Hub, chat *ChatHandler, apiKey string) *AdminHandler {
+	return &AdminHandler{
+		Hub:    hub,
+		Chat:   chat,
+		apiKey: apiKey,
+	}
+}
+
+// ListWorkers 处理 GET /admin/workers，返回所有已连接 worker 的状态与统计
+func (h *AdminHandler) ListWorkers(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	workers := h.Hub.Workers()
+	idle := 0
+	for _, w := range workers {
+		if w.Status == "idle" {
+			idle++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   workers,
+		"total":  len(workers),
+		"idle":   idle,
+	})
+}
+
+// GetWorker 处理 GET /admin/workers/:id，返回单个 worker 的状态与统计
+func (h *AdminHandler) GetWorker(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	id := c.Param("id")
+	for _, w := range h.Hub.Workers() {
+		if w.ID == id {
+			c.JSON(http.StatusOK, w)
+			return
+		}
+	}
+	writeOpenAIError(c, &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "worker_not_found", Message: fmt.Sprintf("worker %s not found", id)})
+}
+
+// Metrics 处理 GET /admin/metrics，返回插件消息队列与回复分发的背压统计
+func (h *AdminHandler) Metrics(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"incoming": h.Hub.IncomingMetrics(),
+		"replies":  h.Chat.TaskManager.Metrics(),
+		"queue":    h.Chat.Queue.Len(),
+	})
+}
+
+// ListTasks 处理 GET /admin/tasks，按创建时间倒序返回任务，可用 state 过滤、limit 限制条数（默认 50）
+func (h *AdminHandler) ListTasks(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	query := h.Chat.DB.Order("created_at DESC").Limit(limit)
+	if state := c.Query("state"); state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	var tasks []model.Task
+	query.Find(&tasks)
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   tasks,
+	})
+}
+
+// GetTask 处理 GET /admin/tasks/:id，返回任务状态及其关联的 user / model 消息
+func (h *AdminHandler) GetTask(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	var task model.Task
+	if err := h.Chat.DB.Preload("Messages").First(&task, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeOpenAIError(c, errTaskNotFound(c.Param("id")))
+		} else {
+			writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// CancelTask 处理 POST /admin/tasks/:id/cancel，取消进行中（含排队中）的任务
+// 插件收到 CMD_CANCEL 后点击停止、清理对话并上报 idle
+func (h *AdminHandler) CancelTask(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	id := c.Param("id")
+	if !h.Chat.CancelTask(id) {
+		writeOpenAIError(c, errTaskNotFound(id))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":        id,
+		"object":    "task.cancelled",
+		"cancelled": true,
+	})
+}
+
+// errTaskNotFound 任务不存在或已结束（无法取消）
+func errTaskNotFound(id string) *apiError {
+	return &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "task_not_found", Message: fmt.Sprintf("task %s not found", id)}
+}
@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anthropic Messages API 兼容请求/响应结构
+
+type AnthropicRequest struct {
+	Model     string             `json:"model"`
+	System    json.RawMessage    `json:"system,omitempty"` // string 或 text block 数组
+	Messages  []AnthropicMessage `json:"messages"`
+	MaxTokens int                `json:"max_tokens,omitempty"`
+	Stream    bool               `json:"stream"`
+	Metadata  *AnthropicMetadata `json:"metadata,omitempty"`
+}
+
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"` // 作为固定会话 ID
+}
+
+type AnthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // string 或 content block 数组
+}
+
+type AnthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text"`
+	Source *AnthropicBlockSource `json:"source,omitempty"` // image / document block
+}
+
+type AnthropicBlockSource struct {
+	Type      string `json:"type"` // base64 或 url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// anthropicContent 将 string 或 content block 数组形式的内容拼接为纯文本
+// image / document block 转换为 content part，作为附件上传
+func anthropicContent(raw json.RawMessage) (string, []ContentPart, error) {
+	if len(raw) == 0 {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", nil, fmt.Errorf("content must be a string or an array of content blocks")
+	}
+	var texts []string
+	var parts []ContentPart
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "image", "document":
+			if b.Source == nil {
+				return "", nil, fmt.Errorf("%s block requires source", b.Type)
+			}
+			if b.Source.Type == "url" {
+				parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ContentImageURL{URL: b.Source.URL}})
+			} else {
+				parts = append(parts, ContentPart{Type: "file", File: &ContentFile{
+					FileData: fmt.Sprintf("data:%s;base64,%s", b.Source.MediaType, b.Source.Data),
+				}})
+			}
+		}
+	}
+	return strings.Join(texts, "\n"), parts, nil
+}
+
+// toChatRequest 将 Anthropic 请求转换为内部统一使用的 ChatRequest
+func (r *AnthropicRequest) toChatRequest() (*ChatRequest, error) {
+	req := &ChatRequest{Model: r.Model, Stream: r.Stream}
+	if r.Metadata != nil {
+		req.User = r.Metadata.UserID
+	}
+
+	system, _, err := anthropicContent(r.System)
+	if err != nil {
+		return nil, fmt.Errorf("system: %v", err)
+	}
+	if system != "" {
+		req.Messages = append(req.Messages, ChatMessage{Role: "system", Content: system})
+	}
+
+	for i, msg := range r.Messages {
+		text, parts, err := anthropicContent(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d: %v", i, err)
+		}
+		req.Messages = append(req.Messages, ChatMessage{Role: msg.Role, Content: text, Parts: parts})
+	}
+	return req, nil
+}
+
+// anthropicErrorType 根据 HTTP 状态码映射 Anthropic 错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+func anthropicErrorBody(e *apiError) gin.H {
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    anthropicErrorType(e.Status),
+			"message": e.Message,
+		},
+	}
+}
+
+// checkAnthropicKey 验证 x-api-key 头（同时兼容 Authorization: Bearer），失败时写入 401 响应
+func checkAnthropicKey(c *gin.Context, apiKey string) bool {
+	if apiKey == "" {
+		return true
+	}
+	key := c.GetHeader("x-api-key")
+	if key == "" {
+		key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if key != apiKey {
+		c.JSON(http.StatusUnauthorized, anthropicErrorBody(&apiError{
+			Status:  http.StatusUnauthorized,
+			Message: "invalid x-api-key",
+		}))
+		return false
+	}
+	return true
+}
+
+// HandleMessages 处理 POST /v1/messages（Anthropic Messages API）
+func (h *ChatHandler) HandleMessages(c *gin.Context) {
+	if !checkAnthropicKey(c, h.apiKey) {
+		return
+	}
+
+	var areq AnthropicRequest
+	if err := c.ShouldBindJSON(&areq); err != nil {
+		c.JSON(http.StatusBadRequest, anthropicErrorBody(&apiError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid request: %v", err),
+		}))
+		return
+	}
+	req, err := areq.toChatRequest()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, anthropicErrorBody(&apiError{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}))
+		return
+	}
+
+	// 流式请求在排队期间通过 SSE 注释行推送排队位置
+	streamStarted := false
+	var onPosition func(position int)
+	if req.Stream {
+		onPosition = func(position int) {
+			if !streamStarted {
+				setSSEHeaders(c)
+				c.Status(http.StatusOK)
+				streamStarted = true
+			}
+			fmt.Fprintf(c.Writer, ": queue position %d\n\n", position)
+			c.Writer.Flush()
+		}
+	}
+
+	task, apiErr := h.prepareTask(c, req, onPosition)
+	if apiErr != nil {
+		if c.Request.Context().Err() != nil {
+			return
+		}
+		if streamStarted {
+			writeAnthropicEvent(c, "error", anthropicErrorBody(apiErr))
+			return
+		}
+		c.JSON(apiErr.Status, anthropicErrorBody(apiErr))
+		return
+	}
+
+	var taskErr error
+	defer func() { h.finishTask(task, taskErr) }()
+
+	if req.Stream {
+		taskErr = h.handleAnthropicStream(c, task)
+	} else {
+		taskErr = h.handleAnthropicNonStream(c, task)
+	}
+}
+
+// anthropicMessageID 由任务 ID 生成 Anthropic 风格的消息 ID
+func anthropicMessageID(taskID string) string {
+	return "msg_" + strings.TrimPrefix(taskID, "chatcmpl-")
+}
+
+func (h *ChatHandler) handleAnthropicNonStream(c *gin.Context, task *chatTask) error {
+	payload, err := h.collectReply(task, nil)
+	if err != nil {
+		log.Printf("[Anthropic] task failed: %v", err)
+		apiErr := taskAPIError(err)
+		setRetryAfter(c, apiErr)
+		c.JSON(apiErr.Status, anthropicErrorBody(apiErr))
+		return err
+	}
+	h.saveReply(task, payload)
+
+	stopReason := "end_turn"
+	c.JSON(http.StatusOK, AnthropicResponse{
+		ID:         anthropicMessageID(task.ID),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      task.Model,
+		Content:    []AnthropicContentBlock{{Type: "text", Text: payload.Text}},
+		StopReason: &stopReason,
+	})
+	return nil
+}
+
+// handleAnthropicStream 按 message_start → content_block_* → message_delta → message_stop 顺序推送 SSE 事件
+func (h *ChatHandler) handleAnthropicStream(c *gin.Context, task *chatTask) error {
+	setSSEHeaders(c)
+
+	writeAnthropicEvent(c, "message_start", gin.H{
+		"type": "message_start",
+		"message": AnthropicResponse{
+			ID:      anthropicMessageID(task.ID),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   task.Model,
+			Content: []AnthropicContentBlock{},
+		},
+	})
+	writeAnthropicEvent(c, "content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         0,
+		"content_block": AnthropicContentBlock{Type: "text"},
+	})
+
+	payload, err := h.collectReply(task, func(delta string) {
+		writeAnthropicEvent(c, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": gin.H{"type": "text_delta", "text": delta},
+		})
+	})
+	if err != nil {
+		log.Printf("[Anthropic] stream error for task %s: %v", task.ID, err)
+		writeAnthropicEvent(c, "error", anthropicErrorBody(taskAPIError(err)))
+		return err
+	}
+	h.saveReply(task, payload)
+
+	writeAnthropicEvent(c, "content_block_stop", gin.H{"type": "content_block_stop", "index": 0})
+	writeAnthropicEvent(c, "message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": "end_turn", "stop_sequence": nil},
+		"usage": gin.H{"output_tokens": 0},
+	})
+	writeAnthropicEvent(c, "message_stop", gin.H{"type": "message_stop"})
+	return nil
+}
+
+// writeAnthropicEvent 写入带 event 名称的 SSE 事件
+func writeAnthropicEvent(c *gin.Context, event string, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, jsonData)
+	c.Writer.Flush()
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+func TestAnthropicNonStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{
+		"text":   "Hello from Gemini!",
+		"status": "DONE",
+	})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","max_tokens":1024,"system":"Be brief","messages":[{"role":"user","content":[{"type":"text","text":"Hello"}]}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp AnthropicResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response failed: %v", err)
+	}
+	if resp.Type != "message" || resp.Role != "assistant" {
+		t.Errorf("unexpected type/role: %s/%s", resp.Type, resp.Role)
+	}
+	if !strings.HasPrefix(resp.ID, "msg_") {
+		t.Errorf("expected id to start with msg_, got %s", resp.ID)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "Hello from Gemini!" {
+		t.Errorf("unexpected content: %+v", resp.Content)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "end_turn" {
+		t.Error("expected stop_reason end_turn")
+	}
+
+	// system 与 content block 应转换为 XML prompt
+	select {
+	case msg := <-received:
+		var p SendMessagePayload
+		json.Unmarshal(msg.Payload, &p)
+		if !strings.Contains(p.Prompt, `role="system"`) || !strings.Contains(p.Prompt, "Hello") {
+			t.Errorf("unexpected prompt: %s", p.Prompt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no command received")
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	p1, _ := json.Marshal(map[string]string{"text": "Hello", "status": "PROCESSING"})
+	p2, _ := json.Marshal(map[string]string{"text": "Hello there", "status": "PROCESSING"})
+	p3, _ := json.Marshal(map[string]string{"text": "Hello there", "status": "DONE"})
+	conn := simulateExtension(t, server, []WSMessage{
+		{Type: "EVENT_REPLY", Payload: p1},
+		{Type: "EVENT_REPLY", Payload: p2},
+		{Type: "EVENT_REPLY", Payload: p3},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","max_tokens":1024,"stream":true,"messages":[{"role":"user","content":"Hello"}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var events []string
+	var text strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		}
+		if strings.HasPrefix(line, "data: ") && events[len(events)-1] == "content_block_delta" {
+			var ev struct {
+				Delta struct {
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev)
+			text.WriteString(ev.Delta.Text)
+		}
+	}
+
+	expected := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected events: %v", events)
+	}
+	if text.String() != "Hello there" {
+		t.Errorf("expected assembled text 'Hello there', got %q", text.String())
+	}
+}
+
+func TestAnthropicAPIKeyAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken}
+	hub := NewHub(cfg)
+	tm := NewTaskManager()
+
+	tmpDir := t.TempDir()
+	db, _ := model.InitDB(filepath.Join(tmpDir, "test.db"))
+
+	chatHandler := NewChatHandler(hub, tm, db, testConfig("my-secret-key"))
+
+	r := gin.New()
+	r.POST("/v1/messages", chatHandler.HandleMessages)
+
+	reqBody := `{"model":"gemini","max_tokens":16,"messages":[{"role":"user","content":"Hello"}]}`
+
+	// 错误的 key → 401，Anthropic 错误格式
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(reqBody))
+	req.Header.Set("x-api-key", "wrong-key")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong key, got %d", w.Code)
+	}
+	var errResp struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Type != "error" || errResp.Error.Type != "authentication_error" {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+
+	// 正确的 key → 通过认证（无插件返回 503）
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(reqBody))
+	req.Header.Set("x-api-key", "my-secret-key")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with correct key (no extension), got %d", w.Code)
+	}
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// attachmentFetchTimeout 服务端下载 http(s) image_url 的超时时间
+const attachmentFetchTimeout = 30 * time.Second
+
+// outboundMaxRedirects 对外请求（下载 image_url、投递回调）最多跟随的重定向次数
+const outboundMaxRedirects = 5
+
+var errForbiddenAddress = errors.New("address is not allowed")
+
+// fetchAddrAllowed 判断 image_url 解析出的 IP 是否允许访问（测试中可替换）
+var fetchAddrAllowed = isPublicAddr
+
+// attachmentHTTPClient 下载 image_url 的客户端，只允许访问公网地址
+var attachmentHTTPClient = newFilteredHTTPClient(attachmentFetchTimeout, func(addr netip.Addr) bool { return fetchAddrAllowed(addr) })
+
+// newFilteredHTTPClient 创建对外请求的客户端：DNS 解析后按 IP 过滤，每次重定向同样过滤，防止 SSRF
+// allowed 判断目标 IP 是否允许访问
+func newFilteredHTTPClient(timeout time.Duration, allowed func(netip.Addr) bool) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// 不走环境变量中的代理，否则过滤的是代理地址而不是目标地址
+			Proxy: nil,
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					addr, err := netip.ParseAddrPort(address)
+					if err != nil || !allowed(addr.Addr()) {
+						return fmt.Errorf("%s: %w", address, errForbiddenAddress)
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkRedirect(req, via, allowed)
+		},
+	}
+}
+
+// sharedAddrSpace 运营商级 NAT 共享地址段（RFC 6598），常用于云厂商内网与 Tailscale 等组网
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddr 拒绝回环、内网、CGNAT 共享地址、链路本地（含云厂商 metadata 169.254.169.254）、组播与未指定地址
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && !addr.IsLoopback() && !addr.IsPrivate() && !sharedAddrSpace.Contains(addr) && !addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsMulticast() && !addr.IsUnspecified()
+}
+
+// checkRedirect 重定向目标同样只允许 http(s)；IP 字面量在此直接检查，域名由 Dialer 在解析后检查
+func checkRedirect(req *http.Request, via []*http.Request, allowed func(netip.Addr) bool) error {
+	if len(via) >= outboundMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", outboundMaxRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(req.URL.Hostname(), "[]")); err == nil && !allowed(addr) {
+		return fmt.Errorf("redirect to %s: %w", req.URL.Host, errForbiddenAddress)
+	}
+	return nil
+}
+
+// AttachmentPayload CMD_SEND_MESSAGE 中随 prompt 下发的附件，由插件在发送前上传到网页
+type AttachmentPayload struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"` // base64 编码的文件内容
+}
+
+// pendingAttachment 已解码、校验但尚未写入磁盘的附件
+type pendingAttachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+func errInvalidAttachment(format string, args ...interface{}) *apiError {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Type:    "invalid_request_error",
+		Code:    "invalid_attachment",
+		Param:   "messages",
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// decodeAttachments 解析 messages 中的 image_url / file part，下载、解码并校验大小与 MIME 类型
+func (h *ChatHandler) decodeAttachments(ctx context.Context, messages []ChatMessage) ([]*pendingAttachment, *apiError) {
+	var result []*pendingAttachment
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			var att *pendingAttachment
+			var apiErr *apiError
+			switch part.Type {
+			case "image_url":
+				if part.ImageURL == nil || part.ImageURL.URL == "" {
+					return nil, errInvalidAttachment("image_url part requires image_url.url")
+				}
+				att, apiErr = h.decodeImageURL(ctx, part.ImageURL.URL)
+			case "file":
+				if part.File == nil {
+					return nil, errInvalidAttachment("file part requires file")
+				}
+				att, apiErr = h.decodeFile(part.File)
+			default:
+				continue
+			}
+			if apiErr != nil {
+				return nil, apiErr
+			}
+
+			result = append(result, att)
+			if max := h.attachments.MaxCount; max > 0 && len(result) > max {
+				return nil, errInvalidAttachment("too many attachments (max %d)", max)
+			}
+		}
+	}
+	return result, nil
+}
+
+// decodeImageURL 支持 data URL 与 http(s) URL（由服务端下载）
+func (h *ChatHandler) decodeImageURL(ctx context.Context, rawURL string) (*pendingAttachment, *apiError) {
+	if strings.HasPrefix(rawURL, "data:") {
+		mimeType, data, err := parseDataURL(rawURL)
+		if err != nil {
+			return nil, errInvalidAttachment("invalid image data URL: %v", err)
+		}
+		return h.checkAttachment("", mimeType, data)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errInvalidAttachment("image_url must be a data URL or an http(s) URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errInvalidAttachment("invalid image_url: %v", err)
+	}
+	resp, err := attachmentHTTPClient.Do(req)
+	if errors.Is(err, errForbiddenAddress) {
+		return nil, errInvalidAttachment("image_url must point to a public address")
+	}
+	if err != nil {
+		return nil, errInvalidAttachment("failed to fetch image_url: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errInvalidAttachment("failed to fetch image_url: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, h.maxAttachmentBytes()+1))
+	if err != nil {
+		return nil, errInvalidAttachment("failed to fetch image_url: %v", err)
+	}
+	return h.checkAttachment(path.Base(u.Path), resp.Header.Get("Content-Type"), data)
+}
+
+// decodeFile file_data 为 data URL 或纯 base64；file_id 暂不支持
+func (h *ChatHandler) decodeFile(f *ContentFile) (*pendingAttachment, *apiError) {
+	if f.FileData == "" {
+		if f.FileID != "" {
+			return nil, errInvalidAttachment("file_id is not supported, use file_data")
+		}
+		return nil, errInvalidAttachment("file part requires file_data")
+	}
+
+	mimeType := ""
+	var data []byte
+	var err error
+	if strings.HasPrefix(f.FileData, "data:") {
+		mimeType, data, err = parseDataURL(f.FileData)
+	} else {
+		data, err = base64.StdEncoding.DecodeString(f.FileData)
+	}
+	if err != nil {
+		return nil, errInvalidAttachment("invalid file_data: %v", err)
+	}
+	if mimeType == "" && f.Filename != "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(f.Filename))
+	}
+	return h.checkAttachment(f.Filename, mimeType, data)
+}
+
+// parseDataURL 解析 data:<mime>;base64,<data>
+func parseDataURL(dataURL string) (string, []byte, error) {
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	if !ok {
+		return "", nil, fmt.Errorf("missing comma")
+	}
+	params := strings.Split(header, ";")
+	if params[len(params)-1] != "base64" {
+		return "", nil, fmt.Errorf("only base64 data URLs are supported")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	return params[0], data, nil
+}
+
+// checkAttachment 校验大小与 MIME 类型，未声明类型时根据内容识别
+func (h *ChatHandler) checkAttachment(filename, declared string, data []byte) (*pendingAttachment, *apiError) {
+	if len(data) == 0 {
+		return nil, errInvalidAttachment("attachment is empty")
+	}
+	if int64(len(data)) > h.maxAttachmentBytes() {
+		return nil, errInvalidAttachment("attachment exceeds %d MB limit", h.attachments.MaxSize)
+	}
+
+	mimeType := baseMimeType(declared)
+	detected := baseMimeType(http.DetectContentType(data))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = detected
+	} else if strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(detected, "image/") && detected != "application/octet-stream" {
+		return nil, errInvalidAttachment("attachment content (%s) does not match declared type %s", detected, mimeType)
+	}
+	if !h.attachmentTypeAllowed(mimeType) {
+		return nil, errInvalidAttachment("attachment type %s is not allowed", mimeType)
+	}
+
+	if filename == "" || filename == "/" || filename == "." {
+		filename = "attachment" + mimeExtension(mimeType)
+	}
+	return &pendingAttachment{Filename: filepath.Base(filename), MimeType: mimeType, Data: data}, nil
+}
+
+func (h *ChatHandler) maxAttachmentBytes() int64 {
+	return int64(h.attachments.MaxSize) << 20
+}
+
+func (h *ChatHandler) attachmentTypeAllowed(mimeType string) bool {
+	for _, t := range h.attachments.AllowedTypes {
+		if strings.EqualFold(t, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+func baseMimeType(t string) string {
+	if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func mimeExtension(mimeType string) string {
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// storeAttachments 将附件写入磁盘，返回待随消息保存的记录与下发给插件的 payload
+func (h *ChatHandler) storeAttachments(pending []*pendingAttachment) ([]model.Attachment, []AttachmentPayload, error) {
+	if len(pending) == 0 {
+		return nil, nil, nil
+	}
+	if err := os.MkdirAll(h.attachments.Dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]model.Attachment, 0, len(pending))
+	payloads := make([]AttachmentPayload, 0, len(pending))
+	for _, att := range pending {
+		id := uuid.New().String()
+		filePath := filepath.Join(h.attachments.Dir, id+filepath.Ext(att.Filename))
+		if err := os.WriteFile(filePath, att.Data, 0o644); err != nil {
+			removeAttachmentFiles(records)
+			return nil, nil, err
+		}
+		records = append(records, model.Attachment{
+			ID:       id,
+			Filename: att.Filename,
+			MimeType: att.MimeType,
+			Size:     int64(len(att.Data)),
+			Path:     filePath,
+		})
+		payloads = append(payloads, AttachmentPayload{
+			Name:     att.Filename,
+			MimeType: att.MimeType,
+			Data:     base64.StdEncoding.EncodeToString(att.Data),
+		})
+	}
+	return records, payloads, nil
+}
+
+// removeAttachmentFiles 删除附件在磁盘上的文件
+func removeAttachmentFiles(records []model.Attachment) {
+	for _, att := range records {
+		os.Remove(att.Path)
+	}
+}
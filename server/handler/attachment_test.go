@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// testPNG 只包含 PNG 文件头，足以通过内容类型识别
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+var testPNGDataURL = "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG)
+
+func setupAttachmentTest(t *testing.T, maxSize int) (*httptest.Server, *gin.Engine, *gorm.DB, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	hub := NewHub(&config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken})
+	tm := NewTaskManager()
+	tm.StartDispatcher(hub)
+
+	tmpDir := t.TempDir()
+	db, err := model.InitDB(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig("")
+	cfg.Attachments.Dir = filepath.Join(tmpDir, "attachments")
+	cfg.Attachments.MaxSize = maxSize
+	chatHandler := NewChatHandler(hub, tm, db, cfg)
+
+	r := gin.New()
+	r.GET("/ws", hub.HandleWS)
+	r.POST("/v1/chat/completions", chatHandler.Handle)
+	return httptest.NewServer(r), r, db, cfg.Attachments.Dir
+}
+
+func TestChatAttachments(t *testing.T) {
+	server, r, db, dir := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	// 模拟图片服务器，验证 http(s) image_url 由服务端下载（放行测试服务器所在的回环地址）
+	fetchAddrAllowed = func(netip.Addr) bool { return true }
+	defer func() { fetchAddrAllowed = isPublicAddr }()
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer imageServer.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "Two images and a PDF", "status": "DONE"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n%test"))
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":[
+		{"type":"text","text":"Describe these"},
+		{"type":"image_url","image_url":{"url":"` + testPNGDataURL + `"}},
+		{"type":"image_url","image_url":{"url":"` + imageServer.URL + `/cat.png"}},
+		{"type":"file","file":{"filename":"report.pdf","file_data":"` + pdf + `"}}
+	]}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 附件随 CMD_SEND_MESSAGE 下发
+	select {
+	case msg := <-received:
+		var p SendMessagePayload
+		json.Unmarshal(msg.Payload, &p)
+		if len(p.Attachments) != 3 {
+			t.Fatalf("expected 3 attachments, got %d", len(p.Attachments))
+		}
+		if p.Attachments[1].Name != "cat.png" || p.Attachments[1].MimeType != "image/png" {
+			t.Errorf("unexpected fetched attachment: %+v", p.Attachments[1])
+		}
+		if p.Attachments[2].Name != "report.pdf" || p.Attachments[2].MimeType != "application/pdf" {
+			t.Errorf("unexpected file attachment: %+v", p.Attachments[2])
+		}
+		if data, _ := base64.StdEncoding.DecodeString(p.Attachments[0].Data); !bytes.Equal(data, testPNG) {
+			t.Error("attachment data mismatch")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no command received")
+	}
+
+	// 附件元数据随 user 消息保存；一次性对话结束后文件被删除，不在磁盘上堆积
+	var userMsg model.Message
+	if err := db.Preload("Attachments").Where("role = ?", "user").First(&userMsg).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(userMsg.Attachments) != 3 {
+		t.Fatalf("expected 3 attachment records, got %d", len(userMsg.Attachments))
+	}
+	for _, att := range userMsg.Attachments {
+		if att.Path != "" || att.Size == 0 {
+			t.Errorf("expected metadata without a file path, got %+v", att)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the attachment files to be removed from %s, got %d (%v)", dir, len(entries), err)
+	}
+	// 固定会话的附件保留到删除会话时
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":[`+
+		`{"type":"text","text":"Keep this"},{"type":"image_url","image_url":{"url":"`+testPNGDataURL+`"}}]}]}`))
+	req.Header.Set(ConversationHeader, "chat-1")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var pinned model.Attachment
+	db.Joins("JOIN messages ON messages.id = attachments.message_id").Where("messages.conversation_id = ?", "chat-1").First(&pinned)
+	if _, err := os.Stat(pinned.Path); pinned.Path == "" || err != nil || filepath.Dir(pinned.Path) != dir {
+		t.Errorf("expected the pinned chat attachment to stay on disk, got %q (%v)", pinned.Path, err)
+	}
+}
+
+func TestChatAttachmentValidation(t *testing.T) {
+	server, r, _, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	large := base64.StdEncoding.EncodeToString(append(testPNG, make([]byte, 2<<20)...))
+	text := base64.StdEncoding.EncodeToString([]byte("just some text"))
+	zip := base64.StdEncoding.EncodeToString([]byte("PK\x03\x04"))
+
+	cases := map[string]string{
+		"too large":     `{"type":"image_url","image_url":{"url":"data:image/png;base64,` + large + `"}}`,
+		"type mismatch": `{"type":"image_url","image_url":{"url":"data:image/png;base64,` + text + `"}}`,
+		"not allowed":   `{"type":"file","file":{"filename":"a.zip","file_data":"data:application/zip;base64,` + zip + `"}}`,
+		"bad scheme":    `{"type":"image_url","image_url":{"url":"ftp://example.com/a.png"}}`,
+		"file id":       `{"type":"file","file":{"file_id":"file-123"}}`,
+	}
+	for name, part := range cases {
+		reqBody := `{"model":"gemini","messages":[{"role":"user","content":[{"type":"text","text":"hi"},` + part + `]}]}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+		r.ServeHTTP(w, req)
+
+		// 校验在排队前完成，未连接插件也返回 400
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", name, w.Code, w.Body.String())
+			continue
+		}
+		if !strings.Contains(w.Body.String(), `"code":"invalid_attachment"`) {
+			t.Errorf("%s: unexpected error body: %s", name, w.Body.String())
+		}
+	}
+}
+
+func TestImageURLRejectsPrivateAddresses(t *testing.T) {
+	server, r, _, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	fetched := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer internal.Close()
+
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+	for _, u := range []string{internal.URL + "/a.png", "http://localhost:" + port + "/a.png", "http://[::ffff:127.0.0.1]:" + port + "/a.png"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":[`+
+			`{"type":"image_url","image_url":{"url":"`+u+`"}}]}]}`))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "public address") {
+			t.Errorf("%s: expected 400, got %d: %s", u, w.Code, w.Body.String())
+		}
+	}
+	if fetched {
+		t.Error("internal server must not be reached")
+	}
+
+	// 重定向到内网 / metadata 地址同样被拒绝
+	for _, target := range []string{"http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/", "http://[::1]/", "file:///etc/passwd"} {
+		req, _ := http.NewRequest("GET", target, nil)
+		if err := attachmentHTTPClient.CheckRedirect(req, []*http.Request{{}}); err == nil {
+			t.Errorf("redirect to %s should be rejected", target)
+		}
+	}
+	for addr, public := range map[string]bool{"8.8.8.8": true, "2606:4700::1111": true, "192.168.1.1": false, "0.0.0.0": false, "fe80::1": false, "224.0.0.1": false, "100.64.0.1": false, "100.127.255.254": false, "100.128.0.1": true, "::ffff:100.100.100.100": false} {
+		if isPublicAddr(netip.MustParseAddr(addr)) != public {
+			t.Errorf("isPublicAddr(%s) != %v", addr, public)
+		}
+	}
+}
@@ -0,0 +1,678 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// batchEndpoint 目前批处理唯一支持的接口
+const batchEndpoint = "/v1/chat/completions"
+
+// maxBatchErrors 输入文件校验最多报告的错误数
+const maxBatchErrors = 100
+
+// batchRetryDelay 插件未连接、worker 忙碌时重试同一行的最短等待时间，测试中可调小
+var batchRetryDelay = 5 * time.Second
+
+// batchErrorBackoff 读写数据库失败、批处理无法推进时，执行循环再次尝试前的等待时间
+var batchErrorBackoff = 10 * time.Second
+
+// errBatchExpired 重试等待期间批处理的完成时限已到
+var errBatchExpired = errors.New("batch expired")
+
+// BatchHandler 处理 /v1/files 与 /v1/batches：批处理按创建顺序逐个执行，批内请求按间隔依次经插件发送
+type BatchHandler struct {
+	Chat   *ChatHandler
+	DB     *gorm.DB
+	apiKey string // API Key，为空则不验证
+	cfg    config.BatchConfig
+
+	wake    chan struct{} // 有新的批处理时唤醒执行循环
+	mu      sync.Mutex
+	current string             // 正在执行的批处理 ID
+	cancel  context.CancelFunc // 取消正在执行的批处理
+}
+
+// NewBatchHandler 创建 BatchHandler 实例，需调用 Start 启动执行循环
+func NewBatchHandler(chat *ChatHandler, cfg *config.Config) *BatchHandler {
+	return &BatchHandler{
+		Chat:   chat,
+		DB:     chat.DB,
+		apiKey: cfg.APIKey,
+		cfg:    cfg.Batch,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// batchRequestLine 输入文件中的一行
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchOutputLine 输出/错误文件中的一行
+type batchOutputLine struct {
+	ID       string          `json:"id"`
+	CustomID string          `json:"custom_id"`
+	Response *batchResponse  `json:"response"`
+	Error    *batchLineError `json:"error"`
+}
+
+type batchResponse struct {
+	StatusCode int         `json:"status_code"`
+	RequestID  string      `json:"request_id"`
+	Body       interface{} `json:"body"`
+}
+
+type batchLineError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// CreateBatch 处理 POST /v1/batches，创建批处理并加入执行队列
+func (h *BatchHandler) CreateBatch(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_json", Message: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	invalid := func(param, msg string) {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: param, Message: msg})
+	}
+	if req.Endpoint != batchEndpoint {
+		invalid("endpoint", fmt.Sprintf("unsupported endpoint %q, only %s is supported", req.Endpoint, batchEndpoint))
+		return
+	}
+	if req.CompletionWindow != "24h" {
+		invalid("completion_window", "completion_window must be \"24h\"")
+		return
+	}
+	var input model.File
+	if err := h.DB.First(&input, "id = ? AND purpose = ?", req.InputFileID, filePurposeBatch).Error; err != nil {
+		invalid("input_file_id", fmt.Sprintf("input file %s not found", req.InputFileID))
+		return
+	}
+
+	expiresAt := time.Now().Add(24 * time.Hour)
+	batch := &model.Batch{
+		ID:               fmt.Sprintf("batch_%s", uuid.New().String()),
+		Endpoint:         req.Endpoint,
+		InputFileID:      input.ID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           model.BatchValidating,
+		ExpiresAt:        &expiresAt,
+	}
+	if len(req.Metadata) > 0 {
+		data, _ := json.Marshal(req.Metadata)
+		batch.Metadata = string(data)
+	}
+	if err := h.DB.Create(batch).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to create batch: %v", err)})
+		return
+	}
+
+	log.Printf("[Batch] batch %s created (input %s)", batch.ID, input.ID)
+	h.notify()
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// ListBatches 处理 GET /v1/batches，按创建时间倒序，支持 limit 与 after 分页
+func (h *BatchHandler) ListBatches(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	limit := 20
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 100 {
+		limit = v
+	}
+	query := h.DB.Order("created_at DESC, id DESC").Limit(limit + 1)
+	if after := c.Query("after"); after != "" {
+		var cursor model.Batch
+		if err := h.DB.First(&cursor, "id = ?", after).Error; err == nil {
+			query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		}
+	}
+	var batches []model.Batch
+	if err := query.Find(&batches).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		return
+	}
+
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+	data := make([]gin.H, 0, len(batches))
+	for i := range batches {
+		data = append(data, batchObject(&batches[i]))
+	}
+	resp := gin.H{"object": "list", "data": data, "has_more": hasMore}
+	if len(batches) > 0 {
+		resp["first_id"] = batches[0].ID
+		resp["last_id"] = batches[len(batches)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetBatch 处理 GET /v1/batches/:id
+func (h *BatchHandler) GetBatch(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	if batch, ok := h.findBatch(c); ok {
+		c.JSON(http.StatusOK, batchObject(batch))
+	}
+}
+
+// CancelBatch 处理 POST /v1/batches/:id/cancel
+// 正在执行的批处理先进入 cancelling，当前请求取消后以 cancelled 结束，已完成的结果仍写入输出文件
+func (h *BatchHandler) CancelBatch(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	batch, ok := h.findBatch(c)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	now := time.Now()
+	status := batch.Status
+	var result *gorm.DB
+	if batch.Status == model.BatchValidating && h.current != batch.ID {
+		// 尚未开始执行，直接结束
+		result = h.DB.Model(&model.Batch{}).Where("id = ? AND status = ?", batch.ID, model.BatchValidating).
+			Updates(map[string]interface{}{"status": model.BatchCancelled, "cancelling_at": now, "cancelled_at": now})
+		batch.Status, batch.CancellingAt, batch.CancelledAt = model.BatchCancelled, &now, &now
+	} else {
+		result = h.DB.Model(&model.Batch{}).Where("id = ? AND status IN ?", batch.ID, []string{model.BatchValidating, model.BatchInProgress}).
+			Updates(map[string]interface{}{"status": model.BatchCancelling, "cancelling_at": now})
+		batch.Status, batch.CancellingAt = model.BatchCancelling, &now
+		if result.RowsAffected > 0 && h.current == batch.ID {
+			h.cancel()
+		}
+	}
+	h.mu.Unlock()
+
+	if result.Error != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeOpenAIError(c, &apiError{Status: http.StatusConflict, Type: "invalid_request_error", Code: "batch_not_cancellable", Message: fmt.Sprintf("batch %s is %s and can no longer be cancelled", batch.ID, status)})
+		return
+	}
+	// 返回取消请求受理时的状态，执行协程随后会将其结束为 cancelled
+	log.Printf("[Batch] batch %s cancel requested", batch.ID)
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// findBatch 按路径参数加载批处理，不存在时写入 404
+func (h *BatchHandler) findBatch(c *gin.Context) (*model.Batch, bool) {
+	var batch model.Batch
+	if err := h.DB.First(&batch, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeOpenAIError(c, &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "batch_not_found", Message: fmt.Sprintf("batch %s not found", c.Param("id"))})
+		} else {
+			writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		}
+		return nil, false
+	}
+	return &batch, true
+}
+
+// batchObject 构建 OpenAI 格式的批处理对象
+func batchObject(b *model.Batch) gin.H {
+	unix := func(t *time.Time) interface{} {
+		if t == nil {
+			return nil
+		}
+		return t.Unix()
+	}
+	optional := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	raw := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return json.RawMessage(s)
+	}
+
+	return gin.H{
+		"id":                b.ID,
+		"object":            "batch",
+		"endpoint":          b.Endpoint,
+		"errors":            raw(b.Errors),
+		"input_file_id":     b.InputFileID,
+		"completion_window": b.CompletionWindow,
+		"status":            b.Status,
+		"output_file_id":    optional(b.OutputFileID),
+		"error_file_id":     optional(b.ErrorFileID),
+		"created_at":        b.CreatedAt.Unix(),
+		"in_progress_at":    unix(b.InProgressAt),
+		"expires_at":        unix(b.ExpiresAt),
+		"finalizing_at":     unix(b.FinalizingAt),
+		"completed_at":      unix(b.CompletedAt),
+		"failed_at":         unix(b.FailedAt),
+		"expired_at":        unix(b.ExpiredAt),
+		"cancelling_at":     unix(b.CancellingAt),
+		"cancelled_at":      unix(b.CancelledAt),
+		"request_counts": gin.H{
+			"total":     b.Total,
+			"completed": b.Completed,
+			"failed":    b.Failed,
+		},
+		"metadata": raw(b.Metadata),
+	}
+}
+
+// notify 唤醒执行循环
+func (h *BatchHandler) notify() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start 启动执行循环；重启前未完成的批处理会从输出文件记录的进度继续
+func (h *BatchHandler) Start() {
+	go func() {
+		for {
+			var batch model.Batch
+			err := h.DB.Where("status IN ?", []string{model.BatchValidating, model.BatchInProgress, model.BatchCancelling}).
+				Order("created_at, id").First(&batch).Error
+			if err != nil {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Printf("[Batch] failed to load batches: %v", err)
+				}
+				<-h.wake
+				continue
+			}
+			if err := h.run(&batch); err != nil {
+				log.Printf("[Batch] batch %s: %v, retrying in %s", batch.ID, err, batchErrorBackoff)
+				time.Sleep(batchErrorBackoff)
+			}
+		}
+	}()
+}
+
+// run 执行一个批处理直到完成、取消、过期或失败；返回 error 表示批处理状态未能推进（如数据库错误）
+func (h *BatchHandler) run(batch *model.Batch) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.current, h.cancel = batch.ID, cancel
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.current, h.cancel = "", nil
+		h.mu.Unlock()
+		cancel()
+	}()
+
+	// 登记后重新读取状态，避免与 CancelBatch 竞争
+	if err := h.DB.First(batch, "id = ?", batch.ID).Error; err != nil {
+		return fmt.Errorf("failed to reload batch: %w", err)
+	}
+	switch batch.Status {
+	case model.BatchCancelling:
+		return h.finalize(batch, model.BatchCancelled)
+	case model.BatchValidating, model.BatchInProgress:
+	default:
+		return nil
+	}
+
+	requests, errs := h.loadInput(batch)
+	if len(errs) > 0 {
+		return h.fail(batch, errs)
+	}
+
+	outPath, errPath := h.outputPaths(batch)
+	batch.Completed, batch.Failed = countLines(outPath), countLines(errPath)
+	done := batch.Completed + batch.Failed
+	if batch.Status == model.BatchValidating {
+		now := time.Now()
+		result := h.DB.Model(batch).Where("status = ?", model.BatchValidating).
+			Updates(map[string]interface{}{"status": model.BatchInProgress, "in_progress_at": now, "total": len(requests)})
+		if result.Error != nil {
+			return fmt.Errorf("failed to start batch: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return nil // 已被取消，由下一轮循环处理
+		}
+		batch.Status, batch.InProgressAt, batch.Total = model.BatchInProgress, &now, len(requests)
+		log.Printf("[Batch] batch %s started: %d requests", batch.ID, len(requests))
+	} else {
+		log.Printf("[Batch] batch %s resumed at request %d/%d", batch.ID, done+1, len(requests))
+	}
+
+	interval := time.Duration(h.cfg.Interval) * time.Second
+	for i := done; i < len(requests); i++ {
+		if batch.ExpiresAt != nil && time.Now().After(*batch.ExpiresAt) {
+			return h.expire(batch, requests[i:])
+		}
+		if i > done && !sleepContext(ctx, interval) {
+			break
+		}
+
+		line, err := h.execute(ctx, batch, &requests[i])
+		if errors.Is(err, errBatchExpired) {
+			return h.expire(batch, requests[i:])
+		}
+		if err != nil {
+			break // 批处理被取消，当前请求不计入结果
+		}
+
+		// 重启后按结果文件的行数恢复进度，写入失败时继续执行会使进度错位，因此直接结束批处理
+		path := outPath
+		if line.Response.StatusCode != http.StatusOK {
+			path = errPath
+		}
+		if err := appendLine(path, line); err != nil {
+			log.Printf("[Batch] failed to write result of %s: %v", line.CustomID, err)
+			return h.fail(batch, []batchLineError{{Code: "output_write_failed", Message: fmt.Sprintf("failed to write the result of %s: %v", line.CustomID, err)}})
+		}
+		if path == outPath {
+			batch.Completed++
+		} else {
+			batch.Failed++
+		}
+		h.DB.Model(batch).Select("completed", "failed").Updates(batch)
+	}
+
+	if ctx.Err() != nil {
+		return h.finalize(batch, model.BatchCancelled)
+	}
+	return h.finalize(batch, model.BatchCompleted)
+}
+
+// execute 执行一行请求；插件未连接、worker 忙碌或额度用尽（429/503）时等待后重试同一行
+// 返回 error 表示批处理已被取消，或在重试等待中到达完成时限（errBatchExpired）
+func (h *BatchHandler) execute(ctx context.Context, batch *model.Batch, r *batchRequestLine) (*batchOutputLine, error) {
+	line := &batchOutputLine{ID: fmt.Sprintf("batch_req_%s", uuid.New().String()), CustomID: r.CustomID}
+	timeout := time.Duration(h.cfg.Timeout) * time.Second
+
+	for {
+		if batch.ExpiresAt != nil && time.Now().After(*batch.ExpiresAt) {
+			return nil, errBatchExpired
+		}
+
+		var req ChatRequest
+		json.Unmarshal(r.Body, &req)
+		req.Stream = false
+		taskID := newTaskID()
+
+		resp, apiErr := h.complete(ctx, &req, taskOptions{ChatKey: req.User, TaskID: taskID, Timeout: timeout})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if apiErr == nil {
+			line.Response = &batchResponse{StatusCode: http.StatusOK, RequestID: taskID, Body: resp}
+			return line, nil
+		}
+		if apiErr.Status != http.StatusTooManyRequests && apiErr.Status != http.StatusServiceUnavailable {
+			line.Response = &batchResponse{StatusCode: apiErr.Status, RequestID: taskID, Body: apiErr.openAIBody()}
+			return line, nil
+		}
+
+		// 重试间隔不超过剩余的完成时限，到期后由下一轮判定过期
+		delay := max(time.Duration(apiErr.RetryAfter)*time.Second, batchRetryDelay)
+		if batch.ExpiresAt != nil {
+			delay = min(delay, time.Until(*batch.ExpiresAt)+time.Millisecond)
+		}
+		log.Printf("[Batch] request %s: %s, retrying in %s", r.CustomID, apiErr.Message, delay)
+		if !sleepContext(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// complete 经插件执行一次非流式 chat completion
+func (h *BatchHandler) complete(ctx context.Context, req *ChatRequest, opts taskOptions) (*ChatResponse, *apiError) {
+	task, apiErr := h.Chat.startTask(ctx, req, opts)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	result, err := h.Chat.complete(task, req, nil)
+	h.Chat.finishTask(task, err)
+	if err != nil {
+		return nil, taskAPIError(err)
+	}
+	resp := completionResponse(task, result)
+	return &resp, nil
+}
+
+// loadInput 读取并校验输入文件，每行须为合法的请求且 custom_id 不重复
+func (h *BatchHandler) loadInput(batch *model.Batch) ([]batchRequestLine, []batchLineError) {
+	var input model.File
+	if err := h.DB.First(&input, "id = ?", batch.InputFileID).Error; err != nil {
+		return nil, []batchLineError{{Code: "input_file_not_found", Message: fmt.Sprintf("input file %s not found", batch.InputFileID)}}
+	}
+	f, err := os.Open(input.Path)
+	if err != nil {
+		return nil, []batchLineError{{Code: "input_file_not_found", Message: err.Error()}}
+	}
+	defer f.Close()
+
+	var requests []batchRequestLine
+	var errs []batchLineError
+	fail := func(lineNo int, code, format string, args ...interface{}) {
+		if len(errs) < maxBatchErrors {
+			errs = append(errs, batchLineError{Code: code, Message: fmt.Sprintf(format, args...), Line: lineNo})
+		}
+	}
+	seen := make(map[string]bool)
+	scanner := newLineScanner(f, h.cfg.MaxFileSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		data := scanner.Bytes()
+		if len(data) == 0 {
+			continue
+		}
+		var r batchRequestLine
+		if err := json.Unmarshal(data, &r); err != nil {
+			fail(lineNo, "invalid_json_line", "line is not valid JSON: %v", err)
+			continue
+		}
+		var body ChatRequest
+		switch {
+		case r.CustomID == "":
+			fail(lineNo, "missing_required_parameter", "custom_id is required")
+		case seen[r.CustomID]:
+			fail(lineNo, "duplicate_custom_id", "custom_id %q is used more than once", r.CustomID)
+		case r.Method != http.MethodPost:
+			fail(lineNo, "invalid_method", "method must be POST")
+		case r.URL != batch.Endpoint:
+			fail(lineNo, "mismatched_endpoint", "url %q does not match the batch endpoint %s", r.URL, batch.Endpoint)
+		case json.Unmarshal(r.Body, &body) != nil:
+			fail(lineNo, "invalid_request", "body is not a valid chat completion request")
+		default:
+			seen[r.CustomID] = true
+			requests = append(requests, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(0, "invalid_file", "failed to read input file: %v", err)
+	}
+	if len(errs) == 0 && len(requests) == 0 {
+		fail(0, "empty_file", "input file contains no requests")
+	}
+	return requests, errs
+}
+
+// fail 输入校验失败或结果无法写入，批处理以 failed 结束
+func (h *BatchHandler) fail(batch *model.Batch, errs []batchLineError) error {
+	data, _ := json.Marshal(gin.H{"object": "list", "data": errs})
+	now := time.Now()
+	updates := map[string]interface{}{"status": model.BatchFailed, "errors": string(data), "failed_at": now, "completed": batch.Completed, "failed": batch.Failed}
+	if err := h.DB.Model(batch).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to mark batch failed: %w", err)
+	}
+	log.Printf("[Batch] batch %s failed: %s", batch.ID, errs[0].Message)
+	return nil
+}
+
+// expire 完成时限已到，剩余请求以 batch_expired 写入错误文件，只计入成功写入的行
+func (h *BatchHandler) expire(batch *model.Batch, remaining []batchRequestLine) error {
+	_, errPath := h.outputPaths(batch)
+	for _, r := range remaining {
+		err := appendLine(errPath, &batchOutputLine{
+			ID:       fmt.Sprintf("batch_req_%s", uuid.New().String()),
+			CustomID: r.CustomID,
+			Error:    &batchLineError{Code: "batch_expired", Message: "This request could not be executed before the completion window expired."},
+		})
+		if err != nil {
+			log.Printf("[Batch] failed to write expired request %s: %v", r.CustomID, err)
+			continue
+		}
+		batch.Failed++
+	}
+	return h.finalize(batch, model.BatchExpired)
+}
+
+// finalize 登记输出/错误文件并以 status 结束批处理
+func (h *BatchHandler) finalize(batch *model.Batch, status string) error {
+	now := time.Now()
+	outPath, errPath := h.outputPaths(batch)
+	updates := map[string]interface{}{"status": status, "finalizing_at": now, "completed": batch.Completed, "failed": batch.Failed}
+	if id := h.registerOutput(batch, outPath, "output"); id != "" {
+		updates["output_file_id"] = id
+	}
+	if id := h.registerOutput(batch, errPath, "error"); id != "" {
+		updates["error_file_id"] = id
+	}
+	switch status {
+	case model.BatchCompleted:
+		updates["completed_at"] = now
+	case model.BatchCancelled:
+		updates["cancelled_at"] = now
+	case model.BatchExpired:
+		updates["expired_at"] = now
+	}
+
+	if err := h.DB.Model(batch).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to finalize batch: %w", err)
+	}
+	log.Printf("[Batch] batch %s %s: %d completed, %d failed", batch.ID, status, batch.Completed, batch.Failed)
+	return nil
+}
+
+// registerOutput 为非空的结果文件创建文件记录，返回文件 ID
+func (h *BatchHandler) registerOutput(batch *model.Batch, path, kind string) string {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return ""
+	}
+	file := &model.File{
+		ID:       fmt.Sprintf("file-%s", uuid.New().String()),
+		Filename: fmt.Sprintf("%s_%s.jsonl", batch.ID, kind),
+		Purpose:  filePurposeBatchOutput,
+		Bytes:    info.Size(),
+		Path:     path,
+	}
+	if err := h.DB.Create(file).Error; err != nil {
+		log.Printf("[Batch] failed to register %s file of batch %s: %v", kind, batch.ID, err)
+		return ""
+	}
+	return file.ID
+}
+
+// outputPaths 批处理输出文件与错误文件的路径
+func (h *BatchHandler) outputPaths(batch *model.Batch) (string, string) {
+	return filepath.Join(h.cfg.Dir, batch.ID+"_output.jsonl"), filepath.Join(h.cfg.Dir, batch.ID+"_error.jsonl")
+}
+
+// appendLine 追加一行 JSON 到结果文件
+func appendLine(path string, line *batchOutputLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// countLines 统计结果文件中的非空行数，文件不存在时为 0
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := newLineScanner(f, 0)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// newLineScanner 创建按行读取的 scanner，单行最大 maxMB（0 表示 64MB）
+func newLineScanner(f *os.File, maxMB int) *bufio.Scanner {
+	if maxMB <= 0 {
+		maxMB = 64
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxMB<<20)
+	return scanner
+}
+
+// sleepContext 等待 d，ctx 结束时提前返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// setupBatchTest 创建带 /v1/files 与 /v1/batches 路由的测试服务，执行循环需由调用方 Start
+func setupBatchTest(t *testing.T) (*httptest.Server, *gin.Engine, *BatchHandler) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	hub := NewHub(&config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken})
+	tm := NewTaskManager()
+	tm.StartDispatcher(hub)
+
+	tmpDir := t.TempDir()
+	db, err := model.InitDB(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig("")
+	cfg.Attachments.Dir = filepath.Join(tmpDir, "attachments")
+	cfg.Batch.Dir = filepath.Join(tmpDir, "batches")
+	cfg.Batch.Interval = 0
+	batchHandler := NewBatchHandler(NewChatHandler(hub, tm, db, cfg), cfg)
+
+	r := gin.New()
+	r.GET("/ws", hub.HandleWS)
+	r.POST("/v1/files", batchHandler.UploadFile)
+	r.GET("/v1/files/:id", batchHandler.GetFile)
+	r.GET("/v1/files/:id/content", batchHandler.GetFileContent)
+	r.POST("/v1/batches", batchHandler.CreateBatch)
+	r.GET("/v1/batches", batchHandler.ListBatches)
+	r.GET("/v1/batches/:id", batchHandler.GetBatch)
+	r.POST("/v1/batches/:id/cancel", batchHandler.CancelBatch)
+	return httptest.NewServer(r), r, batchHandler
+}
+
+func batchLine(customID, model, content string) string {
+	return fmt.Sprintf(`{"custom_id":%q,"method":"POST","url":"/v1/chat/completions","body":{"model":%q,"messages":[{"role":"user","content":%q}]}}`, customID, model, content)
+}
+
+func uploadBatchFile(t *testing.T, r http.Handler, content string) string {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("purpose", "batch")
+	fw, _ := mw.CreateFormFile("file", "input.jsonl")
+	fw.Write([]byte(content))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var file struct {
+		ID    string `json:"id"`
+		Bytes int    `json:"bytes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &file)
+	if file.Bytes != len(content) {
+		t.Errorf("expected %d bytes, got %d", len(content), file.Bytes)
+	}
+	return file.ID
+}
+
+type batchResponseBody struct {
+	ID            string          `json:"id"`
+	Status        string          `json:"status"`
+	OutputFileID  string          `json:"output_file_id"`
+	ErrorFileID   string          `json:"error_file_id"`
+	Errors        json.RawMessage `json:"errors"`
+	RequestCounts struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"request_counts"`
+}
+
+func createBatch(t *testing.T, r http.Handler, fileID string) batchResponseBody {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"`+fileID+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create batch: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var batch batchResponseBody
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	return batch
+}
+
+// waitForBatch 轮询直到批处理进入终态
+func waitForBatch(t *testing.T, r http.Handler, id string) batchResponseBody {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/batches/"+id, nil)
+		r.ServeHTTP(w, req)
+		var batch batchResponseBody
+		json.Unmarshal(w.Body.Bytes(), &batch)
+		switch batch.Status {
+		case "completed", "failed", "cancelled", "expired":
+			return batch
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for batch, last state: %s", w.Body.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readOutputFile 下载结果文件并按 custom_id 索引
+func readOutputFile(t *testing.T, r http.Handler, fileID string) map[string]batchOutputLine {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/files/"+fileID+"/content", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("file content: expected 200, got %d", w.Code)
+	}
+	lines := make(map[string]batchOutputLine)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line batchOutputLine
+		json.Unmarshal(scanner.Bytes(), &line)
+		lines[line.CustomID] = line
+	}
+	return lines
+}
+
+func TestBatchLifecycle(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+	h.Start()
+
+	conn, _ := sequenceExtension(t, server, [][]WSMessage{
+		donePayloadWithText("Answer one"),
+		donePayloadWithText("Answer three"),
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	input := strings.Join([]string{
+		batchLine("req-1", "gemini", "First"),
+		batchLine("req-2", "unknown-model", "Second"),
+		batchLine("req-3", "gemini", "Third"),
+	}, "\n") + "\n"
+	batch := createBatch(t, r, uploadBatchFile(t, r, input))
+	if batch.Status != "validating" {
+		t.Errorf("expected validating, got %s", batch.Status)
+	}
+
+	batch = waitForBatch(t, r, batch.ID)
+	if batch.Status != "completed" || batch.RequestCounts.Total != 3 || batch.RequestCounts.Completed != 2 || batch.RequestCounts.Failed != 1 {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+
+	output := readOutputFile(t, r, batch.OutputFileID)
+	if len(output) != 2 {
+		t.Fatalf("expected 2 output lines, got %d", len(output))
+	}
+	for id, want := range map[string]string{"req-1": "Answer one", "req-3": "Answer three"} {
+		body, _ := json.Marshal(output[id].Response.Body)
+		var resp ChatResponse
+		json.Unmarshal(body, &resp)
+		if output[id].Response.StatusCode != 200 || resp.Choices[0].Message.Content != want {
+			t.Errorf("%s: unexpected output line %s", id, body)
+		}
+	}
+
+	errorsOut := readOutputFile(t, r, batch.ErrorFileID)
+	if line, ok := errorsOut["req-2"]; !ok || line.Response.StatusCode != http.StatusNotFound {
+		t.Errorf("expected req-2 in the error file with status 404, got %+v", errorsOut)
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+	h.Start()
+
+	input := batchLine("req-1", "gemini", "Hi") + "\n" +
+		batchLine("req-1", "gemini", "Again") + "\n" +
+		`{"custom_id":"req-2","method":"POST","url":"/v1/embeddings","body":{}}` + "\n" +
+		"not json\n"
+	batch := waitForBatch(t, r, createBatch(t, r, uploadBatchFile(t, r, input)).ID)
+	if batch.Status != "failed" {
+		t.Fatalf("expected failed, got %s", batch.Status)
+	}
+	var errs struct {
+		Data []batchLineError `json:"data"`
+	}
+	json.Unmarshal(batch.Errors, &errs)
+	codes := make([]string, 0, len(errs.Data))
+	for _, e := range errs.Data {
+		codes = append(codes, fmt.Sprintf("%d:%s", e.Line, e.Code))
+	}
+	if got := strings.Join(codes, ","); got != "2:duplicate_custom_id,3:mismatched_endpoint,4:invalid_json_line" {
+		t.Errorf("unexpected validation errors: %s", got)
+	}
+
+	// 不支持的 endpoint 与不存在的输入文件直接返回 400
+	for _, body := range []string{
+		`{"input_file_id":"file-x","endpoint":"/v1/embeddings","completion_window":"24h"}`,
+		`{"input_file_id":"file-missing","endpoint":"/v1/chat/completions","completion_window":"24h"}`,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/batches", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestBatchResume(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+
+	conn, received := sequenceExtension(t, server, [][]WSMessage{donePayloadWithText("Answer two")})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// 模拟重启前已完成第一行的批处理
+	fileID := uploadBatchFile(t, r, batchLine("req-1", "gemini", "First")+"\n"+batchLine("req-2", "gemini", "Second")+"\n")
+	now := time.Now()
+	batch := &model.Batch{ID: "batch_resume", Endpoint: batchEndpoint, InputFileID: fileID, CompletionWindow: "24h",
+		Status: model.BatchInProgress, Total: 2, Completed: 1, InProgressAt: &now}
+	expires := now.Add(time.Hour)
+	batch.ExpiresAt = &expires
+	h.DB.Create(batch)
+	outPath, _ := h.outputPaths(batch)
+	os.MkdirAll(filepath.Dir(outPath), 0o755)
+	appendLine(outPath, &batchOutputLine{ID: "batch_req_1", CustomID: "req-1", Response: &batchResponse{StatusCode: 200, Body: map[string]string{"previous": "run"}}})
+
+	h.Start()
+	result := waitForBatch(t, r, batch.ID)
+	if result.Status != "completed" || result.RequestCounts.Completed != 2 || result.ErrorFileID != "" {
+		t.Fatalf("unexpected batch: %+v", result)
+	}
+
+	// 只重新发送了第二行
+	sent := <-received
+	var payload SendMessagePayload
+	json.Unmarshal(sent.Payload, &payload)
+	if !strings.Contains(payload.Prompt, "Second") {
+		t.Errorf("expected the second request to be sent, got %s", payload.Prompt)
+	}
+	select {
+	case extra := <-received:
+		t.Errorf("unexpected extra request: %s", extra.Payload)
+	default:
+	}
+	if output := readOutputFile(t, r, result.OutputFileID); len(output) != 2 || output["req-1"].ID != "batch_req_1" {
+		t.Errorf("expected the previous result to be kept, got %+v", output)
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+	h.Start()
+
+	// 插件只推送 PROCESSING，不会自行结束
+	processing, _ := json.Marshal(map[string]string{"text": "Working", "status": "PROCESSING"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: processing}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	batch := createBatch(t, r, uploadBatchFile(t, r, batchLine("req-1", "gemini", "First")+"\n"+batchLine("req-2", "gemini", "Second")+"\n"))
+	waitForCommand(t, received, "CMD_SEND_MESSAGE")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/batches/"+batch.ID+"/cancel", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"cancelling"`) {
+		t.Fatalf("cancel: unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	waitForCommand(t, received, "CMD_CANCEL")
+
+	result := waitForBatch(t, r, batch.ID)
+	if result.Status != "cancelled" || result.RequestCounts.Completed != 0 || result.OutputFileID != "" {
+		t.Errorf("unexpected cancelled batch: %+v", result)
+	}
+}
+
+func TestBatchExpiresWhileRetrying(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+
+	// 额度用尽（429，retry_after 3600 秒）时不会无限重试，完成时限到期后剩余请求记为 batch_expired
+	conn, received := sequenceExtension(t, server, [][]WSMessage{donePayloadWithText("You've reached your limit for 2.5 Pro until tomorrow.")})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	fileID := uploadBatchFile(t, r, batchLine("req-1", "gemini", "First")+"\n"+batchLine("req-2", "gemini", "Second")+"\n")
+	expires := time.Now().Add(time.Second)
+	batch := &model.Batch{ID: "batch_expiring", Endpoint: batchEndpoint, InputFileID: fileID, CompletionWindow: "24h",
+		Status: model.BatchValidating, ExpiresAt: &expires}
+	h.DB.Create(batch)
+
+	h.Start()
+	waitForCommand(t, received, "CMD_SEND_MESSAGE")
+	result := waitForBatch(t, r, batch.ID)
+	if result.Status != "expired" || result.RequestCounts.Failed != 2 || result.RequestCounts.Completed != 0 {
+		t.Fatalf("unexpected batch: %+v", result)
+	}
+	lines := readOutputFile(t, r, result.ErrorFileID)
+	if lines["req-1"].Error == nil || lines["req-1"].Error.Code != "batch_expired" || lines["req-2"].Error == nil {
+		t.Errorf("expected batch_expired lines, got %+v", lines)
+	}
+}
+
+func TestBatchOutputWriteFailure(t *testing.T) {
+	server, r, h := setupBatchTest(t)
+	defer server.Close()
+
+	conn, _ := sequenceExtension(t, server, [][]WSMessage{donePayloadWithText("Answer one"), donePayloadWithText("Answer two")})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	fileID := uploadBatchFile(t, r, batchLine("req-1", "gemini", "First")+"\n"+batchLine("req-2", "gemini", "Second")+"\n")
+	expires := time.Now().Add(time.Hour)
+	batch := &model.Batch{ID: "batch_unwritable", Endpoint: batchEndpoint, InputFileID: fileID, CompletionWindow: "24h",
+		Status: model.BatchValidating, ExpiresAt: &expires}
+	h.DB.Create(batch)
+
+	// 输出文件路径被目录占用，结果无法写入
+	outPath, _ := h.outputPaths(batch)
+	os.MkdirAll(outPath, 0o755)
+
+	h.Start()
+	result := waitForBatch(t, r, batch.ID)
+	if result.Status != "failed" || !strings.Contains(string(result.Errors), "output_write_failed") {
+		t.Fatalf("expected the batch to fail, got %+v %s", result, result.Errors)
+	}
+	// 未写入的结果不计数，重启后的进度与结果文件一致
+	if result.RequestCounts.Completed != 0 || result.RequestCounts.Failed != 0 {
+		t.Errorf("expected no counted results, got %+v", result.RequestCounts)
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForCommand 从插件收到的指令中等待指定类型的一条
+func waitForCommand(t *testing.T, received chan WSMessage, msgType string) WSMessage {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", msgType)
+		}
+	}
+}
+
+func TestChatClientDisconnectCancels(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	// 插件只推送 PROCESSING，不会自行结束
+	processing, _ := json.Marshal(map[string]string{"text": "Once upon a time", "status": "PROCESSING"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: processing}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reqBody := `{"model":"gemini","stream":true,"messages":[{"role":"user","content":"Tell me a story"}]}`
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	sent := waitForCommand(t, received, "CMD_SEND_MESSAGE")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	cancelMsg := waitForCommand(t, received, "CMD_CANCEL")
+	if cancelMsg.ID != sent.ID {
+		t.Errorf("CMD_CANCEL should carry the task ID %s, got %s", sent.ID, cancelMsg.ID)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not return after client disconnect")
+	}
+
+	// 插件上报 idle 前 worker 不再接受新任务
+	if workers := hub.Workers(); workers[0].Status != "busy" {
+		t.Errorf("expected worker to stay busy until the extension reports idle, got %s", workers[0].Status)
+	}
+}
+
+func TestAdminCancelTask(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, received := recordExtension(t, server, nil)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	sent := waitForCommand(t, received, "CMD_SEND_MESSAGE")
+
+	cw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/tasks/"+sent.ID+"/cancel", nil)
+	r.ServeHTTP(cw, req)
+	if cw.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", cw.Code, cw.Body.String())
+	}
+
+	if msg := waitForCommand(t, received, "CMD_CANCEL"); msg.ID != sent.ID {
+		t.Errorf("unexpected CMD_CANCEL task ID: %s", msg.ID)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request did not finish after cancel")
+	}
+	if w.Code != statusClientClosedRequest || !strings.Contains(w.Body.String(), `"code":"cancelled"`) {
+		t.Errorf("expected cancelled error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	cw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/tasks/"+sent.ID, nil)
+	r.ServeHTTP(cw, req)
+	if !strings.Contains(cw.Body.String(), `"state":"cancelled"`) {
+		t.Errorf("expected task recorded as cancelled, got %s", cw.Body.String())
+	}
+
+	// 已结束或不存在的任务 → 404
+	cw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/tasks/"+sent.ID+"/cancel", nil)
+	r.ServeHTTP(cw, req)
+	if cw.Code != http.StatusNotFound || !strings.Contains(cw.Body.String(), `"code":"task_not_found"`) {
+		t.Errorf("expected 404 task_not_found for finished task, got %d: %s", cw.Code, cw.Body.String())
+	}
+	cw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/tasks/chatcmpl-unknown", nil)
+	r.ServeHTTP(cw, req)
+	if cw.Code != http.StatusNotFound || !strings.Contains(cw.Body.String(), `"type":"invalid_request_error"`) {
+		t.Errorf("expected 404 in the OpenAI error format, got %d: %s", cw.Code, cw.Body.String())
+	}
+}
@@ -1,18 +1,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
 	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
 )
 
@@ -22,8 +25,10 @@ type CData struct {
 }
 
 type PromptXmlMessage struct {
-	Role    string `xml:"role,attr"`
-	Content CData  `xml:",innerxml"`
+	Role       string `xml:"role,attr"`
+	Name       string `xml:"name,attr,omitempty"`
+	ToolCallID string `xml:"tool_call_id,attr,omitempty"`
+	Content    CData  `xml:",innerxml"`
 }
 
 type PromptXml struct {
@@ -35,10 +40,17 @@ type PromptXml struct {
 func messagesToXML(messages []ChatMessage) (string, error) {
 	promptXml := &PromptXml{}
 	for _, msg := range messages {
+		content := msg.Content
+		// assistant 的工具调用以与回复相同的代码块格式写入历史
+		if len(msg.ToolCalls) > 0 {
+			content = strings.TrimSpace(content + "\n" + formatToolCalls(msg.ToolCalls))
+		}
 		promptXml.Messages = append(promptXml.Messages, &PromptXmlMessage{
-			Role: msg.Role,
+			Role:       msg.Role,
+			Name:       msg.Name,
+			ToolCallID: msg.ToolCallID,
 			Content: CData{
-				Value: "\n" + msg.Content + "\n",
+				Value: "\n" + content + "\n",
 			},
 		})
 	}
@@ -57,11 +69,24 @@ type ChatRequest struct {
 	Model    string        `json:"model"`
 	Messages []ChatMessage `json:"messages"`
 	Stream   bool          `json:"stream"`
+	User     string        `json:"user,omitempty"` // 可选，作为固定会话 ID
+
+	Tools          []Tool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage `json:"tool_choice,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	toolChoice toolChoice             // 由 ToolChoice 解析得到
+	schema     map[string]interface{} // 由 response_format.json_schema 解析得到
 }
 
 type ChatMessage struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role       string     `json:"role,omitempty"`
+	Content    string     `json:"content,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"` // role 为 tool 时对应的调用 ID
+
+	Parts []ContentPart `json:"-"` // 请求中数组形式的 content，Content 为其中 text part 的拼接
 }
 
 type ChatResponse struct {
@@ -88,214 +113,625 @@ type Usage struct {
 
 // ChatHandler 处理 /v1/chat/completions 请求
 type ChatHandler struct {
-	Hub         *Hub
-	TaskManager *TaskManager
-	DB          *gorm.DB
-	semaphore   chan struct{} // 并发限制：同一时间只允许一个请求
-	apiKey      string        // API Key，为空则不验证
+	Hub            *Hub
+	TaskManager    *TaskManager
+	Queue          *RequestQueue
+	DB             *gorm.DB
+	apiKey         string               // API Key，为空则不验证
+	models         []config.ModelConfig // 模型目录，为空则不校验模型名
+	aliases        map[string]string    // 模型别名 -> 模型 ID
+	attachments    config.AttachmentConfig
+	maxRepairs     int // 回复格式不符时的最大纠正重试次数
+	limits         config.LimitsConfig
+	jobs           config.JobsConfig
+	callbackClient *http.Client // 投递异步任务回调，按 jobs.allow_private_callbacks 过滤目标地址
+	createdAt      time.Time
+	activeChats    sync.Map // 正在处理中（或删除中）的固定会话 ID，防止同一会话并发发送
+	running        sync.Map // 任务 ID -> *chatTask，供管理端取消
+	progress       sync.Map // 异步任务 ID -> *jobProgress，执行中的排队位置与部分回复
 }
 
 // NewChatHandler 创建 ChatHandler 实例
-func NewChatHandler(hub *Hub, tm *TaskManager, db *gorm.DB, apiKey string) *ChatHandler {
+func NewChatHandler(hub *Hub, tm *TaskManager, db *gorm.DB, cfg *config.Config) *ChatHandler {
 	return &ChatHandler{
-		Hub:         hub,
-		TaskManager: tm,
-		DB:          db,
-		semaphore:   make(chan struct{}, 1),
-		apiKey:      apiKey,
+		Hub:            hub,
+		TaskManager:    tm,
+		Queue:          NewRequestQueue(hub, &cfg.Queue),
+		DB:             db,
+		apiKey:         cfg.APIKey,
+		models:         cfg.Models,
+		aliases:        cfg.ModelAliases,
+		attachments:    cfg.Attachments,
+		maxRepairs:     cfg.Repair.MaxRetries,
+		limits:         cfg.Limits,
+		jobs:           cfg.Jobs,
+		callbackClient: newCallbackClient(cfg.Jobs),
+		createdAt:      time.Now(),
 	}
 }
 
-func (h *ChatHandler) Handle(c *gin.Context) {
-	// 并发控制：server 端信号量 + 插件端状态双重检查
-	select {
-	case h.semaphore <- struct{}{}:
-		defer func() { <-h.semaphore }()
-	default:
-		c.JSON(http.StatusTooManyRequests, gin.H{
-			"error": gin.H{
-				"message": "server is already processing a request, please try again later",
-				"type":    "rate_limit_error",
-			},
-		})
-		return
+// checkAPIKey 验证 Bearer Token，失败时写入 401 响应并返回 false
+func checkAPIKey(c *gin.Context, apiKey string) bool {
+	if apiKey == "" {
+		return true
+	}
+	auth := c.GetHeader("Authorization")
+	if auth == "" {
+		writeOpenAIError(c, &apiError{Status: http.StatusUnauthorized, Type: "authentication_error", Code: "missing_api_key", Message: "missing Authorization header"})
+		return false
 	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token != apiKey {
+		writeOpenAIError(c, &apiError{Status: http.StatusUnauthorized, Type: "authentication_error", Code: "invalid_api_key", Message: "invalid API key"})
+		return false
+	}
+	return true
+}
 
+func (h *ChatHandler) Handle(c *gin.Context) {
 	// API Key 验证
-	if h.apiKey != "" {
-		auth := c.GetHeader("Authorization")
-		if auth == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": gin.H{
-					"message": "missing Authorization header",
-					"type":    "authentication_error",
-				},
-			})
-			return
-		}
-		token := strings.TrimPrefix(auth, "Bearer ")
-		if token == auth || token != h.apiKey {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": gin.H{
-					"message": "invalid API key",
-					"type":    "authentication_error",
-				},
-			})
-			return
-		}
+	if !checkAPIKey(c, h.apiKey) {
+		return
 	}
 
 	var req ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_json", Message: fmt.Sprintf("invalid request: %v", err)})
 		return
 	}
 
-	// 检查是否包含 user 消息
-	hasUserMessage := false
-	for _, msg := range req.Messages {
-		if msg.Role == "user" {
-			hasUserMessage = true
-			break
+	// 流式请求在排队期间通过 SSE 注释行推送排队位置
+	streamStarted := false
+	var onPosition func(position int)
+	if req.Stream {
+		onPosition = func(position int) {
+			if !streamStarted {
+				setSSEHeaders(c)
+				c.Status(http.StatusOK)
+				streamStarted = true
+			}
+			fmt.Fprintf(c.Writer, ": queue position %d\n\n", position)
+			c.Writer.Flush()
 		}
 	}
-	if !hasUserMessage {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no user message found"})
+
+	task, apiErr := h.prepareTask(c, &req, onPosition)
+	if apiErr != nil {
+		if c.Request.Context().Err() != nil {
+			return // 客户端已断开，无需响应
+		}
+		if streamStarted {
+			// SSE 流已开始，以 error 事件和 [DONE] 结束流
+			data, _ := json.Marshal(apiErr.openAIBody())
+			fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+			c.Writer.Flush()
+			return
+		}
+		writeOpenAIError(c, apiErr)
 		return
 	}
 
-	// 将所有 messages 序列化为 XML 格式作为 prompt
-	prompt, err := messagesToXML(req.Messages)
+	var taskErr error
+	defer func() { h.finishTask(task, taskErr) }()
+
+	if req.Stream {
+		taskErr = h.handleStream(c, task, &req)
+	} else {
+		taskErr = h.handleNonStream(c, task, &req)
+	}
+}
+
+// taskOptions 创建任务时的可选参数
+type taskOptions struct {
+	ChatKey        string             // API 侧会话 ID，为空表示一次性对话
+	TaskID         string             // 为空则自动生成
+	Timeout        time.Duration      // 等待插件回复的超时，为 0 使用 requestTimeout
+	OnPosition     func(position int) // 排队位置变化回调
+	OnConversation func(id string)    // 固定会话加载后回调
+}
+
+// prepareTask 为 HTTP 请求创建任务：会话 ID 取自请求头或 user 字段，客户端断开时取消任务
+// 成功返回的 task 必须由调用方通过 finishTask 释放
+func (h *ChatHandler) prepareTask(c *gin.Context, req *ChatRequest, onPosition func(position int)) (*chatTask, *apiError) {
+	return h.startTask(c.Request.Context(), req, taskOptions{
+		ChatKey:        resolveChatKey(c, req),
+		OnPosition:     onPosition,
+		OnConversation: func(id string) { c.Header(ConversationHeader, id) },
+	})
+}
+
+// startTask 校验请求、解析模型与会话、排队获取 worker 并下发 CMD_SEND_MESSAGE
+// ctx 结束时任务被取消；成功返回的 task 必须由调用方通过 finishTask 释放
+func (h *ChatHandler) startTask(ctx context.Context, req *ChatRequest, opts taskOptions) (*chatTask, *apiError) {
+	modelCfg, apiErr := h.validateRequest(req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// 生成任务 ID
+	taskID := opts.TaskID
+	if taskID == "" {
+		taskID = newTaskID()
+	}
+	task := &chatTask{ID: taskID, Model: modelCfg.ID, Spec: modelCfg, ChatKey: opts.ChatKey, Fallbacks: modelCfg.Fallback, timeout: opts.Timeout}
+	if task.timeout == 0 {
+		task.timeout = requestTimeout
+	}
+	task.ctx, task.cancel = context.WithCancelCause(ctx)
+	h.running.Store(taskID, task)
+
+	// 准备失败时释放已占用的资源
+	prepared := false
+	defer func() {
+		if !prepared {
+			h.finishTask(task, &HubError{"task not dispatched"})
+		}
+	}()
+
+	// 固定会话：同一会话同一时间只允许一个请求
+	if task.ChatKey != "" {
+		if _, busy := h.activeChats.LoadOrStore(task.ChatKey, taskID); busy {
+			task.ChatKey = "" // 未占用，无需释放
+			return nil, errConversationBusy()
+		}
+
+		conv, err := h.loadConversation(task.ChatKey, req.Messages)
+		if err != nil {
+			return nil, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to load conversation: %v", err)}
+		}
+		task.Conv = conv
+		if opts.OnConversation != nil {
+			opts.OnConversation(conv.ID)
+		}
+	}
+
+	// 已绑定 Gemini 对话时只发送新消息，否则将所有 messages 序列化为 XML 格式作为 prompt
+	var prompt string
+	var err error
+	promptMessages := req.Messages
+	if task.Conv != nil && task.Conv.GeminiConversationID != "" {
+		promptMessages = turnMessages(req.Messages)
+		prompt, err = buildTurnPrompt(req.Messages)
+	} else {
+		prompt, err = messagesToXML(req.Messages)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to serialize messages: %v", err)})
-		return
+		return nil, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to serialize messages: %v", err)}
 	}
 
-	// 检查插件是否连接
-	if h.Hub.GetClient() == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "extension not connected"})
-		return
+	// 定义了工具时在 prompt 开头注入工具定义与调用格式
+	if instructions := toolInstructions(req); instructions != "" {
+		prompt = instructions + "\n\n" + prompt
+	}
+	// 要求 JSON 输出时在 prompt 末尾追加格式要求
+	if instructions := jsonInstructions(req); instructions != "" {
+		prompt = prompt + "\n\n" + instructions
 	}
 
-	// 检查插件端是否空闲
-	if !h.Hub.IsExtensionReady() {
-		c.JSON(http.StatusTooManyRequests, gin.H{
-			"error": gin.H{
-				"message": "extension is busy, please try again later",
-				"type":    "rate_limit_error",
-			},
-		})
-		return
+	// 解码 prompt 中包含的图片/文件附件，排队前完成校验
+	pending, apiErr := h.decodeAttachments(task.ctx, promptMessages)
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
-	// 生成任务 ID
-	taskID := fmt.Sprintf("chatcmpl-%s", uuid.New().String())
+	// 已连接的插件都不具备任务所需的能力时直接拒绝，避免无限排队
+	caps := requiredCapabilities(task, pending)
+	if missing := h.Hub.MissingCapabilities(caps...); len(missing) > 0 {
+		return nil, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "unsupported_by_extension", Message: fmt.Sprintf("the connected extension does not support: %s", strings.Join(missing, ", "))}
+	}
+
+	// 写入任务表后排队，从 worker 池中选取一个空闲的插件连接，全部忙碌时排队等待
+	h.recordTask(task)
+	task.Worker, err = h.Queue.Acquire(task.ctx, taskID, caps, opts.OnPosition)
+	if err != nil {
+		if context.Cause(task.ctx) == ErrTaskCancelled {
+			err = ErrTaskCancelled
+		}
+		return nil, queueAPIError(err)
+	}
+
+	// 该 worker 上请求模型的额度已用尽时直接使用降级模型
+	h.skipExhaustedModels(task)
+
+	// 附件写入磁盘
+	attachments, attachmentPayloads, err := h.storeAttachments(pending)
+	if err != nil {
+		return nil, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to store attachments: %v", err)}
+	}
 
-	// 存入数据库
+	// 存入数据库（附件记录随消息一起创建）
 	msg := model.Message{
-		Role:    "user",
-		Content: prompt,
-		Status:  "pending",
+		TaskID:      taskID,
+		Role:        "user",
+		Content:     prompt,
+		Status:      "pending",
+		Attachments: attachments,
+	}
+	if task.Conv != nil {
+		msg.ConversationID = task.Conv.ID
 	}
 	h.DB.Create(&msg)
+	task.UserMsg = &msg
 
 	// 创建任务 channel
-	replyCh := h.TaskManager.CreateTask(taskID)
-	defer h.TaskManager.RemoveTask(taskID)
+	task.ReplyCh = h.TaskManager.CreateTask(taskID)
 
 	// 构建并发送 WS 指令
-	payload, _ := json.Marshal(map[string]string{
-		"prompt":          prompt,
-		"conversation_id": "",
-	})
+	sendPayload := SendMessagePayload{Prompt: prompt, Mode: task.Spec.Mode, Attachments: attachmentPayloads, Timeout: int(task.timeout / time.Second)}
+	if task.Conv != nil {
+		sendPayload.ConversationID = task.Conv.GeminiConversationID
+		sendPayload.KeepConversation = true
+	}
+	task.Payload = sendPayload
+	payload, _ := json.Marshal(sendPayload)
 	wsMsg := &WSMessage{
 		ID:      taskID,
 		Type:    "CMD_SEND_MESSAGE",
 		Payload: payload,
 	}
 
-	if err := h.Hub.SendToExtension(wsMsg); err != nil {
+	if err := h.Hub.SendCommand(task.Worker, wsMsg); err != nil {
 		log.Printf("[Chat] send to extension failed: %v", err)
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "extension not connected"})
-		return
+		if err == ErrMessageTooLarge {
+			return nil, errMessageTooLarge()
+		}
+		return nil, queueAPIError(ErrNoClient)
 	}
+	log.Printf("[Chat] task %s dispatched to %s", taskID, task.Worker.ID)
+	h.setTaskState(task, model.TaskDispatched, map[string]interface{}{"worker_id": task.Worker.ID, "model": task.Spec.ID})
 
 	// 更新消息状态
 	h.DB.Model(&msg).Update("status", "sent")
 
-	modelName := req.Model
-	if modelName == "" {
-		modelName = "gemini"
+	prepared = true
+	return task, nil
+}
+
+// validateRequest 校验消息、工具与 response_format，返回请求的模型配置
+func (h *ChatHandler) validateRequest(req *ChatRequest) (*config.ModelConfig, *apiError) {
+	// 检查是否包含 user 消息
+	hasUserMessage := false
+	for _, msg := range req.Messages {
+		if msg.Role == "user" {
+			hasUserMessage = true
+			break
+		}
+	}
+	if !hasUserMessage {
+		return nil, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "messages", Message: "no user message found"}
 	}
 
-	if req.Stream {
-		h.handleStream(c, taskID, modelName, replyCh, &msg)
+	// 解析工具定义与 tool_choice
+	choice, choiceErr := parseToolChoice(req.ToolChoice, req.Tools)
+	if choiceErr != nil {
+		return nil, choiceErr
+	}
+	req.toolChoice = choice
+
+	// 解析 response_format
+	schema, formatErr := parseResponseFormat(req.ResponseFormat)
+	if formatErr != nil {
+		return nil, formatErr
+	}
+	req.schema = schema
+
+	// 校验模型是否在模型目录中
+	modelCfg, ok := h.resolveModel(req.Model)
+	if !ok {
+		return nil, errModelNotFound(req.Model)
+	}
+	return modelCfg, nil
+}
+
+// requiredCapabilities 返回执行任务所需的插件能力
+func requiredCapabilities(task *chatTask, pending []*pendingAttachment) []string {
+	var caps []string
+	if len(pending) > 0 {
+		caps = append(caps, CapAttachments)
+	}
+	if task.Spec.Mode != "" {
+		caps = append(caps, CapModelSelection)
+	}
+	if task.ChatKey != "" {
+		caps = append(caps, CapConversations)
+	}
+	return caps
+}
+
+// newTaskID 生成 chat completion 任务 ID
+func newTaskID() string {
+	return fmt.Sprintf("chatcmpl-%s", uuid.New().String())
+}
+
+// finishTask 释放任务占用的 worker、任务 channel 和会话锁
+func (h *ChatHandler) finishTask(task *chatTask, err error) {
+	h.running.Delete(task.ID)
+	task.cancel(nil)
+	if task.Worker != nil {
+		h.updateWorkerHealth(task.Worker, err)
+	}
+	if err != nil && task.UserMsg != nil {
+		h.DB.Model(task.UserMsg).Updates(map[string]interface{}{"status": "error", "error": err.Error()})
+	}
+	h.finishTaskState(task, err)
+	if task.Worker != nil {
+		h.Hub.ReleaseWorker(task.Worker, err != nil)
+	}
+	if task.ReplyCh != nil {
+		h.TaskManager.RemoveTask(task.ID)
+	}
+	if task.ChatKey != "" {
+		h.activeChats.Delete(task.ChatKey)
+	}
+	// 一次性对话的附件已随指令下发，不会再被引用，结束后删除文件（固定会话的附件在删除会话时清理）
+	if task.Conv == nil && task.UserMsg != nil && len(task.UserMsg.Attachments) > 0 {
+		removeAttachmentFiles(task.UserMsg.Attachments)
+		h.DB.Model(&model.Attachment{}).Where("message_id = ?", task.UserMsg.ID).Update("path", "")
+	}
+}
+
+// collectReply 等待插件回复直到 DONE 或出错
+// 每次 PROCESSING 计算与上一次文本的差量并回调 onDelta（可为 nil）
+// DONE 时更新实际模型、绑定固定会话的 Gemini 对话，返回最终 payload；回复由调用方确认后通过 saveReply 保存
+func (h *ChatHandler) collectReply(task *chatTask, onDelta func(delta string)) (*ReplyPayload, error) {
+	timer := time.NewTimer(task.timeout)
+	defer timer.Stop()
+
+	prevText := ""
+
+	for {
+		select {
+		case payload, ok := <-task.ReplyCh:
+			if !ok {
+				return nil, &HubError{"task channel closed unexpectedly"}
+			}
+
+			if payload.Status == "ERROR" {
+				extErr := h.extensionError(payload)
+				if h.fallback(task, extErr) {
+					prevText = ""
+					timer.Reset(task.timeout)
+					continue
+				}
+				return nil, extErr
+			}
+
+			// 插件断线重连后恢复了任务：之后的指令发给新的 worker
+			if payload.Status == "RESUMED" {
+				if worker := h.Hub.GetWorker(payload.WorkerID); worker != nil {
+					task.Worker = worker
+					state := model.TaskDispatched
+					if task.processing {
+						state = model.TaskProcessing
+					}
+					h.setTaskState(task, state, map[string]interface{}{"worker_id": worker.ID})
+				}
+				continue
+			}
+
+			task.Model = h.actualModel(task.Spec, payload.Model)
+
+			// PROCESSING：计算差量
+			if payload.Status == "PROCESSING" {
+				if !task.processing {
+					task.processing = true
+					h.setTaskState(task, model.TaskProcessing, nil)
+				}
+				delta := ""
+				if strings.HasPrefix(payload.Text, prevText) {
+					delta = payload.Text[len(prevText):]
+				} else {
+					delta = payload.Text
+				}
+				prevText = payload.Text
+
+				if delta != "" && onDelta != nil {
+					onDelta(delta)
+				}
+				continue
+			}
+
+			if payload.Status == "DONE" {
+				// 回复是额度用尽或登录失效的提示页面，而非正常回答
+				if limitErr := h.detectLimit(payload.Text); limitErr != nil {
+					if h.fallback(task, limitErr) {
+						prevText = ""
+						timer.Reset(task.timeout)
+						continue
+					}
+					return nil, limitErr
+				}
+				h.bindConversation(task, payload.ConversationID)
+				return payload, nil
+			}
+
+		case <-timer.C:
+			return nil, ErrTaskTimeout
+
+		case <-task.ctx.Done():
+			// 客户端断开或管理端取消：通知插件停止生成
+			h.cancelRemote(task)
+			return nil, ErrTaskCancelled
+		}
+	}
+}
+
+// cancelRemote 向 worker 下发 CMD_CANCEL，并在插件上报 idle 前不再向其分配任务
+func (h *ChatHandler) cancelRemote(task *chatTask) {
+	h.Hub.SetWorkerReady(task.Worker.ID, false)
+	if !h.Hub.WorkerSupports(task.Worker.ID, CapCancel) {
+		log.Printf("[Chat] task %s cancelled (%v), %s does not support CMD_CANCEL", task.ID, context.Cause(task.ctx), task.Worker.ID)
+		return
+	}
+	if err := h.Hub.SendCommand(task.Worker, &WSMessage{ID: task.ID, Type: "CMD_CANCEL"}); err != nil {
+		log.Printf("[Chat] send CMD_CANCEL for task %s failed: %v", task.ID, err)
+		return
+	}
+	log.Printf("[Chat] task %s cancelled (%v), CMD_CANCEL sent to %s", task.ID, context.Cause(task.ctx), task.Worker.ID)
+}
+
+// CancelTask 取消进行中的任务，任务不存在时返回 false
+func (h *ChatHandler) CancelTask(taskID string) bool {
+	v, ok := h.running.Load(taskID)
+	if !ok {
+		return false
+	}
+	v.(*chatTask).cancel(ErrTaskCancelled)
+	return true
+}
+
+// completion 一次 chat completion 的最终结果
+type completion struct {
+	Text         string
+	ToolCalls    []ToolCall
+	FinishReason string
+}
+
+// formatError 回复不符合请求要求的格式（工具调用、JSON 输出），携带纠正说明用于重新询问
+type formatError struct {
+	Code       string   // 重试耗尽后返回的错误码
+	Details    []string // 不符合之处
+	Correction string   // 发送给 Gemini 的纠正说明
+}
+
+// bufferReply 启用工具或 JSON 输出时需要完整回复才能解析，不增量推送
+func bufferReply(req *ChatRequest) bool {
+	return toolsEnabled(req) || jsonMode(req)
+}
+
+// parseCompletion 按请求的 tools / response_format 解析回复
+func parseCompletion(req *ChatRequest, text string) (*completion, *formatError) {
+	result := &completion{Text: text, FinishReason: "stop"}
+
+	if toolsEnabled(req) {
+		calls, content, err := parseToolCalls(text, req.Tools, req.toolChoice)
+		if err != nil {
+			return nil, &formatError{Code: "tool_call_parse_error", Details: []string{err.Error()}, Correction: toolCallCorrection(err)}
+		}
+		if len(calls) > 0 {
+			return &completion{Text: content, ToolCalls: calls, FinishReason: "tool_calls"}, nil
+		}
+		result.Text = content
+	}
+
+	if jsonMode(req) {
+		data, errs := parseJSONReply(result.Text, req)
+		if len(errs) > 0 {
+			return nil, &formatError{Code: "json_validation_error", Details: errs, Correction: jsonCorrection(errs)}
+		}
+		result.Text = data
+	}
+	return result, nil
+}
+
+// complete 等待回复并按请求要求解析，格式不符时携带错误说明重新询问，最多 maxRepairs 次
+func (h *ChatHandler) complete(task *chatTask, req *ChatRequest, onDelta func(delta string)) (*completion, error) {
+	if bufferReply(req) {
+		onDelta = nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		payload, err := h.collectReply(task, onDelta)
+		if err != nil {
+			return nil, err
+		}
+
+		result, fmtErr := parseCompletion(req, payload.Text)
+		if fmtErr == nil {
+			h.saveReply(task, payload)
+			return result, nil
+		}
+
+		if attempt >= h.maxRepairs {
+			return nil, &apiError{
+				Status:  http.StatusBadGateway,
+				Type:    "server_error",
+				Code:    fmtErr.Code,
+				Message: fmt.Sprintf("reply did not match the requested format after %d attempts: %s", attempt+1, fmtErr.Details[0]),
+				Details: fmtErr.Details,
+			}
+		}
+		log.Printf("[Chat] task %s: %s, retrying (%d/%d)", task.ID, strings.Join(fmtErr.Details, "; "), attempt+1, h.maxRepairs)
+		if err := h.resend(task, payload.Text, fmtErr.Correction); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resend 在同一 worker 上以同一任务 ID 重新下发 CMD_SEND_MESSAGE，附带纠正说明
+// previous 为未通过校验的上一次回复
+func (h *ChatHandler) resend(task *chatTask, previous, correction string) error {
+	payload := task.Payload
+	if task.Conv != nil && task.Conv.GeminiConversationID != "" {
+		// 固定会话：Gemini 端保留了上一次回复，直接在对话中追加纠正说明
+		payload.ConversationID = task.Conv.GeminiConversationID
+		payload.Prompt = correction
+		payload.Attachments = nil
 	} else {
-		h.handleNonStream(c, taskID, modelName, replyCh, &msg)
+		// 一次性对话已被删除，在新对话中重新发送完整 prompt，并附上纠正说明所指的上一次回复
+		payload.Prompt = task.Payload.Prompt + "\n\nYour previous reply was:\n<previous_reply>\n" + previous + "\n</previous_reply>\n\n" + correction
 	}
+
+	data, _ := json.Marshal(payload)
+	return h.Hub.SendCommand(task.Worker, &WSMessage{
+		ID:      task.ID,
+		Type:    "CMD_SEND_MESSAGE",
+		Payload: data,
+	})
 }
 
 // handleNonStream 非流式：等待 DONE 后一次性返回
-func (h *ChatHandler) handleNonStream(c *gin.Context, taskID, modelName string, replyCh chan *ReplyPayload, msg *model.Message) {
-	payload, err := h.TaskManager.WaitForDone(taskID, replyCh, requestTimeout)
+func (h *ChatHandler) handleNonStream(c *gin.Context, task *chatTask, req *ChatRequest) error {
+	result, err := h.complete(task, req, nil)
 	if err != nil {
 		log.Printf("[Chat] task failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		writeOpenAIError(c, taskAPIError(err))
+		return err
 	}
 
-	// 更新数据库
-	h.DB.Model(msg).Updates(map[string]interface{}{
-		"status": "received",
-	})
-	// 保存 model 回复
-	h.DB.Create(&model.Message{
-		ConversationID: payload.ConversationID,
-		Role:           "model",
-		Content:        payload.Text,
-		Status:         "received",
-	})
+	c.JSON(http.StatusOK, completionResponse(task, result))
+	return nil
+}
 
-	finishReason := "stop"
-	resp := ChatResponse{
-		ID:      taskID,
+// completionResponse 构建非流式 chat.completion 响应
+func completionResponse(task *chatTask, result *completion) ChatResponse {
+	return ChatResponse{
+		ID:      task.ID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   modelName,
+		Model:   task.Model,
 		Choices: []Choice{
 			{
 				Index: 0,
 				Message: &ChatMessage{
-					Role:    "assistant",
-					Content: payload.Text,
+					Role:      "assistant",
+					Content:   result.Text,
+					ToolCalls: result.ToolCalls,
 				},
-				FinishReason: &finishReason,
+				FinishReason: &result.FinishReason,
 			},
 		},
 		Usage: Usage{},
 	}
-
-	c.JSON(http.StatusOK, resp)
 }
 
 // handleStream 流式：SSE 推送
-func (h *ChatHandler) handleStream(c *gin.Context, taskID, modelName string, replyCh chan *ReplyPayload, msg *model.Message) {
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
+func (h *ChatHandler) handleStream(c *gin.Context, task *chatTask, req *ChatRequest) error {
+	setSSEHeaders(c)
 
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming not supported"})
-		return
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: "streaming not supported"})
+		return &HubError{"streaming not supported"}
 	}
 
 	// 发送第一个 chunk，包含 role
 	firstChunk := ChatResponse{
-		ID:      taskID,
+		ID:      task.ID,
 		Object:  "chat.completion.chunk",
 		Created: time.Now().Unix(),
-		Model:   modelName,
+		Model:   task.Model,
 		Choices: []Choice{
 			{
 				Index: 0,
@@ -308,95 +744,83 @@ func (h *ChatHandler) handleStream(c *gin.Context, taskID, modelName string, rep
 	}
 	writeSSE(c.Writer, flusher, firstChunk)
 
-	timer := time.NewTimer(requestTimeout)
-	defer timer.Stop()
-
-	prevText := ""
-
-	for {
-		select {
-		case payload, ok := <-replyCh:
-			if !ok {
-				return
-			}
-
-			if payload.Status == "ERROR" {
-				// 发送错误后结束
-				log.Printf("[Chat] stream error: %s", payload.Error)
-				return
-			}
+	// PROCESSING：推送增量 chunk
+	// DONE 的 text 是 Markdown 格式（通过复制按钮获取），与之前 PROCESSING 的纯文本不同
+	// 不再追加 delta，直接发 finish chunk，避免内容重复
+	writeDelta := func(delta *ChatMessage) {
+		chunk := ChatResponse{
+			ID:      task.ID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   task.Model,
+			Choices: []Choice{
+				{
+					Index:        0,
+					Delta:        delta,
+					FinishReason: nil,
+				},
+			},
+		}
+		writeSSE(c.Writer, flusher, chunk)
+	}
+	writeFinish := func(finishReason string) {
+		chunk := ChatResponse{
+			ID:      task.ID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   task.Model,
+			Choices: []Choice{
+				{
+					Index:        0,
+					Delta:        &ChatMessage{},
+					FinishReason: &finishReason,
+				},
+			},
+		}
+		writeSSE(c.Writer, flusher, chunk)
+	}
 
-			// PROCESSING：计算差量并推送增量 chunk
-			if payload.Status == "PROCESSING" {
-				delta := ""
-				if strings.HasPrefix(payload.Text, prevText) {
-					delta = payload.Text[len(prevText):]
-				} else {
-					delta = payload.Text
-				}
-				prevText = payload.Text
+	result, err := h.complete(task, req, func(delta string) {
+		writeDelta(&ChatMessage{Content: delta})
+	})
+	if err != nil {
+		log.Printf("[Chat] stream error for task %s: %v", task.ID, err)
+		if c.Request.Context().Err() != nil {
+			return err // 客户端已断开，无需响应
+		}
+		// 以 finish chunk 标明结束原因，再发送 OpenAI 格式的 error 事件和 [DONE]
+		writeFinish(errorFinishReason(err))
+		writeSSE(c.Writer, flusher, taskAPIError(err).openAIBody())
+		fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+		flusher.Flush()
+		return err
+	}
 
-				if delta != "" {
-					chunk := ChatResponse{
-						ID:      taskID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{
-							{
-								Index: 0,
-								Delta: &ChatMessage{
-									Content: delta,
-								},
-								FinishReason: nil,
-							},
-						},
-					}
-					writeSSE(c.Writer, flusher, chunk)
-				}
-				continue
-			}
+	// 启用工具或 JSON 输出时回复未增量推送：一次性发送文本，工具调用按 index 逐个发送
+	if bufferReply(req) {
+		if result.Text != "" {
+			writeDelta(&ChatMessage{Content: result.Text})
+		}
+		for i, call := range result.ToolCalls {
+			index := i
+			call.Index = &index
+			writeDelta(&ChatMessage{ToolCalls: []ToolCall{call}})
+		}
+	}
 
-			if payload.Status == "DONE" {
-				// DONE 的 text 是 Markdown 格式（通过复制按钮获取），与之前 PROCESSING 的纯文本不同
-				// 不再追加 delta，直接发 finish chunk，避免内容重复
-				// 更新数据库
-				h.DB.Model(msg).Update("status", "received")
-				h.DB.Create(&model.Message{
-					ConversationID: payload.ConversationID,
-					Role:           "model",
-					Content:        payload.Text,
-					Status:         "received",
-				})
-
-				// 发送 finish chunk
-				finishReason := "stop"
-				finishChunk := ChatResponse{
-					ID:      taskID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   modelName,
-					Choices: []Choice{
-						{
-							Index:        0,
-							Delta:        &ChatMessage{},
-							FinishReason: &finishReason,
-						},
-					},
-				}
-				writeSSE(c.Writer, flusher, finishChunk)
+	// 发送 finish chunk
+	writeFinish(result.FinishReason)
 
-				// 发送 [DONE]
-				fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-				flusher.Flush()
-				return
-			}
+	// 发送 [DONE]
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+	return nil
+}
 
-		case <-timer.C:
-			log.Printf("[Chat] stream timeout for task %s", taskID)
-			return
-		}
-	}
+func setSSEHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
 }
 
 func writeSSE(w http.ResponseWriter, flusher http.Flusher, data interface{}) {
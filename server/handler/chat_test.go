@@ -3,6 +3,7 @@ package handler
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -18,11 +19,23 @@ import (
 	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
 )
 
+// testConfig 返回测试用配置，排队等待时间缩短为 1s
+func testConfig(apiKey string) *config.Config {
+	cfg := config.Default()
+	cfg.APIKey = apiKey
+	cfg.Queue = config.QueueConfig{MaxSize: 1, MaxWait: 1}
+	cfg.ModelAliases = map[string]string{"gpt-4o": "gemini-flash"}
+	cfg.Models[1].Fallback = []string{"gemini-flash"} // gemini-pro 额度用尽时降级到 gemini-flash
+	cfg.Jobs.CallbackSecret = "test-secret"
+	cfg.Jobs.AllowPrivateCallbacks = true // 测试中的回调服务监听在回环地址
+	return cfg
+}
+
 func setupChatTest(t *testing.T) (*Hub, *TaskManager, *httptest.Server, *gin.Engine) {
 	t.Helper()
 	gin.SetMode(gin.TestMode)
 
-	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10}
+	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken}
 	hub := NewHub(cfg)
 	tm := NewTaskManager()
 	tm.StartDispatcher(hub)
@@ -33,11 +46,28 @@ func setupChatTest(t *testing.T) (*Hub, *TaskManager, *httptest.Server, *gin.Eng
 		t.Fatal(err)
 	}
 
-	chatHandler := NewChatHandler(hub, tm, db, "")
+	chatCfg := testConfig("")
+	chatCfg.Attachments.Dir = filepath.Join(tmpDir, "attachments")
+	chatHandler := NewChatHandler(hub, tm, db, chatCfg)
 
 	r := gin.New()
 	r.GET("/ws", hub.HandleWS)
 	r.POST("/v1/chat/completions", chatHandler.Handle)
+	r.POST("/v1/messages", chatHandler.HandleMessages)
+	r.DELETE("/v1/conversations/:id", chatHandler.DeleteConversation)
+	r.GET("/v1/models", chatHandler.ListModels)
+	r.GET("/v1/models/:id", chatHandler.GetModel)
+	r.POST("/api/chat", chatHandler.HandleOllamaChat)
+	r.POST("/api/generate", chatHandler.HandleOllamaGenerate)
+	r.GET("/api/tags", chatHandler.ListOllamaTags)
+	r.POST("/v1/jobs", chatHandler.CreateJob)
+	r.GET("/v1/jobs/:id", chatHandler.GetJob)
+	r.POST("/v1/jobs/:id/cancel", chatHandler.CancelJob)
+	adminHandler := NewAdminHandler(hub, chatHandler, "")
+	r.GET("/admin/metrics", adminHandler.Metrics)
+	r.GET("/admin/tasks", adminHandler.ListTasks)
+	r.GET("/admin/tasks/:id", adminHandler.GetTask)
+	r.POST("/admin/tasks/:id/cancel", adminHandler.CancelTask)
 
 	server := httptest.NewServer(r)
 	return hub, tm, server, r
@@ -46,8 +76,16 @@ func setupChatTest(t *testing.T) (*Hub, *TaskManager, *httptest.Server, *gin.Eng
 // 模拟插件：连接 WS，接收 CMD_SEND_MESSAGE，回复 EVENT_REPLY
 func simulateExtension(t *testing.T, server *httptest.Server, replies []WSMessage) *websocket.Conn {
 	t.Helper()
+	conn, _ := recordExtension(t, server, replies)
+	return conn
+}
+
+// recordExtension 同 simulateExtension，并将收到的所有指令写入返回的 channel
+func recordExtension(t *testing.T, server *httptest.Server, replies []WSMessage) (*websocket.Conn, chan WSMessage) {
+	t.Helper()
+	received := make(chan WSMessage, 16)
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+testWSToken, nil)
 	if err != nil {
 		t.Fatalf("dial ws failed: %v", err)
 	}
@@ -63,8 +101,14 @@ func simulateExtension(t *testing.T, server *httptest.Server, replies []WSMessag
 			if err := json.Unmarshal(data, &msg); err != nil {
 				continue
 			}
+			if msg.Type != "PING" {
+				select {
+				case received <- msg:
+				default:
+				}
+			}
 
-			if msg.Type == "CMD_SEND_MESSAGE" {
+			if msg.Type == "CMD_SEND_MESSAGE" || msg.Type == "CMD_DELETE_CONVERSATION" {
 				// 用收到的任务 ID 回复
 				for _, reply := range replies {
 					r := reply
@@ -77,7 +121,47 @@ func simulateExtension(t *testing.T, server *httptest.Server, replies []WSMessag
 		}
 	}()
 
-	return conn
+	return conn, received
+}
+
+// sequenceExtension 模拟插件：第 i 次收到 CMD_SEND_MESSAGE 时回复 rounds[i]，用于测试纠正重试
+func sequenceExtension(t *testing.T, server *httptest.Server, rounds [][]WSMessage) (*websocket.Conn, chan WSMessage) {
+	t.Helper()
+	received := make(chan WSMessage, 16)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+testWSToken, nil)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+
+	go func() {
+		round := 0
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var msg WSMessage
+			if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "CMD_SEND_MESSAGE" {
+				continue
+			}
+			received <- msg
+			if round >= len(rounds) {
+				continue
+			}
+			for _, reply := range rounds[round] {
+				r := reply
+				r.ReplyTo = msg.ID
+				rData, _ := json.Marshal(r)
+				conn.WriteMessage(websocket.TextMessage, rData)
+				time.Sleep(50 * time.Millisecond)
+			}
+			round++
+		}
+	}()
+
+	return conn, received
 }
 
 func TestNonStreamChat(t *testing.T) {
@@ -220,10 +304,125 @@ func TestStreamChat(t *testing.T) {
 	}
 }
 
+func TestChatTaskRecord(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn := simulateExtension(t, server, donePayloadWithText("Hello from Gemini!"))
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+	r.ServeHTTP(w, req)
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	// 任务表记录最终状态，user 消息与 model 回复通过任务 ID 关联
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/tasks/"+resp.ID, nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var task model.Task
+	json.Unmarshal(w.Body.Bytes(), &task)
+	if task.State != model.TaskDone || task.WorkerID == "" || task.FinishedAt == nil {
+		t.Errorf("unexpected task record: %s", w.Body.String())
+	}
+	if len(task.Messages) != 2 || task.Messages[0].Role != "user" || task.Messages[1].Content != "Hello from Gemini!" {
+		t.Errorf("expected user and model messages linked to the task, got %+v", task.Messages)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/tasks?state=done", nil)
+	r.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), resp.ID) {
+		t.Errorf("expected task in list, got %s", w.Body.String())
+	}
+}
+
+func TestStreamChatError(t *testing.T) {
+	server, r, db, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	p1, _ := json.Marshal(map[string]string{"text": "Hel", "status": "PROCESSING"})
+	p2, _ := json.Marshal(map[string]string{"error": "cannot find input element"})
+	conn := simulateExtension(t, server, []WSMessage{
+		{Type: "EVENT_REPLY", Payload: p1},
+		{Type: "EVENT_ERROR", Payload: p2},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Hello"}],"stream":true}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	// 流以 finish chunk、error 事件和 [DONE] 结束
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(lines) < 3 || lines[len(lines)-1] != "data: [DONE]" {
+		t.Fatalf("stream should end with [DONE], got:\n%s", w.Body.String())
+	}
+	var finish ChatResponse
+	json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-3], "data: ")), &finish)
+	if reason := finish.Choices[0].FinishReason; reason == nil || *reason != "error" {
+		t.Errorf("expected finish_reason error, got %s", lines[len(lines)-3])
+	}
+	var errEvent struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-2], "data: ")), &errEvent)
+	if errEvent.Error.Message != "cannot find input element" || errEvent.Error.Code != "extension_error" {
+		t.Errorf("unexpected error event: %s", lines[len(lines)-2])
+	}
+
+	// user 消息标记为 error 并保存错误信息
+	var msg model.Message
+	db.Where("role = ?", "user").First(&msg)
+	if msg.Status != "error" || msg.Error != "cannot find input element" {
+		t.Errorf("expected user message status error, got %q (%q)", msg.Status, msg.Error)
+	}
+}
+
+func TestNonStreamChatError(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	errPayload, _ := json.Marshal(map[string]string{"error": "response timeout"})
+	conn := simulateExtension(t, server, []WSMessage{{Type: "EVENT_ERROR", Payload: errPayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error.Type != "server_error" || errResp.Error.Code != "extension_error" {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+}
+
 func TestChatNoExtension(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10}
+	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken}
 	hub := NewHub(cfg)
 	tm := NewTaskManager()
 	tm.StartDispatcher(hub)
@@ -231,7 +430,7 @@ func TestChatNoExtension(t *testing.T) {
 	tmpDir := t.TempDir()
 	db, _ := model.InitDB(filepath.Join(tmpDir, "test.db"))
 
-	chatHandler := NewChatHandler(hub, tm, db, "")
+	chatHandler := NewChatHandler(hub, tm, db, testConfig(""))
 
 	r := gin.New()
 	r.POST("/v1/chat/completions", chatHandler.Handle)
@@ -250,14 +449,14 @@ func TestChatNoExtension(t *testing.T) {
 func TestChatNoUserMessage(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10}
+	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken}
 	hub := NewHub(cfg)
 	tm := NewTaskManager()
 
 	tmpDir := t.TempDir()
 	db, _ := model.InitDB(filepath.Join(tmpDir, "test.db"))
 
-	chatHandler := NewChatHandler(hub, tm, db, "")
+	chatHandler := NewChatHandler(hub, tm, db, testConfig(""))
 
 	r := gin.New()
 	r.POST("/v1/chat/completions", chatHandler.Handle)
@@ -276,14 +475,14 @@ func TestChatNoUserMessage(t *testing.T) {
 func TestChatAPIKeyAuth(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10}
+	cfg := &config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken}
 	hub := NewHub(cfg)
 	tm := NewTaskManager()
 
 	tmpDir := t.TempDir()
 	db, _ := model.InitDB(filepath.Join(tmpDir, "test.db"))
 
-	chatHandler := NewChatHandler(hub, tm, db, "my-secret-key")
+	chatHandler := NewChatHandler(hub, tm, db, testConfig("my-secret-key"))
 
 	r := gin.New()
 	r.POST("/v1/chat/completions", chatHandler.Handle)
@@ -320,6 +519,276 @@ func TestChatAPIKeyAuth(t *testing.T) {
 	}
 }
 
+func TestChatQueueWaitsForIdleWorker(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{
+		"text":   "queued reply",
+		"status": "DONE",
+	})
+	conn := simulateExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// 占用唯一的 worker，稍后释放
+	worker, err := hub.AcquireWorker("occupied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		hub.ReleaseWorker(worker, false)
+	}()
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Hello"}],"stream":true}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, ": queue position 1") {
+		t.Errorf("expected queue position comment, got %s", body)
+	}
+	if !strings.Contains(body, "data: [DONE]") {
+		t.Errorf("expected stream to finish after queueing, got %s", body)
+	}
+}
+
+func TestChatQueueFullAndTimeout(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn := simulateExtension(t, server, nil)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := hub.AcquireWorker("occupied"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 第一个请求进入队列（MaxSize=1），等待超时后返回 503
+	firstDone := make(chan int, 1)
+	go func() { firstDone <- send().Code }()
+	time.Sleep(200 * time.Millisecond)
+
+	// 队列已满，第二个请求立即返回 429
+	if code := send().Code; code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 when queue is full, got %d", code)
+	}
+
+	select {
+	case code := <-firstDone:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 after queue timeout, got %d", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued request did not time out")
+	}
+}
+
+func TestChatPinnedConversation(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{
+		"text":            "first answer",
+		"status":          "DONE",
+		"conversation_id": "gem-1",
+	})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(ConversationHeader, "chat-1")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	nextCommand := func() SendMessagePayload {
+		t.Helper()
+		select {
+		case msg := <-received:
+			var p SendMessagePayload
+			json.Unmarshal(msg.Payload, &p)
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("no command received")
+		}
+		return SendMessagePayload{}
+	}
+
+	// 第一轮：新建 Gemini 对话并保留
+	w := send(`{"messages":[{"role":"user","content":"Hello"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(ConversationHeader) != "chat-1" {
+		t.Errorf("expected conversation header chat-1, got %q", w.Header().Get(ConversationHeader))
+	}
+	first := nextCommand()
+	if first.ConversationID != "" || !first.KeepConversation {
+		t.Errorf("unexpected first command: %+v", first)
+	}
+
+	// 第二轮：复用 gem-1，只发送新消息
+	w = send(`{"messages":[{"role":"user","content":"Hello"},{"role":"assistant","content":"first answer"},{"role":"user","content":"Next"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	second := nextCommand()
+	if second.ConversationID != "gem-1" {
+		t.Errorf("expected conversation_id gem-1, got %q", second.ConversationID)
+	}
+	if second.Prompt != "Next" {
+		t.Errorf("expected only new message as prompt, got %q", second.Prompt)
+	}
+
+	// 结束会话：下发删除指令并清理本地记录
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/v1/conversations/chat-1", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case msg := <-received:
+		if msg.Type != "CMD_DELETE_CONVERSATION" {
+			t.Errorf("expected CMD_DELETE_CONVERSATION, got %s", msg.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no delete command received")
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/v1/conversations/chat-1", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestModelsEndpoint(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/models", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var list ModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Object != "list" || len(list.Data) != len(config.Default().Models) {
+		t.Fatalf("unexpected model list: %+v", list)
+	}
+	if list.Data[0].Object != "model" || list.Data[0].ID != "gemini" {
+		t.Errorf("unexpected first model: %+v", list.Data[0])
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/models/gemini-flash", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for known model, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/models/gpt-4", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown model, got %d", w.Code)
+	}
+}
+
+func TestChatUnknownModel(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	reqBody := `{"model":"gpt-4","messages":[{"role":"user","content":"Hello"}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	var resp struct {
+		Error struct {
+			Code  string `json:"code"`
+			Param string `json:"param"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error.Code != "model_not_found" || resp.Error.Param != "model" {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+}
+
+func TestChatModelAliasAndActualModel(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	// 网页端实际使用的是 Pro 模型（例如 Flash 不可用）
+	donePayload, _ := json.Marshal(map[string]string{
+		"text":   "answer",
+		"status": "DONE",
+		"model":  "2.5 Pro",
+	})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 别名 gpt-4o -> gemini-flash，下发的模式应为 flash
+	select {
+	case msg := <-received:
+		var p SendMessagePayload
+		json.Unmarshal(msg.Payload, &p)
+		if p.Mode != "flash" {
+			t.Errorf("expected mode flash, got %q", p.Mode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no command received")
+	}
+
+	// 响应中的 model 反映实际使用的模型
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Model != "gemini" {
+		t.Errorf("expected actual model gemini (pro), got %q", resp.Model)
+	}
+}
+
 func TestTaskManagerDispatch(t *testing.T) {
 	tm := NewTaskManager()
 
@@ -349,5 +818,289 @@ func TestTaskManagerDispatch(t *testing.T) {
 		t.Error("timeout waiting for dispatch")
 	}
 
+	// EVENT_ERROR 保留错误码，缺省时为 extension_error
+	for _, tc := range []struct{ payload, code string }{
+		{`{"error":"please sign in","code":"login_required"}`, "login_required"},
+		{`{"error":"boom"}`, "extension_error"},
+	} {
+		tm.Dispatch(&WSMessage{ReplyTo: taskID, Type: "EVENT_ERROR", Payload: json.RawMessage(tc.payload)})
+		reply := <-ch
+		if reply.Status != "ERROR" || reply.Code != tc.code {
+			t.Errorf("expected ERROR with code %s, got %+v", tc.code, reply)
+		}
+	}
+
 	tm.RemoveTask(taskID)
 }
+
+func TestChatExtensionErrorCodes(t *testing.T) {
+	cases := []struct {
+		code   string
+		status int
+		typ    string
+	}{
+		{"input_not_found", http.StatusBadGateway, "server_error"},
+		{"send_button_missing", http.StatusBadGateway, "server_error"},
+		{"login_required", http.StatusUnauthorized, "authentication_error"},
+		{"rate_limited_by_gemini", http.StatusTooManyRequests, "rate_limit_error"},
+		{"response_timeout", http.StatusGatewayTimeout, "timeout_error"},
+		{"something_new", http.StatusBadGateway, "server_error"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.code, func(t *testing.T) {
+			_, _, server, r := setupChatTest(t)
+			defer server.Close()
+
+			errPayload, _ := json.Marshal(map[string]string{"error": "failed: " + tc.code, "code": tc.code})
+			conn := simulateExtension(t, server, []WSMessage{{Type: "EVENT_ERROR", Payload: errPayload}})
+			defer conn.Close()
+			time.Sleep(200 * time.Millisecond)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+			r.ServeHTTP(w, req)
+
+			var errResp struct {
+				Error struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Code    string `json:"code"`
+				} `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &errResp)
+			if w.Code != tc.status || errResp.Error.Type != tc.typ || errResp.Error.Code != tc.code {
+				t.Errorf("expected %d %s/%s, got %d: %s", tc.status, tc.typ, tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// 请求体解析失败同样返回 OpenAI 格式的错误对象
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"type":"invalid_request_error"`) {
+		t.Errorf("expected OpenAI error object for invalid JSON, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatContentParts(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "It's a cat", "status": "DONE"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","messages":[
+		{"role":"system","content":[{"type":"text","text":"Be brief"}]},
+		{"role":"user","content":[
+			{"type":"text","text":"What is"},
+			{"type":"image_url","image_url":{"url":"` + testPNGDataURL + `"}},
+			{"type":"text","text":"in this picture?"}
+		]}
+	]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case msg := <-received:
+		var p SendMessagePayload
+		json.Unmarshal(msg.Payload, &p)
+		if !strings.Contains(p.Prompt, "Be brief") || !strings.Contains(p.Prompt, "What is\nin this picture?") {
+			t.Errorf("text parts not flattened into prompt: %s", p.Prompt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no command received")
+	}
+
+	// 非 text part 保留在 Parts 中
+	var msg ChatMessage
+	json.Unmarshal([]byte(`{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AA=="}}]}`), &msg)
+	if msg.Content != "hi" || len(msg.Parts) != 2 || msg.Parts[1].ImageURL == nil {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	// 其他类型的 content → 400
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":42}]}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for numeric content, got %d", w.Code)
+	}
+}
+
+func TestChatQueueWaitsForExtension(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	// 插件连接前到达的请求排队等待，而不是立即返回 503
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "late reply", "status": "DONE"})
+	conn := simulateExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued request was not served after the extension connected")
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "late reply") {
+		t.Fatalf("expected 200 after the extension connected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatQueueTimeoutWithoutExtension(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	// 等待超时后仍未连接，返回 extension_not_connected 而非 queue_timeout
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"code":"extension_not_connected"`) {
+		t.Fatalf("expected 503 extension_not_connected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatStreamQueueTimeout(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn := simulateExtension(t, server, nil)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := hub.AcquireWorker("occupied"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}],"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	// 排队期间 SSE 已开始，超时后以 error 事件和 [DONE] 结束流
+	body := w.Body.String()
+	if !strings.Contains(body, ": queue position 1") || !strings.Contains(body, `"code":"queue_timeout"`) {
+		t.Fatalf("expected queue comment and queue_timeout error event, got %s", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("expected the stream to end with [DONE], got %s", body)
+	}
+}
+
+func TestChatReplyConversationIDs(t *testing.T) {
+	server, r, db, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "answer", "status": "DONE", "conversation_id": "gem-1"})
+	conn := simulateExtension(t, server, []WSMessage{
+		{Type: "EVENT_REPLY", Payload: donePayload},
+		{Type: "EVENT_REPLY", Payload: donePayload},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	send := func(chatKey string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		if chatKey != "" {
+			req.Header.Set(ConversationHeader, chatKey)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// 一次性对话：conversation_id 为空，Gemini 对话 ID 单独保存
+	send("")
+	// 固定会话：conversation_id 为 API 侧会话 ID
+	send("chat-1")
+
+	var replies []model.Message
+	db.Where("role = ?", "model").Order("id").Find(&replies)
+	if len(replies) != 2 {
+		t.Fatalf("expected two model messages, got %d", len(replies))
+	}
+	if replies[0].ConversationID != "" || replies[0].GeminiConversationID != "gem-1" {
+		t.Errorf("unexpected one-shot reply ids: %q / %q", replies[0].ConversationID, replies[0].GeminiConversationID)
+	}
+	if replies[1].ConversationID != "chat-1" || replies[1].GeminiConversationID != "gem-1" {
+		t.Errorf("unexpected pinned reply ids: %q / %q", replies[1].ConversationID, replies[1].GeminiConversationID)
+	}
+}
+
+func TestDeleteBusyConversation(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "first answer", "status": "DONE", "conversation_id": "gem-1"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	send := func(ctx context.Context) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewBufferString(`{"messages":[{"role":"user","content":"Hello"}]}`))
+		req.Header.Set(ConversationHeader, "chat-1")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := send(context.Background()); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	<-received
+
+	// 插件不再回复：第二轮请求一直处理中
+	conn.Close()
+	conn = simulateExtension(t, server, nil)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		send(ctx)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// 处理中的会话不能删除
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/v1/conversations/chat-1", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"code":"conversation_busy"`) {
+		t.Fatalf("expected 409 conversation_busy, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 请求结束后可以删除
+	cancel()
+	<-done
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the request finished, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ContentPart OpenAI 数组形式 content 中的一项（text / image_url / file 等）
+type ContentPart struct {
+	Type     string           `json:"type"`
+	Text     string           `json:"text,omitempty"`
+	ImageURL *ContentImageURL `json:"image_url,omitempty"`
+	File     *ContentFile     `json:"file,omitempty"`
+}
+
+type ContentImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ContentFile struct {
+	FileData string `json:"file_data,omitempty"` // data URL 或 base64
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+// UnmarshalJSON content 同时支持 string 与 content part 数组两种形式
+// 数组形式时 text part 拼接为 Content，完整的 part 列表保存在 Parts 中供后续处理
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type alias ChatMessage
+	aux := struct {
+		*alias
+		Content json.RawMessage `json:"content"`
+	}{alias: (*alias)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	text, parts, err := parseContent(aux.Content)
+	if err != nil {
+		return err
+	}
+	m.Content = text
+	m.Parts = parts
+	return nil
+}
+
+// parseContent 解析 string / null / content part 数组
+func parseContent(raw json.RawMessage) (string, []ContentPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return "", nil, nil
+	}
+
+	switch raw[0] {
+	case '"':
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "", nil, err
+		}
+		return text, nil, nil
+	case '[':
+		var parts []ContentPart
+		if err := json.Unmarshal(raw, &parts); err != nil {
+			return "", nil, fmt.Errorf("invalid content parts: %v", err)
+		}
+		var texts []string
+		for _, p := range parts {
+			if p.Type == "text" {
+				texts = append(texts, p.Text)
+			}
+		}
+		return strings.Join(texts, "\n"), parts, nil
+	default:
+		return "", nil, fmt.Errorf("content must be a string or an array of content parts")
+	}
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// ConversationHeader 客户端通过此请求头（或 OpenAI 的 user 字段）固定一个多轮会话
+const ConversationHeader = "X-Conversation-ID"
+
+const deleteConversationTimeout = 60 * time.Second
+
+// chatTask 一次 chat completion 请求在处理过程中的上下文
+type chatTask struct {
+	ID      string
+	Model   string              // 响应中返回的模型 ID，收到插件回复后更新为实际使用的模型
+	Spec    *config.ModelConfig // 当前使用的模型配置，额度用尽降级后为降级模型
+	Worker  *Client             // 分配到的插件 worker
+	ReplyCh <-chan *ReplyPayload
+	UserMsg *model.Message
+	ChatKey string              // API 侧会话 ID，为空表示一次性对话
+	Conv    *model.Conversation // ChatKey 对应的会话记录
+	Payload SendMessagePayload  // 已下发的 CMD_SEND_MESSAGE，纠正重试时复用
+
+	Fallbacks  []string      // 尚未尝试的降级模型 ID
+	processing bool          // 任务表已记录 processing 状态
+	timeout    time.Duration // 等待插件回复的超时
+
+	ctx    context.Context         // 随客户端断开或管理端取消而结束
+	cancel context.CancelCauseFunc // 以指定原因取消 ctx
+}
+
+// resolveChatKey 获取 API 侧会话 ID：请求头优先，其次 user 字段
+func resolveChatKey(c *gin.Context, req *ChatRequest) string {
+	if key := c.GetHeader(ConversationHeader); key != "" {
+		return key
+	}
+	return req.User
+}
+
+// loadConversation 加载或创建 API 侧会话记录
+func (h *ChatHandler) loadConversation(chatKey string, messages []ChatMessage) (*model.Conversation, error) {
+	var conv model.Conversation
+	err := h.DB.First(&conv, "id = ?", chatKey).Error
+	if err == nil {
+		return &conv, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	conv = model.Conversation{ID: chatKey, Title: conversationTitle(messages)}
+	if err := h.DB.Create(&conv).Error; err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// conversationTitle 取第一条 user 消息的前 50 个字符作为会话标题
+func conversationTitle(messages []ChatMessage) string {
+	for _, msg := range messages {
+		if msg.Role == "user" {
+			title := []rune(msg.Content)
+			if len(title) > 50 {
+				title = title[:50]
+			}
+			return string(title)
+		}
+	}
+	return ""
+}
+
+// turnMessages 返回最后一条 assistant 消息之后的新消息
+func turnMessages(messages []ChatMessage) []ChatMessage {
+	start := 0
+	for i, msg := range messages {
+		if msg.Role == "assistant" {
+			start = i + 1
+		}
+	}
+	return messages[start:]
+}
+
+// buildTurnPrompt 构建发送给已有 Gemini 对话的 prompt：只包含最后一条 assistant 消息之后的新消息
+// Gemini 端已保存此前的上下文，无需重复粘贴完整历史
+func buildTurnPrompt(messages []ChatMessage) (string, error) {
+	newMessages := turnMessages(messages)
+	if len(newMessages) == 1 && newMessages[0].Role == "user" {
+		return newMessages[0].Content, nil
+	}
+	return messagesToXML(newMessages)
+}
+
+// bindConversation 固定会话收到回复后记录其对应的 Gemini 对话，纠正重试与后续轮次在该对话中继续
+func (h *ChatHandler) bindConversation(task *chatTask, geminiID string) {
+	if task.Conv == nil || geminiID == "" || geminiID == task.Conv.GeminiConversationID {
+		return
+	}
+	task.Conv.GeminiConversationID = geminiID
+	h.DB.Model(task.Conv).Update("gemini_conversation_id", geminiID)
+	log.Printf("[Chat] conversation %s bound to gemini conversation %s", task.Conv.ID, geminiID)
+}
+
+// saveReply 回复被接受后更新数据库：用户消息状态与 model 回复
+// 格式校验未通过而被纠正重试的回复不保存
+func (h *ChatHandler) saveReply(task *chatTask, payload *ReplyPayload) {
+	h.DB.Model(task.UserMsg).Update("status", "received")
+
+	var conversationID string
+	geminiID := payload.ConversationID
+	if task.Conv != nil {
+		conversationID = task.Conv.ID
+		if geminiID == "" {
+			geminiID = task.Conv.GeminiConversationID
+		}
+	}
+
+	h.DB.Create(&model.Message{
+		TaskID:               task.ID,
+		ConversationID:       conversationID,
+		GeminiConversationID: geminiID,
+		Role:                 "model",
+		Content:              payload.Text,
+		Status:               "received",
+		Model:                task.Model,
+	})
+}
+
+// DeleteConversation 处理 DELETE /v1/conversations/:id
+// 结束一个固定会话：删除 Gemini 网页端对应的对话及本地记录
+func (h *ChatHandler) DeleteConversation(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	id := c.Param("id")
+	var conv model.Conversation
+	if err := h.DB.First(&conv, "id = ?", id).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "conversation_not_found", Message: "conversation not found"})
+		return
+	}
+
+	// 占用会话锁：处理中的请求结束前不能删除，删除期间也不接受新请求
+	if _, busy := h.activeChats.LoadOrStore(conv.ID, ""); busy {
+		writeOpenAIError(c, errConversationBusy())
+		return
+	}
+	defer h.activeChats.Delete(conv.ID)
+
+	// 通知插件删除 Gemini 网页端对话（尽力而为，失败不影响本地删除）
+	remoteDeleted := false
+	if conv.GeminiConversationID != "" {
+		if err := h.deleteGeminiConversation(c, conv.GeminiConversationID); err != nil {
+			log.Printf("[Chat] delete gemini conversation %s failed: %v", conv.GeminiConversationID, err)
+		} else {
+			remoteDeleted = true
+		}
+	}
+
+	// 删除会话中消息的附件文件与记录
+	var attachments []model.Attachment
+	h.DB.Where("message_id IN (?)", h.DB.Model(&model.Message{}).Select("id").Where("conversation_id = ?", conv.ID)).Find(&attachments)
+	if len(attachments) > 0 {
+		removeAttachmentFiles(attachments)
+		h.DB.Delete(&attachments)
+	}
+
+	h.DB.Where("conversation_id = ?", conv.ID).Delete(&model.Message{})
+	h.DB.Delete(&conv)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":             conv.ID,
+		"object":         "conversation.deleted",
+		"deleted":        true,
+		"remote_deleted": remoteDeleted,
+	})
+}
+
+// deleteGeminiConversation 向空闲 worker 下发 CMD_DELETE_CONVERSATION 并等待完成
+func (h *ChatHandler) deleteGeminiConversation(c *gin.Context, geminiID string) error {
+	taskID := fmt.Sprintf("delconv-%s", uuid.New().String())
+	if missing := h.Hub.MissingCapabilities(CapConversations); len(missing) > 0 {
+		return &HubError{"the connected extension does not support deleting conversations"}
+	}
+	worker, err := h.Queue.Acquire(c.Request.Context(), taskID, []string{CapConversations}, nil)
+	if err != nil {
+		return err
+	}
+	var taskErr error
+	defer func() { h.Hub.ReleaseWorker(worker, taskErr != nil) }()
+
+	replyCh := h.TaskManager.CreateTask(taskID)
+	defer h.TaskManager.RemoveTask(taskID)
+
+	payload, _ := json.Marshal(map[string]string{"conversation_id": geminiID})
+	if taskErr = h.Hub.SendCommand(worker, &WSMessage{
+		ID:      taskID,
+		Type:    "CMD_DELETE_CONVERSATION",
+		Payload: payload,
+	}); taskErr != nil {
+		return taskErr
+	}
+
+	_, taskErr = h.TaskManager.WaitForDone(taskID, replyCh, deleteConversationTimeout)
+	return taskErr
+}
+
+// errConversationBusy 固定会话正在处理其他请求
+func errConversationBusy() *apiError {
+	return &apiError{Status: http.StatusConflict, Type: "conflict_error", Code: "conversation_busy", Message: "conversation is processing another request"}
+}
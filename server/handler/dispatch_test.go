@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplyCoalescing(t *testing.T) {
+	tm := NewTaskManager()
+	ch := tm.CreateTask("task-1")
+	defer tm.RemoveTask("task-1")
+
+	// 等待方未读取期间插件持续上报 PROCESSING，最后是 DONE
+	text := ""
+	for i := 0; i < 50; i++ {
+		text += "x"
+		payload, _ := json.Marshal(map[string]string{"text": text, "status": "PROCESSING"})
+		tm.Dispatch(&WSMessage{ReplyTo: "task-1", Type: "EVENT_REPLY", Payload: payload})
+	}
+	done, _ := json.Marshal(map[string]string{"text": text + "!", "status": "DONE"})
+	tm.Dispatch(&WSMessage{ReplyTo: "task-1", Type: "EVENT_REPLY", Payload: done})
+
+	if m := tm.Metrics(); m.Tasks != 1 || m.Coalesced == 0 {
+		t.Errorf("expected coalesced PROCESSING updates, got %+v", m)
+	}
+
+	var replies []*ReplyPayload
+	for len(replies) == 0 || replies[len(replies)-1].Status != "DONE" {
+		select {
+		case reply := <-ch:
+			replies = append(replies, reply)
+		case <-time.After(time.Second):
+			t.Fatalf("DONE was not delivered, got %d replies", len(replies))
+		}
+	}
+	if len(replies) > 3 {
+		t.Errorf("expected PROCESSING updates to be coalesced, got %d replies", len(replies))
+	}
+	if last := replies[len(replies)-2]; last.Status != "PROCESSING" || last.Text != text {
+		t.Errorf("expected the latest PROCESSING text before DONE, got %+v", last)
+	}
+	if m := tm.Metrics(); m.Backlog != 0 {
+		t.Errorf("expected an empty backlog, got %+v", m)
+	}
+}
+
+func TestIncomingBackpressure(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// 超过队列容量的消息在分发恢复后全部送达
+	total := cap(hub.IncomingMessages) + 20
+	for i := 0; i < total; i++ {
+		status := "PROCESSING"
+		if i == total-1 {
+			status = "DONE"
+		}
+		payload, _ := json.Marshal(map[string]string{"text": "chunk", "status": status})
+		conn.WriteJSON(WSMessage{ReplyTo: "task-1", Type: "EVENT_REPLY", Payload: payload})
+	}
+	time.Sleep(200 * time.Millisecond)
+	if m := hub.IncomingMetrics(); m.Blocked == 0 || m.Queued != m.Capacity {
+		t.Errorf("expected the reader to be blocked on a full queue, got %+v", m)
+	}
+
+	received := 0
+	var last *WSMessage
+	for received < total {
+		select {
+		case last = <-hub.IncomingMessages:
+			received++
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", total, received)
+		}
+	}
+	if !strings.Contains(string(last.Payload), "DONE") {
+		t.Errorf("expected the final DONE to be delivered last, got %s", last.Payload)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/metrics", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Incoming IncomingMetrics `json:"incoming"`
+		Replies  ReplyMetrics    `json:"replies"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Incoming.Capacity != 100 || body.Replies.Tasks != 0 {
+		t.Errorf("unexpected metrics: %s", w.Body.String())
+	}
+}
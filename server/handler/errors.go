@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiError 与协议无关的 API 错误，由各协议的 handler 转换为对应的响应格式
+type apiError struct {
+	Status  int
+	Type    string // OpenAI error.type
+	Code    string // OpenAI error.code，可为空
+	Param   string // OpenAI error.param，可为空
+	Message string
+	Details []string // 可选，详细的错误列表（如 JSON Schema 校验错误）
+
+	RetryAfter int // 可选，建议的重试间隔（秒），写入 Retry-After 响应头
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+// openAIBody 返回 OpenAI 格式的错误响应体
+func (e *apiError) openAIBody() gin.H {
+	body := gin.H{
+		"message": e.Message,
+		"type":    e.Type,
+	}
+	if e.Code != "" {
+		body["code"] = e.Code
+	}
+	if e.Param != "" {
+		body["param"] = e.Param
+	}
+	if len(e.Details) > 0 {
+		body["details"] = e.Details
+	}
+	if e.RetryAfter > 0 {
+		body["retry_after"] = e.RetryAfter
+	}
+	return gin.H{"error": body}
+}
+
+// writeOpenAIError 以 OpenAI 格式写入错误响应
+func writeOpenAIError(c *gin.Context, e *apiError) {
+	setRetryAfter(c, e)
+	c.JSON(e.Status, e.openAIBody())
+}
+
+// setRetryAfter 错误带有重试间隔时设置 Retry-After 响应头
+func setRetryAfter(c *gin.Context, e *apiError) {
+	if e.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+}
+
+func errModelNotFound(id string) *apiError {
+	return &apiError{
+		Status:  http.StatusNotFound,
+		Type:    "invalid_request_error",
+		Code:    "model_not_found",
+		Param:   "model",
+		Message: fmt.Sprintf("The model `%s` does not exist", id),
+	}
+}
+
+// errMessageTooLarge 指令超过 worker 传输层的大小上限（native messaging 的 1MB），通常由附件过大导致
+func errMessageTooLarge() *apiError {
+	return &apiError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Type:    "invalid_request_error",
+		Code:    "message_too_large",
+		Message: "the request is too large for the extension's native messaging connection (max 1MB including base64 attachments); use smaller attachments or the WebSocket transport",
+	}
+}
+
+// statusClientClosedRequest 任务被取消时使用的非标准状态码（同 nginx 499）
+const statusClientClosedRequest = 499
+
+// taskAPIError 将任务执行过程中的错误（插件报错、超时、取消、格式纠正失败）转换为 API 错误
+func taskAPIError(err error) *apiError {
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case *ExtensionError:
+		return extensionAPIError(e)
+	}
+
+	switch err {
+	case ErrTaskTimeout:
+		return &apiError{Status: http.StatusGatewayTimeout, Type: "timeout_error", Code: "timeout", Message: "timed out waiting for the extension to reply"}
+	case ErrTaskCancelled:
+		return &apiError{Status: statusClientClosedRequest, Type: "cancelled_error", Code: "cancelled", Message: err.Error()}
+	case ErrNoClient:
+		return queueAPIError(err)
+	case ErrMessageTooLarge:
+		return errMessageTooLarge()
+	default:
+		return &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()}
+	}
+}
+
+// extensionErrors 插件 EVENT_ERROR 错误码对应的 HTTP 状态码与 OpenAI error.type
+// 未列出的错误码按 502 server_error 处理
+var extensionErrors = map[string]struct {
+	Status int
+	Type   string
+}{
+	"input_not_found":          {http.StatusBadGateway, "server_error"},
+	"send_button_missing":      {http.StatusBadGateway, "server_error"},
+	"attachment_upload_failed": {http.StatusBadGateway, "server_error"},
+	"conversation_not_open":    {http.StatusBadGateway, "server_error"},
+	"invalid_payload":          {http.StatusBadGateway, "server_error"},
+	"login_required":           {http.StatusUnauthorized, "authentication_error"},
+	"extension_disconnected":   {http.StatusServiceUnavailable, "service_unavailable"},
+	"extension_unresponsive":   {http.StatusServiceUnavailable, "service_unavailable"},
+	"tab_not_found":            {http.StatusServiceUnavailable, "service_unavailable"},
+	"rate_limited_by_gemini":   {http.StatusTooManyRequests, "rate_limit_error"},
+	"response_timeout":         {http.StatusGatewayTimeout, "timeout_error"},
+	"message_too_large":        {http.StatusRequestEntityTooLarge, "invalid_request_error"},
+	"cancelled":                {statusClientClosedRequest, "cancelled_error"},
+}
+
+// extensionAPIError 按插件上报的错误码转换为 API 错误，error.code 保留原错误码
+func extensionAPIError(e *ExtensionError) *apiError {
+	code := e.Code
+	if code == "" {
+		code = "extension_error"
+	}
+	if m, ok := extensionErrors[code]; ok {
+		return &apiError{Status: m.Status, Type: m.Type, Code: code, Message: e.Message, RetryAfter: e.RetryAfter}
+	}
+	return &apiError{Status: http.StatusBadGateway, Type: "server_error", Code: code, Message: e.Message, RetryAfter: e.RetryAfter}
+}
+
+// errorFinishReason 任务失败时流式响应 finish chunk 的 finish_reason
+func errorFinishReason(err error) string {
+	if e, ok := err.(*ExtensionError); ok {
+		switch e.Code {
+		case "response_timeout":
+			return "timeout"
+		case "cancelled":
+			return "cancelled"
+		}
+	}
+	switch err {
+	case ErrTaskTimeout:
+		return "timeout"
+	case ErrTaskCancelled:
+		return "cancelled"
+	default:
+		return "error"
+	}
+}
+
+// queueAPIError 将排队/获取 worker 失败转换为 API 错误
+func queueAPIError(err error) *apiError {
+	switch err {
+	case ErrNoClient:
+		return &apiError{Status: http.StatusServiceUnavailable, Type: "service_unavailable", Code: "extension_not_connected", Message: "extension not connected"}
+	case ErrNoIdleWorker:
+		return &apiError{Status: http.StatusTooManyRequests, Type: "rate_limit_error", Code: "workers_busy", Message: "all extension workers are busy, please try again later"}
+	case ErrQueueFull:
+		return &apiError{Status: http.StatusTooManyRequests, Type: "rate_limit_error", Code: "queue_full", Message: "request queue is full, please try again later"}
+	case ErrQueueTimeout:
+		return &apiError{Status: http.StatusServiceUnavailable, Type: "service_unavailable", Code: "queue_timeout", Message: err.Error()}
+	case ErrTaskCancelled:
+		return taskAPIError(err)
+	default:
+		return &apiError{Status: http.StatusServiceUnavailable, Type: "service_unavailable", Message: err.Error()}
+	}
+}
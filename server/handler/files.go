@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// 文件用途
+const (
+	filePurposeBatch       = "batch"
+	filePurposeBatchOutput = "batch_output"
+)
+
+// fileObject 构建 OpenAI 格式的文件对象
+func fileObject(f *model.File) gin.H {
+	return gin.H{
+		"id":         f.ID,
+		"object":     "file",
+		"bytes":      f.Bytes,
+		"created_at": f.CreatedAt.Unix(),
+		"filename":   f.Filename,
+		"purpose":    f.Purpose,
+	}
+}
+
+// UploadFile 处理 POST /v1/files（multipart/form-data），目前只接受 purpose=batch 的 JSONL 文件
+func (h *BatchHandler) UploadFile(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	if purpose := c.PostForm("purpose"); purpose != filePurposeBatch {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "purpose", Message: fmt.Sprintf("unsupported purpose %q, only \"batch\" is supported", purpose)})
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "file", Message: "missing file"})
+		return
+	}
+	if maxBytes := int64(h.cfg.MaxFileSize) << 20; header.Size > maxBytes {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "file_too_large", Param: "file", Message: fmt.Sprintf("file exceeds the maximum size of %dMB", h.cfg.MaxFileSize)})
+		return
+	}
+
+	if err := os.MkdirAll(h.cfg.Dir, 0o755); err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		return
+	}
+	file := &model.File{
+		ID:       fmt.Sprintf("file-%s", uuid.New().String()),
+		Filename: filepath.Base(header.Filename),
+		Purpose:  filePurposeBatch,
+		Bytes:    header.Size,
+	}
+	file.Path = filepath.Join(h.cfg.Dir, file.ID+".jsonl")
+	if err := c.SaveUploadedFile(header, file.Path); err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to save file: %v", err)})
+		return
+	}
+	if err := h.DB.Create(file).Error; err != nil {
+		os.Remove(file.Path)
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to save file: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, fileObject(file))
+}
+
+// ListFiles 处理 GET /v1/files，支持 purpose 过滤
+func (h *BatchHandler) ListFiles(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	query := h.DB.Order("created_at DESC")
+	if purpose := c.Query("purpose"); purpose != "" {
+		query = query.Where("purpose = ?", purpose)
+	}
+	var files []model.File
+	if err := query.Find(&files).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		return
+	}
+
+	data := make([]gin.H, 0, len(files))
+	for i := range files {
+		data = append(data, fileObject(&files[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data, "has_more": false})
+}
+
+// GetFile 处理 GET /v1/files/:id
+func (h *BatchHandler) GetFile(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	if file, ok := h.findFile(c); ok {
+		c.JSON(http.StatusOK, fileObject(file))
+	}
+}
+
+// GetFileContent 处理 GET /v1/files/:id/content，返回文件原始内容
+func (h *BatchHandler) GetFileContent(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	file, ok := h.findFile(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.File(file.Path)
+}
+
+// DeleteFile 处理 DELETE /v1/files/:id，删除记录与磁盘文件
+func (h *BatchHandler) DeleteFile(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	file, ok := h.findFile(c)
+	if !ok {
+		return
+	}
+	if err := h.DB.Delete(file).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		return
+	}
+	os.Remove(file.Path)
+	c.JSON(http.StatusOK, gin.H{"id": file.ID, "object": "file", "deleted": true})
+}
+
+// findFile 按路径参数加载文件记录，不存在时写入 404
+func (h *BatchHandler) findFile(c *gin.Context) (*model.File, bool) {
+	var file model.File
+	if err := h.DB.First(&file, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeOpenAIError(c, &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "file_not_found", Message: fmt.Sprintf("file %s not found", c.Param("id"))})
+		} else {
+			writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		}
+		return nil, false
+	}
+	return &file, true
+}
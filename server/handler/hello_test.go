@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func sendHello(t *testing.T, conn *websocket.Conn, hello HelloPayload) {
+	t.Helper()
+	payload, _ := json.Marshal(hello)
+	if err := conn.WriteJSON(WSMessage{Type: "EVENT_HELLO", Payload: payload}); err != nil {
+		t.Fatalf("send hello: %v", err)
+	}
+}
+
+func TestHelloCapabilities(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	r.GET("/admin/workers/:id", NewAdminHandler(hub, nil, "").GetWorker)
+
+	conn := simulateExtension(t, server, donePayloadWithText("Hi there"))
+	defer conn.Close()
+	sendHello(t, conn, HelloPayload{Version: "0.2.0", Browser: "Chrome/126.0", Account: "someone@gmail.com", Capabilities: []string{CapCancel, CapModelSelection}})
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/workers/"+hub.Workers()[0].ID, nil)
+	r.ServeHTTP(w, req)
+	var info WorkerInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info.Version != "0.2.0" || info.Browser != "Chrome/126.0" || info.Account != "someone@gmail.com" || strings.Join(info.Capabilities, ",") != "cancel,model_selection" {
+		t.Errorf("unexpected worker info: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/workers/worker-unknown", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"worker_not_found"`) {
+		t.Errorf("expected 404 worker_not_found, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 插件未上报 attachments，带图片的请求直接被拒绝
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"`+testPNGDataURL+`"}}]}]}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unsupported_by_extension") || !strings.Contains(w.Body.String(), CapAttachments) {
+		t.Errorf("expected 400 unsupported_by_extension, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 插件具备所需能力的请求正常下发
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}]}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Hi there") {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHelloMinVersion(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.MinExtensionVersion = "0.2.0"
+
+	// 未完成 hello 的连接不接收任务，即使上报 idle
+	conn := dialWS(t, server)
+	defer conn.Close()
+	payload, _ := json.Marshal(map[string]string{"status": "idle"})
+	conn.WriteJSON(WSMessage{Type: "EVENT_STATUS", Payload: payload})
+	time.Sleep(100 * time.Millisecond)
+	if hub.IsExtensionReady() {
+		t.Fatal("worker should not be ready before hello")
+	}
+
+	sendHello(t, conn, HelloPayload{Version: "0.10.0", Capabilities: []string{CapCancel}})
+	time.Sleep(100 * time.Millisecond)
+	if !hub.IsExtensionReady() {
+		t.Fatal("worker should be ready after a valid hello")
+	}
+
+	// 版本过低的插件被关闭码 4001 断开
+	old := dialWS(t, server)
+	defer old.Close()
+	sendHello(t, old, HelloPayload{Version: "0.1.9"})
+	old.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := old.ReadMessage()
+	if !websocket.IsCloseError(err, closeVersionRejected) {
+		t.Fatalf("expected close code %d, got %v", closeVersionRejected, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(hub.Workers()); n != 1 {
+		t.Errorf("expected the outdated worker to be removed, got %d workers", n)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"0.1.0", "0.1.0", 0},
+		{"0.2", "0.1.9", 1},
+		{"v1.0.0", "1.0", 0},
+		{"0.9.0", "0.10.0", -1},
+		{"", "0.1.0", -1},
+	}
+	for _, tc := range cases {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
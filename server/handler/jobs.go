@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// jobCallbackTimeout 单次回调请求的超时时间
+const jobCallbackTimeout = 10 * time.Second
+
+// jobCallbackBackoff 回调首次重试间隔，之后每次翻倍（测试中可调小）
+var jobCallbackBackoff = 2 * time.Second
+
+// newCallbackClient 创建投递回调的客户端，与下载 image_url 相同的地址过滤与重定向策略
+// 配置 allow_private_callbacks 时允许访问非公网地址
+func newCallbackClient(cfg config.JobsConfig) *http.Client {
+	allowed := isPublicAddr
+	if cfg.AllowPrivateCallbacks {
+		allowed = func(netip.Addr) bool { return true }
+	}
+	return newFilteredHTTPClient(jobCallbackTimeout, allowed)
+}
+
+// JobRequest POST /v1/jobs 请求体：chat completion 请求加可选的回调地址
+type JobRequest struct {
+	ChatRequest
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// jobProgress 未结束任务的排队位置、已收到的部分回复与取消句柄
+type jobProgress struct {
+	cancel context.CancelCauseFunc // 创建任务时即可用，排队中或执行中均可取消
+
+	mu       sync.Mutex
+	position int
+	text     strings.Builder
+}
+
+func (p *jobProgress) setPosition(position int) {
+	p.mu.Lock()
+	p.position = position
+	p.mu.Unlock()
+}
+
+func (p *jobProgress) append(delta string) {
+	p.mu.Lock()
+	p.text.WriteString(delta)
+	p.mu.Unlock()
+}
+
+func (p *jobProgress) snapshot() (int, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position, p.text.String()
+}
+
+// CreateJob 处理 POST /v1/jobs，校验请求后立即返回 202 与任务 ID，在后台执行 chat completion
+func (h *ChatHandler) CreateJob(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	var req JobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_json", Message: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if req.CallbackURL != "" {
+		u, err := url.Parse(req.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_callback_url", Param: "callback_url", Message: "callback_url must be an absolute http(s) URL"})
+			return
+		}
+		// IP 字面量在创建时直接检查，域名在投递时解析后检查
+		if addr, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); err == nil && !h.jobs.AllowPrivateCallbacks && !isPublicAddr(addr) {
+			writeOpenAIError(c, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_callback_url", Param: "callback_url", Message: "callback_url must point to a public address"})
+			return
+		}
+	}
+
+	// 异步任务只返回完整结果
+	chatReq := &req.ChatRequest
+	chatReq.Stream = false
+	modelCfg, apiErr := h.validateRequest(chatReq)
+	if apiErr != nil {
+		writeOpenAIError(c, apiErr)
+		return
+	}
+
+	raw, _ := json.Marshal(req)
+	job := &model.Job{
+		ID:          fmt.Sprintf("job-%s", uuid.New().String()),
+		TaskID:      newTaskID(),
+		Model:       modelCfg.ID,
+		Status:      model.JobQueued,
+		Request:     string(raw),
+		CallbackURL: req.CallbackURL,
+	}
+	if job.CallbackURL != "" {
+		job.CallbackStatus = model.CallbackPending
+	}
+	if err := h.DB.Create(job).Error; err != nil {
+		writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: fmt.Sprintf("failed to create job: %v", err)})
+		return
+	}
+
+	// 返回前登记取消句柄，任务尚未开始排队时也可立即取消
+	ctx, cancel := context.WithCancelCause(context.Background())
+	progress := &jobProgress{cancel: cancel}
+	h.progress.Store(job.ID, progress)
+	resp := h.jobObject(job)
+	go h.runJob(ctx, job, chatReq, resolveChatKey(c, chatReq), progress)
+
+	log.Printf("[Jobs] job %s created (task %s, model %s)", job.ID, job.TaskID, job.Model)
+	c.JSON(http.StatusAccepted, resp)
+}
+
+// GetJob 处理 GET /v1/jobs/:id，返回任务状态；执行中附带部分回复，结束后附带结果或错误
+func (h *ChatHandler) GetJob(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	job, ok := h.findJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, h.jobObject(job))
+}
+
+// CancelJob 处理 POST /v1/jobs/:id/cancel，取消排队中或执行中的任务
+func (h *ChatHandler) CancelJob(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	job, ok := h.findJob(c)
+	if !ok {
+		return
+	}
+	v, ok := h.progress.Load(job.ID)
+	if !ok {
+		writeOpenAIError(c, &apiError{Status: http.StatusConflict, Type: "invalid_request_error", Code: "job_not_cancellable", Message: fmt.Sprintf("job %s is %s and can no longer be cancelled", job.ID, job.Status)})
+		return
+	}
+	v.(*jobProgress).cancel(ErrTaskCancelled)
+	c.JSON(http.StatusOK, gin.H{"id": job.ID, "object": "chat.completion.job.cancelled", "cancelled": true})
+}
+
+// findJob 按路径参数加载任务，不存在时写入 404
+func (h *ChatHandler) findJob(c *gin.Context) (*model.Job, bool) {
+	var job model.Job
+	if err := h.DB.First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeOpenAIError(c, &apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "job_not_found", Message: fmt.Sprintf("job %s not found", c.Param("id"))})
+		} else {
+			writeOpenAIError(c, &apiError{Status: http.StatusInternalServerError, Type: "server_error", Message: err.Error()})
+		}
+		return nil, false
+	}
+	return &job, true
+}
+
+// jobObject 构建任务的 API 表示
+func (h *ChatHandler) jobObject(job *model.Job) gin.H {
+	obj := gin.H{
+		"id":         job.ID,
+		"object":     "chat.completion.job",
+		"status":     job.Status,
+		"model":      job.Model,
+		"created_at": job.CreatedAt.Unix(),
+	}
+	if job.CompletedAt != nil {
+		obj["completed_at"] = job.CompletedAt.Unix()
+	}
+	if job.Result != "" {
+		obj["result"] = json.RawMessage(job.Result)
+	}
+	if job.Error != "" {
+		var body struct {
+			Error json.RawMessage `json:"error"`
+		}
+		json.Unmarshal([]byte(job.Error), &body)
+		obj["error"] = body.Error
+	}
+	if job.CallbackURL != "" {
+		obj["callback_url"] = job.CallbackURL
+		obj["callback_status"] = job.CallbackStatus
+		obj["callback_attempts"] = job.CallbackAttempts
+	}
+	if v, ok := h.progress.Load(job.ID); ok {
+		position, text := v.(*jobProgress).snapshot()
+		if job.Status == model.JobQueued && position > 0 {
+			obj["queue_position"] = position
+		}
+		obj["partial_text"] = text
+	}
+	return obj
+}
+
+// runJob 在后台执行任务：排队、等待完整回复（超时为 jobs.timeout），保存结果后投递回调
+// ctx 由 CancelJob 取消
+func (h *ChatHandler) runJob(ctx context.Context, job *model.Job, req *ChatRequest, chatKey string, progress *jobProgress) {
+	defer progress.cancel(nil)
+	if context.Cause(ctx) == ErrTaskCancelled {
+		h.completeJob(job, nil, ErrTaskCancelled)
+		return
+	}
+
+	task, apiErr := h.startTask(ctx, req, taskOptions{
+		ChatKey:    chatKey,
+		TaskID:     job.TaskID,
+		Timeout:    time.Duration(h.jobs.Timeout) * time.Second,
+		OnPosition: progress.setPosition,
+	})
+	if apiErr != nil {
+		if context.Cause(ctx) == ErrTaskCancelled {
+			h.completeJob(job, nil, ErrTaskCancelled)
+			return
+		}
+		h.completeJob(job, nil, apiErr)
+		return
+	}
+
+	job.Status = model.JobRunning
+	h.DB.Model(job).Update("status", job.Status)
+	result, err := h.complete(task, req, progress.append)
+	h.finishTask(task, err)
+	if err != nil {
+		h.completeJob(job, nil, err)
+		return
+	}
+	resp := completionResponse(task, result)
+	h.completeJob(job, &resp, nil)
+}
+
+// completeJob 保存任务结果或错误，需要时投递回调
+func (h *ChatHandler) completeJob(job *model.Job, resp *ChatResponse, err error) {
+	now := time.Now()
+	job.CompletedAt = &now
+	if err != nil {
+		apiErr := taskAPIError(err)
+		body, _ := json.Marshal(apiErr.openAIBody())
+		job.Error = string(body)
+		job.Status = model.JobFailed
+		if errorFinishReason(err) == "cancelled" {
+			job.Status = model.JobCancelled
+		}
+		log.Printf("[Jobs] job %s %s: %v", job.ID, job.Status, err)
+	} else {
+		data, _ := json.Marshal(resp)
+		job.Result = string(data)
+		job.Model = resp.Model
+		job.Status = model.JobSucceeded
+		log.Printf("[Jobs] job %s succeeded", job.ID)
+	}
+	if dbErr := h.DB.Model(job).Select("status", "model", "result", "error", "completed_at").Updates(job).Error; dbErr != nil {
+		log.Printf("[Jobs] failed to save job %s: %v", job.ID, dbErr)
+	}
+	h.progress.Delete(job.ID)
+
+	if job.CallbackURL != "" {
+		h.deliverCallback(job)
+	}
+}
+
+// ResumeJobCallbacks 重新投递已结束但回调尚未送达的任务（如重启前中断的任务）
+func (h *ChatHandler) ResumeJobCallbacks() {
+	var jobs []model.Job
+	h.DB.Where("callback_status = ? AND status IN ?", model.CallbackPending,
+		[]string{model.JobSucceeded, model.JobFailed, model.JobCancelled}).Find(&jobs)
+	for i := range jobs {
+		go h.deliverCallback(&jobs[i])
+	}
+}
+
+// deliverCallback 将任务对象 POST 到回调地址，非 2xx 时按指数退避重试
+// 配置了 callback_secret 时附带签名头：X-Webhook-Signature: sha256=HMAC-SHA256(secret, timestamp + "." + body)
+func (h *ChatHandler) deliverCallback(job *model.Job) {
+	body, _ := json.Marshal(h.jobObject(job))
+	backoff := jobCallbackBackoff
+
+	for attempt := 0; attempt <= h.jobs.CallbackRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		job.CallbackAttempts++
+		err := h.postCallback(job, body)
+		if err == nil {
+			job.CallbackStatus = model.CallbackDelivered
+			break
+		}
+		log.Printf("[Jobs] callback for job %s failed (attempt %d/%d): %v", job.ID, attempt+1, h.jobs.CallbackRetries+1, err)
+		job.CallbackStatus = model.CallbackFailed
+	}
+
+	h.DB.Model(job).Select("callback_status", "callback_attempts").Updates(job)
+}
+
+func (h *ChatHandler) postCallback(job *model.Job, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", job.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if h.jobs.CallbackSecret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+signCallback(h.jobs.CallbackSecret, timestamp, body))
+	}
+
+	resp, err := h.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signCallback 计算回调签名（十六进制 HMAC-SHA256）
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
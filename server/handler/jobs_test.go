@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+type jobResponse struct {
+	ID               string          `json:"id"`
+	Status           string          `json:"status"`
+	PartialText      string          `json:"partial_text"`
+	Result           *ChatResponse   `json:"result"`
+	Error            json.RawMessage `json:"error"`
+	CallbackStatus   string          `json:"callback_status"`
+	CallbackAttempts int             `json:"callback_attempts"`
+}
+
+func getJob(t *testing.T, r http.Handler, id string) jobResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/jobs/"+id, nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET job: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var job jobResponse
+	json.Unmarshal(w.Body.Bytes(), &job)
+	return job
+}
+
+// waitForJob 轮询直到任务满足条件
+func waitForJob(t *testing.T, r http.Handler, id string, cond func(jobResponse) bool) jobResponse {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		job := getJob(t, r, id)
+		if cond(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job, last state: %+v", job)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func createJob(t *testing.T, r http.Handler, body string) jobResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/jobs", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var job jobResponse
+	json.Unmarshal(w.Body.Bytes(), &job)
+	return job
+}
+
+func TestJobCallback(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+	defer func(d time.Duration) { jobCallbackBackoff = d }(jobCallbackBackoff)
+	jobCallbackBackoff = 10 * time.Millisecond
+
+	// 回调服务第一次返回 500，验证重试
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 4)
+	calls := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		deliveries <- delivery{req.Header, body}
+	}))
+	defer callback.Close()
+
+	conn := simulateExtension(t, server, donePayloadWithText("A long answer"))
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	created := createJob(t, r, `{"model":"gemini","messages":[{"role":"user","content":"Think hard"}],"callback_url":"`+callback.URL+`"}`)
+	if created.Status != "queued" || created.CallbackStatus != "pending" {
+		t.Errorf("unexpected created job: %+v", created)
+	}
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(3 * time.Second):
+		t.Fatal("callback was not delivered")
+	}
+
+	// 签名为 HMAC-SHA256(secret, timestamp + "." + body)
+	expected := "sha256=" + signCallback("test-secret", d.header.Get("X-Webhook-Timestamp"), d.body)
+	if d.header.Get("X-Webhook-Signature") != expected || d.header.Get("X-Job-ID") != created.ID {
+		t.Errorf("unexpected callback headers: %v", d.header)
+	}
+	var payload jobResponse
+	json.Unmarshal(d.body, &payload)
+	if payload.Status != "succeeded" || payload.Result == nil || payload.Result.Choices[0].Message.Content != "A long answer" {
+		t.Errorf("unexpected callback body: %s", d.body)
+	}
+
+	job := waitForJob(t, r, created.ID, func(j jobResponse) bool { return j.CallbackStatus == "delivered" })
+	if job.CallbackAttempts != 2 || job.Result.Object != "chat.completion" {
+		t.Errorf("unexpected job after delivery: %+v", job)
+	}
+}
+
+func TestJobCallbackRejectsPrivateAddresses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := model.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(&config.WebSocketConfig{PingInterval: 60, PongTimeout: 10, Token: testWSToken})
+	h := NewChatHandler(hub, NewTaskManager(), db, config.Default())
+	r := gin.New()
+	r.POST("/v1/jobs", h.CreateJob)
+
+	// 默认不允许回调到回环、内网与 metadata 地址
+	for _, u := range []string{"http://127.0.0.1:6543/admin/tasks", "http://169.254.169.254/latest/meta-data/", "http://[::1]/hook", "http://10.0.0.1/hook"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/jobs", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}],"callback_url":"`+u+`"}`))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"invalid_callback_url"`) {
+			t.Errorf("%s: expected 400 invalid_callback_url, got %d: %s", u, w.Code, w.Body.String())
+		}
+	}
+
+	// 域名解析到内网地址时在投递时拒绝
+	reached := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	defer internal.Close()
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+	resp, err := h.callbackClient.Post("http://localhost:"+port+"/hook", "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, errForbiddenAddress) || reached {
+		t.Errorf("expected the callback to a private address to be blocked, got %v", err)
+	}
+	if err := h.callbackClient.CheckRedirect(httptest.NewRequest("POST", "http://192.168.1.1/", nil), []*http.Request{{}}); err == nil {
+		t.Error("redirect to a private address should be rejected")
+	}
+
+	// 开启 allow_private_callbacks 后允许本机 webhook
+	resp, err = newCallbackClient(config.JobsConfig{AllowPrivateCallbacks: true}).Post(internal.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("expected the local callback to be allowed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestJobPollAndCancel(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	processing, _ := json.Marshal(map[string]string{"text": "Once upon a time", "status": "PROCESSING"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: processing}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	created := createJob(t, r, `{"model":"gemini","messages":[{"role":"user","content":"Tell me a story"}]}`)
+	// 插件等待回复的上限随指令下发，长回答不会被插件默认的 120 秒截断
+	var sent SendMessagePayload
+	json.Unmarshal(waitForCommand(t, received, "CMD_SEND_MESSAGE").Payload, &sent)
+	if sent.Timeout != 1800 {
+		t.Errorf("expected the jobs timeout in the command, got %d", sent.Timeout)
+	}
+	job := waitForJob(t, r, created.ID, func(j jobResponse) bool { return j.PartialText != "" })
+	if job.Status != "running" || job.PartialText != "Once upon a time" {
+		t.Errorf("unexpected running job: %+v", job)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/jobs/"+created.ID+"/cancel", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	waitForCommand(t, received, "CMD_CANCEL")
+
+	job = waitForJob(t, r, created.ID, func(j jobResponse) bool { return j.Status != "running" })
+	if job.Status != "cancelled" || !bytes.Contains(job.Error, []byte(`"code":"cancelled"`)) {
+		t.Errorf("unexpected cancelled job: %+v %s", job, job.Error)
+	}
+
+	// 已结束的任务不能再取消
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for finished job, got %d", w.Code)
+	}
+}
+
+func TestJobCancelWhileQueued(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, received := recordExtension(t, server, nil)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := hub.AcquireWorker("occupied"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 创建后立即取消：任务仍在排队，不应返回 409
+	created := createJob(t, r, `{"model":"gemini","messages":[{"role":"user","content":"Hi"}]}`)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/jobs/"+created.ID+"/cancel", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	job := waitForJob(t, r, created.ID, func(j jobResponse) bool { return j.Status != "queued" })
+	if job.Status != "cancelled" || !bytes.Contains(job.Error, []byte(`"code":"cancelled"`)) {
+		t.Errorf("unexpected cancelled job: %+v %s", job, job.Error)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("cancelled job must not be dispatched, got %s", msg.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestJobValidation(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	cases := map[string]int{
+		`{"model":"gemini","messages":[{"role":"user","content":"Hi"}],"callback_url":"ftp://example.com"}`: http.StatusBadRequest,
+		`{"model":"unknown","messages":[{"role":"user","content":"Hi"}]}`:                                   http.StatusNotFound,
+		`{"model":"gemini","messages":[]}`:                                                                  http.StatusBadRequest,
+	}
+	for body, status := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/jobs", bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/jobs/job-missing", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown job, got %d", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// limitSignatureMaxLength 超过此长度的回复视为正常回答，不做特征文本匹配，避免误判
+const limitSignatureMaxLength = 1000
+
+// limitNoticeSlack 特征文本不在开头时，回复最多比特征文本长出的字符数，超过则视为引用了提示的正常回答
+const limitNoticeSlack = 40
+
+// extensionError 将插件的 EVENT_ERROR 转换为 ExtensionError，额度用尽时补充默认的重试间隔
+func (h *ChatHandler) extensionError(payload *ReplyPayload) *ExtensionError {
+	e := &ExtensionError{Code: payload.Code, Message: payload.Error, RetryAfter: payload.RetryAfter}
+	if e.Code == "rate_limited_by_gemini" && e.RetryAfter == 0 {
+		e.RetryAfter = h.limits.RetryAfter
+	}
+	return e
+}
+
+// detectLimit 检查 DONE 回复是否为 Gemini 额度用尽或登录失效的提示，不是则返回 nil
+func (h *ChatHandler) detectLimit(text string) *ExtensionError {
+	if utf8.RuneCountInString(text) > limitSignatureMaxLength {
+		return nil
+	}
+	notice := strings.TrimSpace(text)
+	if matchSignature(notice, h.limits.UsageLimitSignatures) {
+		return &ExtensionError{
+			Code:       "rate_limited_by_gemini",
+			Message:    fmt.Sprintf("Gemini usage limit reached: %s", firstLine(notice)),
+			RetryAfter: h.limits.RetryAfter,
+		}
+	}
+	if matchSignature(notice, h.limits.LoginSignatures) {
+		return &ExtensionError{
+			Code:    "login_required",
+			Message: fmt.Sprintf("Gemini login required: %s", firstLine(notice)),
+		}
+	}
+	return nil
+}
+
+// updateWorkerHealth 任务因额度用尽或登录失效失败时标记 worker 降级，成功完成时恢复
+func (h *ChatHandler) updateWorkerHealth(worker *Client, err error) {
+	if err == nil {
+		h.Hub.SetWorkerDegraded(worker.ID, "")
+		return
+	}
+	if e, ok := err.(*ExtensionError); ok && (e.Code == "rate_limited_by_gemini" || e.Code == "login_required") {
+		h.Hub.SetWorkerDegraded(worker.ID, e.Code)
+	}
+}
+
+// matchSignature 不区分大小写地判断 text 本身是否为提示：以特征文本开头，
+// 或包含特征文本且长度与其相近；引用特征文本的正常回答不算
+func matchSignature(text string, signatures []string) bool {
+	lower := strings.ToLower(text)
+	for _, sig := range signatures {
+		sig = strings.ToLower(sig)
+		if sig == "" {
+			continue
+		}
+		if strings.HasPrefix(lower, sig) {
+			return true
+		}
+		if strings.Contains(lower, sig) && utf8.RuneCountInString(lower) <= utf8.RuneCountInString(sig)+limitNoticeSlack {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLine(text string) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return strings.TrimSpace(text[:i])
+	}
+	return text
+}
+
+// quotaKey 额度按 Gemini 网页端模式区分，未配置模式时按模型 ID
+func quotaKey(spec *config.ModelConfig) string {
+	if spec.Mode != "" {
+		return spec.Mode
+	}
+	return spec.ID
+}
+
+// nextFallback 取出降级链中下一个可用的模型：跳过未知模型以及在该 worker 上额度已用尽的模型
+func (h *ChatHandler) nextFallback(task *chatTask) *config.ModelConfig {
+	for len(task.Fallbacks) > 0 {
+		id := task.Fallbacks[0]
+		task.Fallbacks = task.Fallbacks[1:]
+		spec, ok := h.resolveModel(id)
+		if !ok {
+			log.Printf("[Chat] unknown fallback model %s for task %s", id, task.ID)
+			continue
+		}
+		if h.Hub.QuotaExhausted(task.Worker.ID, quotaKey(spec)) {
+			continue
+		}
+		return spec
+	}
+	return nil
+}
+
+// skipExhaustedModels 下发前若该 worker 上当前模型的额度已用尽，直接切换到降级链中的模型
+func (h *ChatHandler) skipExhaustedModels(task *chatTask) {
+	for h.Hub.QuotaExhausted(task.Worker.ID, quotaKey(task.Spec)) {
+		next := h.nextFallback(task)
+		if next == nil {
+			return
+		}
+		log.Printf("[Chat] task %s: %s quota exhausted on %s, using %s", task.ID, task.Spec.ID, task.Worker.ID, next.ID)
+		task.Spec = next
+		task.Model = next.ID
+	}
+}
+
+// fallback 额度用尽时记录到 worker，并以降级链中的下一个模型重新下发同一任务
+// 返回 false 表示不是额度用尽或没有可用的降级模型
+func (h *ChatHandler) fallback(task *chatTask, err *ExtensionError) bool {
+	if err.Code != "rate_limited_by_gemini" {
+		return false
+	}
+	retryAfter := time.Duration(err.RetryAfter) * time.Second
+	if retryAfter <= 0 {
+		retryAfter = time.Hour
+	}
+	h.Hub.MarkQuotaExhausted(task.Worker.ID, quotaKey(task.Spec), time.Now().Add(retryAfter))
+
+	next := h.nextFallback(task)
+	if next == nil {
+		return false
+	}
+	log.Printf("[Chat] task %s: %s quota exhausted, falling back to %s", task.ID, task.Spec.ID, next.ID)
+	task.Spec = next
+	task.Model = next.ID
+	task.Payload.Mode = next.Mode
+	task.processing = false
+	h.setTaskState(task, model.TaskDispatched, map[string]interface{}{"model": next.ID})
+
+	data, _ := json.Marshal(task.Payload)
+	if sendErr := h.Hub.SendCommand(task.Worker, &WSMessage{
+		ID:      task.ID,
+		Type:    "CMD_SEND_MESSAGE",
+		Payload: data,
+	}); sendErr != nil {
+		log.Printf("[Chat] fallback dispatch for task %s failed: %v", task.ID, sendErr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+func TestChatUsageLimitDegradesWorker(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, _ := sequenceExtension(t, server, [][]WSMessage{
+		donePayloadWithText("You've reached your limit for 2.5 Pro until tomorrow.\nUpgrade to get higher limits."),
+		donePayloadWithText("Hello!"),
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hello"}]}`))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 额度用尽提示 → 429 + Retry-After，worker 标记为降级
+	w := send()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("expected 429 with Retry-After, got %d (%q): %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	var errResp struct {
+		Error struct {
+			Type       string `json:"type"`
+			Code       string `json:"code"`
+			RetryAfter int    `json:"retry_after"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error.Type != "rate_limit_error" || errResp.Error.Code != "rate_limited_by_gemini" || errResp.Error.RetryAfter != 3600 {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+	if workers := hub.Workers(); workers[0].Degraded != "rate_limited_by_gemini" || workers[0].DegradedAt == nil {
+		t.Errorf("expected worker degraded, got %+v", workers[0])
+	}
+
+	// 成功的请求清除降级状态
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if workers := hub.Workers(); workers[0].Degraded != "" {
+		t.Errorf("expected worker recovered, got %+v", workers[0])
+	}
+}
+
+func TestDegradedEventAndWorkerPreference(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+
+	conn1 := dialWS(t, server)
+	defer conn1.Close()
+	time.Sleep(50 * time.Millisecond)
+	conn2 := dialWS(t, server)
+	defer conn2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// 先连接的 worker 最久未使用，上报登录失效后应优先分配另一个 worker
+	degraded, _ := json.Marshal(map[string]interface{}{
+		"type":    "EVENT_DEGRADED",
+		"payload": map[string]string{"reason": "login_required"},
+	})
+	conn1.WriteMessage(websocket.TextMessage, degraded)
+	time.Sleep(100 * time.Millisecond)
+
+	workers := hub.Workers()
+	if workers[0].Degraded != "login_required" || workers[1].Degraded != "" {
+		t.Fatalf("unexpected degraded state: %+v", workers)
+	}
+	w, err := hub.AcquireWorker("task-1")
+	if err != nil || w.ID != workers[1].ID {
+		t.Errorf("expected healthy worker %s, got %v (%v)", workers[1].ID, w, err)
+	}
+
+	// 降级的 worker 仍可在其他 worker 忙碌时被分配
+	if w, err := hub.AcquireWorker("task-2"); err != nil || w.ID != workers[0].ID {
+		t.Errorf("expected degraded worker as fallback, got %v (%v)", w, err)
+	}
+}
+
+func TestChatQuotaFallback(t *testing.T) {
+	server, r, db, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	flashDone, _ := json.Marshal(map[string]string{"text": "Hello from Flash", "status": "DONE", "model": "2.5 Flash"})
+	conn, received := sequenceExtension(t, server, [][]WSMessage{
+		donePayloadWithText("You've reached your limit for 2.5 Pro until 4:00 PM."),
+		{{Type: "EVENT_REPLY", Payload: flashDone}},
+		{{Type: "EVENT_REPLY", Payload: flashDone}},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	send := func() ChatResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini-pro","messages":[{"role":"user","content":"Hello"}]}`))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp ChatResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// 额度用尽后以降级模型重新下发同一任务
+	resp := send()
+	if resp.Model != "gemini-flash" || resp.Choices[0].Message.Content != "Hello from Flash" {
+		t.Errorf("expected fallback answer from gemini-flash, got %s: %q", resp.Model, resp.Choices[0].Message.Content)
+	}
+	first, second := <-received, <-received
+	var p1, p2 SendMessagePayload
+	json.Unmarshal(first.Payload, &p1)
+	json.Unmarshal(second.Payload, &p2)
+	if first.ID != second.ID || p1.Mode != "pro" || p2.Mode != "flash" {
+		t.Errorf("expected re-dispatch of %s with flash mode, got %s %s/%s", first.ID, second.ID, p1.Mode, p2.Mode)
+	}
+
+	var reply model.Message
+	db.Where("role = ?", "model").First(&reply)
+	if reply.Model != "gemini-flash" {
+		t.Errorf("expected model message to record gemini-flash, got %q", reply.Model)
+	}
+
+	// 额度恢复前，同一 worker 上的后续请求直接使用降级模型
+	if resp := send(); resp.Model != "gemini-flash" {
+		t.Errorf("expected gemini-flash, got %s", resp.Model)
+	}
+	var p3 SendMessagePayload
+	json.Unmarshal((<-received).Payload, &p3)
+	if p3.Mode != "flash" {
+		t.Errorf("expected exhausted pro mode to be skipped, got %s", p3.Mode)
+	}
+}
+
+func TestLimitSignatureInAnswer(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	// 解释该提示含义的正常回答：流式片段与最终回复都原样返回，不触发降级
+	answer := `When Gemini shows "You've reached your limit", it means the daily quota for that model is used up. ` +
+		`Wait until the reset time, or switch to another model. Similarly, "Sign in to continue" means your session expired.`
+	processing, _ := json.Marshal(map[string]string{"text": "Sign in to continue", "status": "PROCESSING"})
+	done, _ := json.Marshal(map[string]string{"text": answer, "status": "DONE"})
+	conn := simulateExtension(t, server, []WSMessage{
+		{Type: "EVENT_REPLY", Payload: processing},
+		{Type: "EVENT_REPLY", Payload: done},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"What does this error mean?"}]}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an answer quoting a signature, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != answer || resp.Model != "gemini" {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if workers := hub.Workers(); workers[0].Degraded != "" {
+		t.Errorf("expected the worker to stay healthy, got %+v", workers[0])
+	}
+
+	h := &ChatHandler{limits: config.Default().Limits}
+	for text, limited := range map[string]bool{
+		"You've reached your limit for 2.5 Pro until tomorrow.\nUpgrade to get higher limits.": true,
+		"  Sign in to continue  ": true,
+		"您已达到使用上限，请稍后再试":          true,
+		`The text "sign in to continue" appears when your session has expired on the website.`: false,
+		answer: false,
+	} {
+		if got := h.detectLimit(text) != nil; got != limited {
+			t.Errorf("detectLimit(%q) = %v, want %v", text, got, limited)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+)
+
+// defaultModelName 模型目录为空时使用的模型名
+const defaultModelName = "gemini"
+
+// ModelObject OpenAI 格式的模型对象
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelList OpenAI 格式的模型列表
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+// modeKeywords Gemini 网页端模式对应的模型选择器文案关键字（小写）
+var modeKeywords = map[string][]string{
+	"pro":      {"pro"},
+	"flash":    {"flash", "fast", "快速"},
+	"thinking": {"thinking", "思考"},
+}
+
+// modeMatches 判断网页端模型选择器的文案是否属于指定模式
+func modeMatches(label, mode string) bool {
+	label = strings.ToLower(label)
+	keywords, ok := modeKeywords[mode]
+	if !ok {
+		keywords = []string{strings.ToLower(mode)}
+	}
+	for _, kw := range keywords {
+		if strings.Contains(label, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveModel 在模型目录中查找请求的模型（先经过别名表映射），空字符串表示默认模型
+// 模型目录为空时不做校验，接受任意模型名
+func (h *ChatHandler) resolveModel(id string) (*config.ModelConfig, bool) {
+	if target, ok := h.aliases[id]; ok {
+		id = target
+	}
+	if len(h.models) == 0 {
+		if id == "" {
+			id = defaultModelName
+		}
+		return &config.ModelConfig{ID: id}, true
+	}
+	if id == "" {
+		return &h.models[0], true
+	}
+	for i := range h.models {
+		if h.models[i].ID == id {
+			return &h.models[i], true
+		}
+	}
+	return nil, false
+}
+
+// actualModel 根据插件上报的网页端模型文案确定实际使用的模型 ID
+// 请求的模型与实际模式一致时保持不变，否则取目录中第一个匹配的模型，都不匹配时直接使用上报的文案
+func (h *ChatHandler) actualModel(requested *config.ModelConfig, reported string) string {
+	if reported == "" || requested.Mode == "" || modeMatches(reported, requested.Mode) {
+		return requested.ID
+	}
+	for i := range h.models {
+		if h.models[i].Mode != "" && modeMatches(reported, h.models[i].Mode) {
+			return h.models[i].ID
+		}
+	}
+	return reported
+}
+
+func (h *ChatHandler) modelObject(m *config.ModelConfig) ModelObject {
+	ownedBy := m.OwnedBy
+	if ownedBy == "" {
+		ownedBy = "google"
+	}
+	return ModelObject{
+		ID:      m.ID,
+		Object:  "model",
+		Created: h.createdAt.Unix(),
+		OwnedBy: ownedBy,
+	}
+}
+
+// ListModels 处理 GET /v1/models
+func (h *ChatHandler) ListModels(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	list := ModelList{Object: "list", Data: []ModelObject{}}
+	for i := range h.models {
+		list.Data = append(list.Data, h.modelObject(&h.models[i]))
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetModel 处理 GET /v1/models/:id
+func (h *ChatHandler) GetModel(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	id := c.Param("id")
+	for i := range h.models {
+		if h.models[i].ID == id {
+			c.JSON(http.StatusOK, h.modelObject(&h.models[i]))
+			return
+		}
+	}
+	writeOpenAIError(c, errModelNotFound(id))
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ollama 兼容请求/响应结构
+
+type OllamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64 编码的图片
+}
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"` // Ollama 默认流式
+}
+
+type OllamaGenerateRequest struct {
+	Model  string   `json:"model"`
+	Prompt string   `json:"prompt"`
+	System string   `json:"system,omitempty"`
+	Images []string `json:"images,omitempty"` // base64 编码的图片
+	Stream *bool    `json:"stream,omitempty"` // Ollama 默认流式
+}
+
+type OllamaResponse struct {
+	Model         string         `json:"model"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Message       *OllamaMessage `json:"message,omitempty"`
+	Response      *string        `json:"response,omitempty"` // /api/generate 使用
+	Done          bool           `json:"done"`
+	DoneReason    string         `json:"done_reason,omitempty"`
+	TotalDuration int64          `json:"total_duration,omitempty"`
+}
+
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// ollamaModelName 去掉 Ollama 风格的 ":latest" 标签
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// ollamaImageParts 将 base64 图片转换为 content part，作为附件上传
+func ollamaImageParts(images []string) []ContentPart {
+	var parts []ContentPart
+	for _, img := range images {
+		parts = append(parts, ContentPart{Type: "file", File: &ContentFile{FileData: img}})
+	}
+	return parts
+}
+
+func ollamaStream(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// writeOllamaError 以 Ollama 格式写入错误：{"error": "..."}
+func writeOllamaError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": message})
+}
+
+// ListOllamaTags 处理 GET /api/tags
+func (h *ChatHandler) ListOllamaTags(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	models := []OllamaModel{}
+	for _, m := range h.models {
+		models = append(models, OllamaModel{
+			Name:       m.ID + ":latest",
+			Model:      m.ID + ":latest",
+			ModifiedAt: h.createdAt,
+			Details: OllamaModelDetails{
+				Format:   "web",
+				Family:   "gemini",
+				Families: []string{"gemini"},
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// HandleOllamaChat 处理 POST /api/chat
+func (h *ChatHandler) HandleOllamaChat(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	var oreq OllamaChatRequest
+	if err := c.ShouldBindJSON(&oreq); err != nil {
+		writeOllamaError(c, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	req := &ChatRequest{Model: ollamaModelName(oreq.Model), Stream: ollamaStream(oreq.Stream)}
+	for _, msg := range oreq.Messages {
+		req.Messages = append(req.Messages, ChatMessage{Role: msg.Role, Content: msg.Content, Parts: ollamaImageParts(msg.Images)})
+	}
+	h.handleOllama(c, req, false)
+}
+
+// HandleOllamaGenerate 处理 POST /api/generate
+func (h *ChatHandler) HandleOllamaGenerate(c *gin.Context) {
+	if !checkAPIKey(c, h.apiKey) {
+		return
+	}
+
+	var oreq OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&oreq); err != nil {
+		writeOllamaError(c, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	req := &ChatRequest{Model: ollamaModelName(oreq.Model), Stream: ollamaStream(oreq.Stream)}
+	if oreq.System != "" {
+		req.Messages = append(req.Messages, ChatMessage{Role: "system", Content: oreq.System})
+	}
+	req.Messages = append(req.Messages, ChatMessage{Role: "user", Content: oreq.Prompt, Parts: ollamaImageParts(oreq.Images)})
+	h.handleOllama(c, req, true)
+}
+
+// handleOllama /api/chat 与 /api/generate 的公共流程，generate 为 true 时使用 response 字段返回文本
+func (h *ChatHandler) handleOllama(c *gin.Context, req *ChatRequest, generate bool) {
+	task, apiErr := h.prepareTask(c, req, nil)
+	if apiErr != nil {
+		if c.Request.Context().Err() == nil {
+			writeOllamaError(c, apiErr.Status, apiErr.Message)
+		}
+		return
+	}
+
+	var taskErr error
+	defer func() { h.finishTask(task, taskErr) }()
+
+	start := time.Now()
+	chunk := func(text string, done bool) OllamaResponse {
+		resp := OllamaResponse{Model: task.Model, CreatedAt: time.Now().UTC(), Done: done}
+		if generate {
+			resp.Response = &text
+		} else {
+			resp.Message = &OllamaMessage{Role: "assistant", Content: text}
+		}
+		if done {
+			resp.DoneReason = "stop"
+			resp.TotalDuration = time.Since(start).Nanoseconds()
+		}
+		return resp
+	}
+
+	if !req.Stream {
+		payload, err := h.collectReply(task, nil)
+		if err != nil {
+			taskErr = err
+			log.Printf("[Ollama] task failed: %v", err)
+			writeOllamaError(c, taskAPIError(err).Status, err.Error())
+			return
+		}
+		h.saveReply(task, payload)
+		c.JSON(http.StatusOK, chunk(payload.Text, true))
+		return
+	}
+
+	// 流式：每行一个 JSON 对象（NDJSON），增量计算与 SSE 相同
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	payload, taskErr := h.collectReply(task, func(delta string) {
+		writeNDJSON(c, chunk(delta, false))
+	})
+	if taskErr != nil {
+		log.Printf("[Ollama] stream error for task %s: %v", task.ID, taskErr)
+		writeNDJSON(c, gin.H{"error": taskErr.Error()})
+		return
+	}
+	h.saveReply(task, payload)
+	writeNDJSON(c, chunk("", true))
+}
+
+func writeNDJSON(c *gin.Context, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	c.Writer.Write(jsonData)
+	c.Writer.Write([]byte("\n"))
+	c.Writer.Flush()
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOllamaChatStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	p1, _ := json.Marshal(map[string]string{"text": "Hello", "status": "PROCESSING"})
+	p2, _ := json.Marshal(map[string]string{"text": "Hello there", "status": "PROCESSING"})
+	p3, _ := json.Marshal(map[string]string{"text": "Hello there", "status": "DONE"})
+	conn := simulateExtension(t, server, []WSMessage{
+		{Type: "EVENT_REPLY", Payload: p1},
+		{Type: "EVENT_REPLY", Payload: p2},
+		{Type: "EVENT_REPLY", Payload: p3},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// stream 未指定时默认流式
+	reqBody := `{"model":"gemini:latest","messages":[{"role":"user","content":"Hello"}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected ndjson content type, got %s", ct)
+	}
+
+	var lines []OllamaResponse
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var line OllamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid ndjson line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %s", len(lines), w.Body.String())
+	}
+	var text strings.Builder
+	for _, line := range lines[:2] {
+		if line.Done || line.Message == nil {
+			t.Fatalf("unexpected intermediate line: %+v", line)
+		}
+		text.WriteString(line.Message.Content)
+	}
+	if text.String() != "Hello there" {
+		t.Errorf("expected assembled text 'Hello there', got %q", text.String())
+	}
+	last := lines[2]
+	if !last.Done || last.DoneReason != "stop" || last.Model != "gemini" {
+		t.Errorf("unexpected final line: %+v", last)
+	}
+}
+
+func TestOllamaGenerateNonStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	donePayload, _ := json.Marshal(map[string]string{"text": "Hi!", "status": "DONE"})
+	conn, received := recordExtension(t, server, []WSMessage{{Type: "EVENT_REPLY", Payload: donePayload}})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini-flash","prompt":"Hello","system":"Be brief","stream":false}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/generate", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp OllamaResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Response == nil || *resp.Response != "Hi!" || !resp.Done {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if resp.Model != "gemini-flash" {
+		t.Errorf("expected model gemini-flash, got %s", resp.Model)
+	}
+
+	select {
+	case msg := <-received:
+		var p SendMessagePayload
+		json.Unmarshal(msg.Payload, &p)
+		if !strings.Contains(p.Prompt, `role="system"`) || p.Mode != "flash" {
+			t.Errorf("unexpected payload: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no command received")
+	}
+}
+
+func TestOllamaTags(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/tags", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Models []OllamaModel `json:"models"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Models) != 4 || resp.Models[0].Name != "gemini:latest" {
+		t.Errorf("unexpected models: %+v", resp.Models)
+	}
+
+	// 未知模型 → 404，Ollama 错误格式
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/chat", bytes.NewBufferString(`{"model":"llama3","messages":[{"role":"user","content":"Hi"}]}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown model, got %d", w.Code)
+	}
+	var errResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if _, ok := errResp["error"].(string); !ok {
+		t.Errorf("expected string error, got %s", w.Body.String())
+	}
+}
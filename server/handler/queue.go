@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
+)
+
+var (
+	ErrQueueFull    = &HubError{"request queue is full"}
+	ErrQueueTimeout = &HubError{"timed out waiting for an idle extension worker"}
+)
+
+// queuePollInterval 排队位置上报间隔，同时作为漏掉空闲信号时的兜底重试间隔
+const queuePollInterval = 1 * time.Second
+
+// queueWaiter 一个排队中的请求
+type queueWaiter struct {
+	taskID string
+	caps   []string     // 任务要求 worker 具备的能力
+	ready  chan *Client // 分配到 worker 后写入，缓冲 1
+}
+
+// RequestQueue 在 worker 池前的 FIFO 请求队列
+// 所有 worker 忙碌时请求排队等待，而不是立即返回 429
+type RequestQueue struct {
+	hub     *Hub
+	maxSize int
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	waiters []*queueWaiter
+}
+
+// NewRequestQueue 创建请求队列并启动分配协程
+func NewRequestQueue(hub *Hub, cfg *config.QueueConfig) *RequestQueue {
+	q := &RequestQueue{
+		hub:     hub,
+		maxSize: cfg.MaxSize,
+		maxWait: time.Duration(cfg.MaxWait) * time.Second,
+	}
+	go q.run()
+	return q
+}
+
+// Len 返回当前排队中的请求数
+func (q *RequestQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters)
+}
+
+// Acquire 为任务获取一个空闲 worker，必要时排队等待
+// 插件尚未连接时同样排队，连接后由空闲信号唤醒；等待超时仍无连接则返回 ErrNoClient
+// caps 为任务要求 worker 具备的能力，onPosition 在排队位置（从 1 开始）变化时回调，可为 nil
+func (q *RequestQueue) Acquire(ctx context.Context, taskID string, caps []string, onPosition func(position int)) (*Client, error) {
+	q.mu.Lock()
+	// 队列为空时直接尝试获取，避免插队
+	if len(q.waiters) == 0 {
+		client, err := q.hub.AcquireWorker(taskID, caps...)
+		if err != ErrNoIdleWorker && err != ErrNoClient {
+			q.mu.Unlock()
+			return client, err
+		}
+		if q.maxSize == 0 {
+			q.mu.Unlock()
+			return nil, err
+		}
+	}
+	if len(q.waiters) >= q.maxSize {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &queueWaiter{taskID: taskID, caps: caps, ready: make(chan *Client, 1)}
+	q.waiters = append(q.waiters, w)
+	position := len(q.waiters)
+	q.mu.Unlock()
+
+	log.Printf("[Queue] task %s queued at position %d", taskID, position)
+	if onPosition != nil {
+		onPosition(position)
+	}
+
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case client := <-w.ready:
+			return client, nil
+
+		case <-ticker.C:
+			q.tryAssign()
+			if pos := q.position(w); pos > 0 && pos != position {
+				position = pos
+				if onPosition != nil {
+					onPosition(position)
+				}
+			}
+
+		case <-timer.C:
+			if client := q.cancel(w); client != nil {
+				return client, nil
+			}
+			log.Printf("[Queue] task %s timed out in queue", taskID)
+			if q.hub.GetClient() == nil {
+				return nil, ErrNoClient
+			}
+			return nil, ErrQueueTimeout
+
+		case <-ctx.Done():
+			if client := q.cancel(w); client != nil {
+				// 已分配到 worker 但调用方已离开，立即归还
+				q.hub.ReleaseWorker(client, false)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// position 返回 waiter 当前位置（从 1 开始），不在队列中返回 0
+func (q *RequestQueue) position(w *queueWaiter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.waiters {
+		if item == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// cancel 将 waiter 移出队列；若在移出前已分配到 worker 则返回该 worker
+func (q *RequestQueue) cancel(w *queueWaiter) *Client {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.waiters {
+		if item == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return nil
+		}
+	}
+	select {
+	case client := <-w.ready:
+		return client
+	default:
+		return nil
+	}
+}
+
+// tryAssign 按 FIFO 顺序为队首请求分配空闲 worker
+func (q *RequestQueue) tryAssign() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.waiters) > 0 {
+		head := q.waiters[0]
+		client, err := q.hub.AcquireWorker(head.taskID, head.caps...)
+		if err != nil {
+			return
+		}
+		q.waiters = q.waiters[1:]
+		head.ready <- client
+		log.Printf("[Queue] task %s assigned to %s", head.taskID, client.ID)
+	}
+}
+
+// run 监听 Hub 的空闲信号并分配 worker
+func (q *RequestQueue) run() {
+	for range q.hub.IdleSignal() {
+		q.tryAssign()
+	}
+}
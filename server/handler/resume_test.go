@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntil 读取 WS 消息直到收到指定类型
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) WSMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestResumeAfterReconnect(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	hub.cfg.ResumeTimeout = 5
+
+	conn := dialWS(t, server)
+	time.Sleep(100 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Write an essay"}]}`))
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	taskID := readUntil(t, conn, "CMD_SEND_MESSAGE").ID
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// 插件重连并上报进行中的任务
+	conn = dialWS(t, server)
+	defer conn.Close()
+	payload, _ := json.Marshal(ResumePayload{Tasks: []string{taskID, "chatcmpl-unknown"}})
+	conn.WriteJSON(WSMessage{Type: "EVENT_RESUME", Payload: payload})
+
+	var result ResumeResultPayload
+	json.Unmarshal(readUntil(t, conn, "CMD_RESUME_RESULT").Payload, &result)
+	if strings.Join(result.Resumed, ",") != taskID || strings.Join(result.Rejected, ",") != "chatcmpl-unknown" {
+		t.Fatalf("unexpected resume result: %+v", result)
+	}
+	if workers := hub.Workers(); workers[0].Status != "busy" || workers[0].TaskID != taskID {
+		t.Errorf("expected the reconnected worker to own the task, got %+v", workers[0])
+	}
+
+	reply, _ := json.Marshal(map[string]string{"text": "Recovered answer", "status": "DONE"})
+	conn.WriteJSON(WSMessage{ReplyTo: taskID, Type: "EVENT_REPLY", Payload: reply})
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request did not complete after resume")
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Recovered answer") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if workers := hub.Workers(); workers[0].TaskID != "" {
+		t.Errorf("expected the reconnected worker to be released, got task %s", workers[0].TaskID)
+	}
+}
+
+func TestResumeTimeout(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	hub.cfg.ResumeTimeout = 1
+
+	conn := dialWS(t, server)
+	time.Sleep(100 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}]}`))
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	taskID := readUntil(t, conn, "CMD_SEND_MESSAGE").ID
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request did not fail after the resume timeout")
+	}
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "extension_disconnected") {
+		t.Fatalf("expected 503 extension_disconnected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 超时后重连上报的任务被拒绝
+	conn = dialWS(t, server)
+	defer conn.Close()
+	payload, _ := json.Marshal(ResumePayload{Tasks: []string{taskID}})
+	conn.WriteJSON(WSMessage{Type: "EVENT_RESUME", Payload: payload})
+	var result ResumeResultPayload
+	json.Unmarshal(readUntil(t, conn, "CMD_RESUME_RESULT").Payload, &result)
+	if len(result.Resumed) != 0 || len(result.Rejected) != 1 {
+		t.Errorf("expected the expired task to be rejected, got %+v", result)
+	}
+}
+
+func TestResumeWithQueuedRequest(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	hub.cfg.ResumeTimeout = 5
+
+	conn := dialWS(t, server)
+	time.Sleep(100 * time.Millisecond)
+
+	post := func(prompt string) (*httptest.ResponseRecorder, chan struct{}) {
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"`+prompt+`"}]}`))
+			r.ServeHTTP(w, req)
+			close(done)
+		}()
+		return w, done
+	}
+
+	w1, done1 := post("Write an essay")
+	taskID := readUntil(t, conn, "CMD_SEND_MESSAGE").ID
+	// 第二个请求在 worker 忙碌时排队
+	w2, done2 := post("Second question")
+	time.Sleep(100 * time.Millisecond)
+
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// 重连后 EVENT_RESUME 稍晚到达，期间排队的请求不能占用该 worker
+	conn = dialWS(t, server)
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	payload, _ := json.Marshal(ResumePayload{Tasks: []string{taskID}})
+	conn.WriteJSON(WSMessage{Type: "EVENT_RESUME", Payload: payload})
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "CMD_RESUME_RESULT" {
+		t.Fatalf("expected CMD_RESUME_RESULT before any new task, got %+v (%v)", msg, err)
+	}
+	var result ResumeResultPayload
+	json.Unmarshal(msg.Payload, &result)
+	if strings.Join(result.Resumed, ",") != taskID {
+		t.Fatalf("expected %s to be resumed, got %+v", taskID, result)
+	}
+
+	reply, _ := json.Marshal(map[string]string{"text": "Recovered answer", "status": "DONE"})
+	conn.WriteJSON(WSMessage{ReplyTo: taskID, Type: "EVENT_REPLY", Payload: reply})
+	<-done1
+	if w1.Code != http.StatusOK || !strings.Contains(w1.Body.String(), "Recovered answer") {
+		t.Fatalf("unexpected first response %d: %s", w1.Code, w1.Body.String())
+	}
+
+	// 恢复的任务结束、插件空闲后，排队的请求才被分配
+	conn.WriteJSON(WSMessage{Type: "EVENT_STATUS", Payload: json.RawMessage(`{"status":"idle"}`)})
+	second := readUntil(t, conn, "CMD_SEND_MESSAGE")
+	reply, _ = json.Marshal(map[string]string{"text": "Second answer", "status": "DONE"})
+	conn.WriteJSON(WSMessage{ReplyTo: second.ID, Type: "EVENT_REPLY", Payload: reply})
+	select {
+	case <-done2:
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued request did not complete")
+	}
+	if w2.Code != http.StatusOK || !strings.Contains(w2.Body.String(), "Second answer") {
+		t.Fatalf("unexpected second response %d: %s", w2.Code, w2.Body.String())
+	}
+}
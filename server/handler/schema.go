@@ -0,0 +1,409 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaErrors 单次校验最多报告的错误数，避免纠正 prompt 过长
+const maxSchemaErrors = 10
+
+// maxSchemaDepth schema 与 value 的最大嵌套深度（含 $ref 展开），防止恶意 schema 耗尽栈
+const maxSchemaDepth = 64
+
+// schemaValidator JSON Schema 常用子集的校验器：
+// type / enum / const / properties / required / additionalProperties / items / anyOf / oneOf / allOf / $ref
+// 以及字符串、数值、数组的长度与范围约束
+type schemaValidator struct {
+	root   interface{}
+	errors []string
+	depth  int
+	// refs 在当前 value 上正在展开的 $ref，再次遇到说明引用成环
+	refs map[string]bool
+}
+
+// parseSchema 解析 JSON Schema，要求为 JSON 对象，且所有 $ref 可解析、不成环
+func parseSchema(raw json.RawMessage) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+	c := &refChecker{v: &schemaValidator{root: schema}, state: map[string]int{}}
+	if err := c.walk(schema, 0); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// refChecker 检查 schema 中的 $ref：不可解析，或不消耗 value 就回到自身（如 {"$ref":"#"}）均视为错误
+// 经由 properties / items 的递归引用（如树结构）是合法的
+type refChecker struct {
+	v *schemaValidator
+	// state $ref 的检查状态：1 正在展开，2 已确认不成环
+	state map[string]int
+}
+
+// walk 遍历 schema 树中的子 schema，对每个节点检查其直接引用链
+// 只进入承载 schema 的关键字，const / enum / default / examples 下的数据即使含有 "$ref" 也不当作引用
+func (c *refChecker) walk(node interface{}, depth int) error {
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("schema is nested too deeply")
+	}
+	s, ok := node.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if err := c.follow(s, 0); err != nil {
+		return err
+	}
+	for _, key := range []string{"properties", "$defs", "definitions"} {
+		children, _ := s[key].(map[string]interface{})
+		for _, child := range children {
+			if err := c.walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties"} {
+		if err := c.walk(s[key], depth+1); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		children, _ := s[key].([]interface{})
+		for _, child := range children {
+			if err := c.walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// follow 沿 $ref / allOf / anyOf / oneOf（校验同一 value 的关键字）展开，检测引用环
+func (c *refChecker) follow(node interface{}, depth int) error {
+	s, ok := node.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("$ref chain is nested too deeply")
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		switch c.state[ref] {
+		case 1:
+			return fmt.Errorf("cyclic $ref %q", ref)
+		case 0:
+			target, err := c.v.resolveRef(ref)
+			if err != nil {
+				return err
+			}
+			c.state[ref] = 1
+			if err := c.follow(target, depth+1); err != nil {
+				return err
+			}
+			c.state[ref] = 2
+		}
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, _ := s[key].([]interface{})
+		for _, sub := range subs {
+			if err := c.follow(sub, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateSchema 按 schema 校验 value，返回所有不符合之处（为空表示通过）
+func validateSchema(schema map[string]interface{}, value interface{}) []string {
+	v := &schemaValidator{root: schema}
+	v.validate(schema, value, "$")
+	return v.errors
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if len(v.errors) < maxSchemaErrors {
+		v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *schemaValidator) validate(schema interface{}, value interface{}, path string) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		// true / false schema
+		if b, isBool := schema.(bool); isBool && !b {
+			v.fail(path, "value is not allowed")
+		}
+		return
+	}
+	if v.depth >= maxSchemaDepth {
+		v.fail(path, "schema is nested too deeply")
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+
+	if ref, ok := s["$ref"].(string); ok {
+		if v.refs[ref] {
+			v.fail(path, "cyclic $ref %q", ref)
+			return
+		}
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		if v.refs == nil {
+			v.refs = map[string]bool{}
+		}
+		v.refs[ref] = true
+		v.validate(target, value, path)
+		delete(v.refs, ref)
+		return
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		v.fail(path, "expected %s, got %s", typeNames(t), jsonTypeOf(value))
+		return
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "value must be one of %s", mustJSON(enum))
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		v.fail(path, "value must be %s", mustJSON(c))
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(s, val, path)
+	case []interface{}:
+		v.validateArray(s, val, path)
+	case string:
+		v.validateString(s, val, path)
+	case float64:
+		v.validateNumber(s, val, path)
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok && v.countMatches(anyOf, value) == 0 {
+		v.fail(path, "value does not match any of the allowed schemas")
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok && v.countMatches(oneOf, value) != 1 {
+		v.fail(path, "value must match exactly one of the allowed schemas")
+	}
+}
+
+// descend 校验子 value，子 value 上的 $ref 展开重新计算
+func (v *schemaValidator) descend(schema interface{}, value interface{}, path string) {
+	refs := v.refs
+	v.refs = nil
+	v.validate(schema, value, path)
+	v.refs = refs
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, obj map[string]interface{}, path string) {
+	props, _ := s["properties"].(map[string]interface{})
+
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, exists := obj[name]; !exists {
+					v.fail(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	// 按 key 排序，保证错误顺序稳定
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	additional, hasAdditional := s["additionalProperties"]
+	for _, k := range keys {
+		childPath := path + "." + k
+		if sub, ok := props[k]; ok {
+			v.descend(sub, obj[k], childPath)
+		} else if hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(path, "unexpected property %q", k)
+			} else {
+				v.descend(additional, obj[k], childPath)
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(s map[string]interface{}, arr []interface{}, path string) {
+	if min, ok := numberKeyword(s, "minItems"); ok && float64(len(arr)) < min {
+		v.fail(path, "expected at least %v items, got %d", min, len(arr))
+	}
+	if max, ok := numberKeyword(s, "maxItems"); ok && float64(len(arr)) > max {
+		v.fail(path, "expected at most %v items, got %d", max, len(arr))
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range arr {
+			v.descend(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+func (v *schemaValidator) validateString(s map[string]interface{}, str string, path string) {
+	length := float64(utf8.RuneCountInString(str))
+	if min, ok := numberKeyword(s, "minLength"); ok && length < min {
+		v.fail(path, "expected at least %v characters", min)
+	}
+	if max, ok := numberKeyword(s, "maxLength"); ok && length > max {
+		v.fail(path, "expected at most %v characters", max)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "invalid pattern %q in schema", pattern)
+		} else if !re.MatchString(str) {
+			v.fail(path, "value does not match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(s map[string]interface{}, n float64, path string) {
+	if min, ok := numberKeyword(s, "minimum"); ok && n < min {
+		v.fail(path, "expected >= %v, got %v", min, n)
+	}
+	if max, ok := numberKeyword(s, "maximum"); ok && n > max {
+		v.fail(path, "expected <= %v, got %v", max, n)
+	}
+	if min, ok := numberKeyword(s, "exclusiveMinimum"); ok && n <= min {
+		v.fail(path, "expected > %v, got %v", min, n)
+	}
+	if max, ok := numberKeyword(s, "exclusiveMaximum"); ok && n >= max {
+		v.fail(path, "expected < %v, got %v", max, n)
+	}
+}
+
+// countMatches 返回 value 通过校验的子 schema 数量
+func (v *schemaValidator) countMatches(schemas []interface{}, value interface{}) int {
+	count := 0
+	for _, sub := range schemas {
+		probe := &schemaValidator{root: v.root, depth: v.depth, refs: v.refs}
+		probe.validate(sub, value, "$")
+		if len(probe.errors) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// resolveRef 解析文档内引用，如 #/$defs/Item 或 #/definitions/Item
+func (v *schemaValidator) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	node := v.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = m[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+func numberKeyword(s map[string]interface{}, key string) (float64, bool) {
+	n, ok := s[key].(float64)
+	return n, ok
+}
+
+// matchesType type 可以是单个类型名或类型名数组
+func matchesType(t interface{}, value interface{}) bool {
+	switch tt := t.(type) {
+	case string:
+		return matchesTypeName(tt, value)
+	case []interface{}:
+		for _, name := range tt {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	actual := jsonTypeOf(value)
+	switch name {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		return actual == "number"
+	default:
+		return actual == name
+	}
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ResponseFormat OpenAI response_format：text / json_object / json_schema
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// jsonMode 请求要求 JSON 输出
+func jsonMode(req *ChatRequest) bool {
+	return req.ResponseFormat != nil && (req.ResponseFormat.Type == "json_object" || req.ResponseFormat.Type == "json_schema")
+}
+
+// parseResponseFormat 校验 response_format，json_schema 时解析出 schema
+func parseResponseFormat(f *ResponseFormat) (map[string]interface{}, *apiError) {
+	if f == nil {
+		return nil, nil
+	}
+	invalid := func(msg string) *apiError {
+		return &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "response_format", Message: msg}
+	}
+
+	switch f.Type {
+	case "", "text", "json_object":
+		return nil, nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return nil, invalid("response_format.json_schema.schema is required")
+		}
+		schema, err := parseSchema(f.JSONSchema.Schema)
+		if err != nil {
+			return nil, invalid(fmt.Sprintf("invalid response_format.json_schema.schema: %v", err))
+		}
+		return schema, nil
+	default:
+		return nil, invalid(fmt.Sprintf("invalid response_format type %q", f.Type))
+	}
+}
+
+// jsonInstructions 生成追加到 prompt 末尾的 JSON 输出要求
+func jsonInstructions(req *ChatRequest) string {
+	if !jsonMode(req) {
+		return ""
+	}
+	if req.ResponseFormat.Type == "json_object" {
+		return "Respond with ONLY a valid JSON object. Do not wrap it in a code block and do not add any other text."
+	}
+
+	f := req.ResponseFormat.JSONSchema
+	var b strings.Builder
+	b.WriteString("Respond with ONLY a valid JSON value that conforms to the following JSON Schema. ")
+	b.WriteString("Do not wrap it in a code block and do not add any other text.\n\n")
+	fmt.Fprintf(&b, "<json_schema name=%q>\n", f.Name)
+	if f.Description != "" {
+		b.WriteString(f.Description + "\n")
+	}
+	b.Write(f.Schema)
+	b.WriteString("\n</json_schema>")
+	return b.String()
+}
+
+// extractJSON 从 Markdown 回复中取出 JSON：去掉代码块包裹，或截取第一个 {/[ 到最后一个 }/]
+func extractJSON(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if m := fencedBlockPattern.FindStringSubmatch(trimmed); m != nil {
+		return strings.TrimSpace(m[2])
+	}
+	start := strings.IndexAny(trimmed, "{[")
+	end := strings.LastIndexAny(trimmed, "}]")
+	if start >= 0 && end > start {
+		return trimmed[start : end+1]
+	}
+	return trimmed
+}
+
+// parseJSONReply 解析并校验 JSON 回复，返回去掉包裹后的 JSON 文本
+func parseJSONReply(text string, req *ChatRequest) (string, []string) {
+	data := extractJSON(text)
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return "", []string{fmt.Sprintf("reply is not valid JSON: %v", err)}
+	}
+
+	if req.ResponseFormat.Type == "json_object" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", []string{fmt.Sprintf("expected a JSON object, got %s", jsonTypeOf(value))}
+		}
+		return data, nil
+	}
+	if errs := validateSchema(req.schema, value); len(errs) > 0 {
+		return "", errs
+	}
+	return data, nil
+}
+
+// jsonCorrection 生成 JSON 校验失败时的纠正说明
+func jsonCorrection(errs []string) string {
+	return "Your previous reply did not satisfy the required JSON format:\n- " + strings.Join(errs, "\n- ") +
+		"\n\nReply again with ONLY the corrected JSON, without a code block or any other text."
+}
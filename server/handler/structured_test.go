@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"$defs": {"tag": {"type": "string", "enum": ["a", "b"]}}
+}`
+
+func TestValidateSchema(t *testing.T) {
+	schema, err := parseSchema(json.RawMessage(personSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		value  string
+		errors []string
+	}{
+		{`{"name":"Ann","age":30,"tags":["a"]}`, nil},
+		{`{"name":"Ann"}`, []string{`$: missing required property "age"`}},
+		{`{"name":"","age":1.5}`, []string{"$.age: expected integer, got number", "$.name: expected at least 1 characters"}},
+		{`{"name":"Ann","age":1,"extra":true}`, []string{`$: unexpected property "extra"`}},
+		{`{"name":"Ann","age":1,"tags":["a","c","b"]}`, []string{"$.tags: expected at most 2 items, got 3", `$.tags[1]: value must be one of ["a","b"]`}},
+		{`["Ann"]`, []string{"$: expected object, got array"}},
+	}
+	for _, tc := range cases {
+		var value interface{}
+		json.Unmarshal([]byte(tc.value), &value)
+		errs := validateSchema(schema, value)
+		if strings.Join(errs, "|") != strings.Join(tc.errors, "|") {
+			t.Errorf("%s: expected %v, got %v", tc.value, tc.errors, errs)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	cases := map[string]string{
+		"```json\n{\"a\":1}\n```":                 `{"a":1}`,
+		"Here you go:\n```\n[1,2]\n```\nDone":     `[1,2]`,
+		"Result: {\"a\":{\"b\":2}} hope it helps": `{"a":{"b":2}}`,
+		`{"a":1}`: `{"a":1}`,
+	}
+	for in, want := range cases {
+		if got := extractJSON(in); got != want {
+			t.Errorf("extractJSON(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func jsonSchemaRequest(stream bool) string {
+	s := "false"
+	if stream {
+		s = "true"
+	}
+	return `{"model":"gemini","stream":` + s + `,"messages":[{"role":"user","content":"Extract: Ann is 30"}],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"person","schema":` + personSchema + `}}}`
+}
+
+func TestChatJSONSchemaRepair(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, received := sequenceExtension(t, server, [][]WSMessage{
+		donePayloadWithText("```json\n{\"name\": \"Ann\", \"age\": \"30\"}\n```"),
+		donePayloadWithText("```json\n{\"name\": \"Ann\", \"age\": 30}\n```"),
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(jsonSchemaRequest(false)))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if content := resp.Choices[0].Message.Content; content != `{"name": "Ann", "age": 30}` {
+		t.Errorf("expected fence-stripped JSON, got %q", content)
+	}
+
+	// 首次下发包含 schema 说明，重试时附带校验错误
+	first, second := <-received, <-received
+	var p1, p2 SendMessagePayload
+	json.Unmarshal(first.Payload, &p1)
+	json.Unmarshal(second.Payload, &p2)
+	if !strings.Contains(p1.Prompt, `<json_schema name="person">`) {
+		t.Errorf("schema instructions not injected: %s", p1.Prompt)
+	}
+	if !strings.Contains(p2.Prompt, "$.age: expected integer, got string") {
+		t.Errorf("retry prompt missing validation errors: %s", p2.Prompt)
+	}
+	// 一次性对话在新对话中重试，需附上纠正说明所指的上一次回复
+	if !strings.Contains(p2.Prompt, "<previous_reply>\n```json\n{\"name\": \"Ann\", \"age\": \"30\"}\n```\n</previous_reply>") {
+		t.Errorf("retry prompt missing the previous reply: %s", p2.Prompt)
+	}
+}
+
+func TestChatRepairSavesOnlyValidReply(t *testing.T) {
+	server, r, db, _ := setupAttachmentTest(t, 1)
+	defer server.Close()
+
+	invalid, _ := json.Marshal(map[string]string{"text": `{"name": "Ann", "age": "30"}`, "status": "DONE", "conversation_id": "gem-1"})
+	valid, _ := json.Marshal(map[string]string{"text": `{"name": "Ann", "age": 30}`, "status": "DONE", "conversation_id": "gem-1"})
+	conn, received := sequenceExtension(t, server, [][]WSMessage{
+		{{Type: "EVENT_REPLY", Payload: invalid}},
+		{{Type: "EVENT_REPLY", Payload: valid}},
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(jsonSchemaRequest(false)))
+	req.Header.Set(ConversationHeader, "chat-1")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 固定会话在同一 Gemini 对话中纠正，只发送纠正说明
+	<-received
+	var retry SendMessagePayload
+	json.Unmarshal((<-received).Payload, &retry)
+	if retry.ConversationID != "gem-1" || strings.Contains(retry.Prompt, "<previous_reply>") {
+		t.Errorf("unexpected retry command: %+v", retry)
+	}
+
+	// 被纠正的回复不写入会话历史
+	var replies []model.Message
+	db.Where("role = ?", "model").Find(&replies)
+	if len(replies) != 1 || replies[0].Content != `{"name": "Ann", "age": 30}` || replies[0].ConversationID != "chat-1" {
+		t.Errorf("expected only the valid reply to be saved, got %+v", replies)
+	}
+}
+
+func TestChatJSONObjectStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	processing, _ := json.Marshal(map[string]string{"text": "{\"ok\":", "status": "PROCESSING"})
+	replies := append([]WSMessage{{Type: "EVENT_REPLY", Payload: processing}}, donePayloadWithText("```json\n{\"ok\": true}\n```")...)
+	conn := simulateExtension(t, server, replies)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","stream":true,"messages":[{"role":"user","content":"ok?"}],"response_format":{"type":"json_object"}}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	var content strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+			continue
+		}
+		var chunk ChatResponse
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk)
+		content.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if content.String() != `{"ok": true}` {
+		t.Errorf("expected only the stripped JSON to be streamed, got %q", content.String())
+	}
+}
+
+func TestChatJSONSchemaExhausted(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn := simulateExtension(t, server, donePayloadWithText("Ann is 30 years old."))
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(jsonSchemaRequest(false)))
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp struct {
+		Error struct {
+			Code    string   `json:"code"`
+			Details []string `json:"details"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error.Code != "json_validation_error" || len(errResp.Error.Details) == 0 {
+		t.Errorf("unexpected error body: %s", w.Body.String())
+	}
+
+	// 无效的 response_format → 400
+	for _, format := range []string{`{"type":"xml"}`, `{"type":"json_schema","json_schema":{"name":"x"}}`} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}],"response_format":`+format+`}`))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", format, w.Code)
+		}
+	}
+}
+
+func TestSchemaRefCycles(t *testing.T) {
+	// 不消耗 value 就回到自身的引用会无限递归，必须在解析时拒绝
+	for _, schema := range []string{
+		`{"$ref":"#"}`,
+		`{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"allOf":[{"$ref":"#/$defs/a"}]}},"$ref":"#/$defs/a"}`,
+		`{"properties":{"x":{"anyOf":[{"$ref":"#/properties/x"}]}}}`,
+		`{"properties":{"x":{"$ref":"#/$defs/missing"}}}`,
+	} {
+		if _, err := parseSchema(json.RawMessage(schema)); err == nil {
+			t.Errorf("%s: expected an error", schema)
+		}
+	}
+
+	// 经由 properties / items 的递归引用是合法的
+	tree, err := parseSchema(json.RawMessage(`{"$ref":"#/$defs/node","$defs":{"node":{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#/$defs/node"}}}}}}`))
+	if err != nil {
+		t.Fatalf("recursive schema: %v", err)
+	}
+	var value interface{}
+	json.Unmarshal([]byte(`{"children":[{"children":[]},{"children":[1]}]}`), &value)
+	if errs := validateSchema(tree, value); len(errs) != 1 || errs[0] != "$.children[1].children[0]: expected object, got number" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// const / enum / default / examples 中的数据不是 schema，其中的 "$ref" 键不当作引用
+	data, err := parseSchema(json.RawMessage(`{"type":"object","properties":{"link":{"enum":[{"$ref":"#/missing"}],"default":{"$ref":"#"}},` +
+		`"doc":{"const":{"$ref":"#/definitions/x"},"examples":[{"$ref":"#"}]}}}`))
+	if err != nil {
+		t.Fatalf("schema with $ref keys in data: %v", err)
+	}
+	json.Unmarshal([]byte(`{"link":{"$ref":"#/missing"},"doc":{"$ref":"#/definitions/x"}}`), &value)
+	if errs := validateSchema(data, value); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// 在下发给插件之前返回 400
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}],`+
+		`"response_format":{"type":"json_schema","json_schema":{"name":"x","schema":{"$ref":"#"}}}}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "cyclic $ref") {
+		t.Errorf("expected 400 cyclic $ref, got %d: %s", w.Code, w.Body.String())
+	}
+}
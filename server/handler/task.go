@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,40 +13,169 @@ type ReplyPayload struct {
 	Text           string `json:"text"`
 	Status         string `json:"status"` // "PROCESSING" | "DONE"
 	ConversationID string `json:"conversation_id"`
+	Model          string `json:"model,omitempty"` // 网页端实际使用的模型（模型选择器文案）
 	Error          string `json:"error,omitempty"`
+	Code           string `json:"code,omitempty"`        // EVENT_ERROR 的错误码，见 extensionErrors
+	RetryAfter     int    `json:"retry_after,omitempty"` // EVENT_ERROR 建议的重试间隔（秒）
+
+	// WorkerID 状态为 RESUMED 时恢复该任务的 worker
+	WorkerID string `json:"-"`
+}
+
+// SendMessagePayload CMD_SEND_MESSAGE 指令的 payload
+type SendMessagePayload struct {
+	Prompt         string `json:"prompt"`
+	ConversationID string `json:"conversation_id"` // 为空表示新建对话
+	// KeepConversation 为 true 时插件完成后保留对话，供后续轮次继续使用
+	KeepConversation bool `json:"keep_conversation,omitempty"`
+	// Mode 期望的 Gemini 网页端模式（pro/flash/thinking），为空则不切换
+	Mode string `json:"mode,omitempty"`
+	// Attachments 插件需在输入 prompt 前上传到网页的附件
+	Attachments []AttachmentPayload `json:"attachments,omitempty"`
+	// Timeout 插件等待回复的最长时间（秒），与 server 端等待的超时一致，为 0 时插件使用默认的 120 秒
+	Timeout int `json:"timeout,omitempty"`
+}
+
+var (
+	ErrTaskTimeout   = &HubError{"task timeout"}   // 超时未收到插件的 DONE
+	ErrTaskCancelled = &HubError{"task cancelled"} // 客户端断开或被管理端取消
+)
+
+// ExtensionError 插件通过 EVENT_ERROR 上报的任务失败
+type ExtensionError struct {
+	Code       string // 插件上报的错误码，如 input_not_found / login_required
+	Message    string
+	RetryAfter int // 建议的重试间隔（秒），0 表示不提示
 }
 
+func (e *ExtensionError) Error() string { return e.Message }
+
 // TaskManager 管理 API 请求与插件回复之间的映射
 type TaskManager struct {
 	mu    sync.RWMutex
-	tasks map[string]chan *ReplyPayload
+	tasks map[string]*replyQueue
+
+	coalesced atomic.Int64 // 未被取走即被新回复覆盖的 PROCESSING 数
 }
 
 func NewTaskManager() *TaskManager {
 	return &TaskManager{
-		tasks: make(map[string]chan *ReplyPayload),
+		tasks: make(map[string]*replyQueue),
+	}
+}
+
+// replyQueue 单个任务的回复队列，Dispatch 写入时从不阻塞
+// PROCESSING 为累计全文，只保留最新一条：队尾未被取走的 PROCESSING 会被新的 PROCESSING 覆盖
+// DONE / ERROR / RESUMED 只追加、从不丢弃
+type replyQueue struct {
+	out    chan *ReplyPayload
+	mu     sync.Mutex
+	items  []*ReplyPayload
+	signal chan struct{} // 有新回复时发出，缓冲 1
+	done   chan struct{} // 任务移除时关闭
+}
+
+func newReplyQueue() *replyQueue {
+	q := &replyQueue{
+		out:    make(chan *ReplyPayload),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go q.pump()
+	return q
+}
+
+// push 追加一条回复，返回是否覆盖了未被取走的 PROCESSING
+func (q *replyQueue) push(payload *ReplyPayload) bool {
+	q.mu.Lock()
+	coalesced := false
+	if n := len(q.items); n > 0 && payload.Status == "PROCESSING" && q.items[n-1].Status == "PROCESSING" {
+		q.items[n-1] = payload
+		coalesced = true
+	} else {
+		q.items = append(q.items, payload)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return coalesced
+}
+
+// backlog 返回尚未被取走的回复数
+func (q *replyQueue) backlog() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// pump 按顺序将回复交给等待方，任务移除后关闭 out
+func (q *replyQueue) pump() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		var next *ReplyPayload
+		if len(q.items) > 0 {
+			next = q.items[0]
+			q.items = q.items[1:]
+		}
+		q.mu.Unlock()
+
+		if next == nil {
+			select {
+			case <-q.signal:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		select {
+		case q.out <- next:
+		case <-q.done:
+			return
+		}
 	}
 }
 
 // CreateTask 创建一个任务，返回接收回复的 channel
-func (tm *TaskManager) CreateTask(taskID string) chan *ReplyPayload {
-	ch := make(chan *ReplyPayload, 10) // 缓冲区支持多次 PROCESSING
+func (tm *TaskManager) CreateTask(taskID string) <-chan *ReplyPayload {
+	q := newReplyQueue()
 	tm.mu.Lock()
-	tm.tasks[taskID] = ch
+	tm.tasks[taskID] = q
 	tm.mu.Unlock()
-	return ch
+	return q.out
 }
 
-// RemoveTask 清理任务
+// RemoveTask 清理任务，回复 channel 随后关闭
 func (tm *TaskManager) RemoveTask(taskID string) {
 	tm.mu.Lock()
-	if ch, ok := tm.tasks[taskID]; ok {
-		close(ch)
+	if q, ok := tm.tasks[taskID]; ok {
+		close(q.done)
 		delete(tm.tasks, taskID)
 	}
 	tm.mu.Unlock()
 }
 
+// ReplyMetrics 回复分发的积压统计
+type ReplyMetrics struct {
+	Tasks     int   `json:"tasks"`     // 等待回复的任务数
+	Backlog   int   `json:"backlog"`   // 所有任务中尚未被取走的回复数
+	Coalesced int64 `json:"coalesced"` // 累计被合并的 PROCESSING 数
+}
+
+// Metrics 返回回复分发的积压统计
+func (tm *TaskManager) Metrics() ReplyMetrics {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	m := ReplyMetrics{Tasks: len(tm.tasks), Coalesced: tm.coalesced.Load()}
+	for _, q := range tm.tasks {
+		m.Backlog += q.backlog()
+	}
+	return m
+}
+
 // Dispatch 将插件回复分发到对应的任务 channel
 func (tm *TaskManager) Dispatch(msg *WSMessage) {
 	if msg.ReplyTo == "" {
@@ -62,7 +192,14 @@ func (tm *TaskManager) Dispatch(msg *WSMessage) {
 		if payload.Error == "" {
 			payload.Error = "unknown error from extension"
 		}
+		if payload.Code == "" {
+			payload.Code = "extension_error"
+		}
 		payload.Status = "ERROR"
+	} else if msg.Type == "EVENT_RESUMED" {
+		// 插件重连后恢复了该任务，后续回复来自新的 worker
+		payload.Status = "RESUMED"
+		payload.WorkerID = msg.WorkerID
 	} else if msg.Type == "EVENT_REPLY" {
 		if msg.Payload != nil {
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
@@ -75,7 +212,7 @@ func (tm *TaskManager) Dispatch(msg *WSMessage) {
 	}
 
 	tm.mu.RLock()
-	ch, ok := tm.tasks[msg.ReplyTo]
+	q, ok := tm.tasks[msg.ReplyTo]
 	tm.mu.RUnlock()
 
 	if !ok {
@@ -83,10 +220,8 @@ func (tm *TaskManager) Dispatch(msg *WSMessage) {
 		return
 	}
 
-	select {
-	case ch <- &payload:
-	default:
-		log.Printf("[TaskManager] task channel full for %s", msg.ReplyTo)
+	if q.push(&payload) {
+		tm.coalesced.Add(1)
 	}
 }
 
@@ -101,7 +236,7 @@ func (tm *TaskManager) StartDispatcher(hub *Hub) {
 }
 
 // WaitForDone 等待任务完成（DONE 或 ERROR），返回最终的完整文本
-func (tm *TaskManager) WaitForDone(taskID string, ch chan *ReplyPayload, timeout time.Duration) (*ReplyPayload, error) {
+func (tm *TaskManager) WaitForDone(taskID string, ch <-chan *ReplyPayload, timeout time.Duration) (*ReplyPayload, error) {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
@@ -117,7 +252,10 @@ func (tm *TaskManager) WaitForDone(taskID string, ch chan *ReplyPayload, timeout
 			}
 
 			if payload.Status == "ERROR" {
-				return payload, &HubError{payload.Error}
+				return payload, &ExtensionError{Code: payload.Code, Message: payload.Error}
+			}
+			if payload.Status == "RESUMED" {
+				continue
 			}
 
 			lastPayload = payload
@@ -128,7 +266,7 @@ func (tm *TaskManager) WaitForDone(taskID string, ch chan *ReplyPayload, timeout
 			// PROCESSING: 继续等待
 
 		case <-timer.C:
-			return nil, &HubError{"task timeout"}
+			return nil, ErrTaskTimeout
 		}
 	}
 }
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"log"
+	"time"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+)
+
+// recordTask 任务进入排队时写入任务表
+func (h *ChatHandler) recordTask(task *chatTask) {
+	record := model.Task{ID: task.ID, Model: task.Spec.ID, State: model.TaskQueued}
+	if task.Conv != nil {
+		record.ConversationID = task.Conv.ID
+	}
+	if err := h.DB.Create(&record).Error; err != nil {
+		log.Printf("[Chat] record task %s failed: %v", task.ID, err)
+	}
+}
+
+// setTaskState 更新任务状态，fields 为需要同时更新的其他列
+func (h *ChatHandler) setTaskState(task *chatTask, state string, fields map[string]interface{}) {
+	updates := map[string]interface{}{"state": state}
+	for k, v := range fields {
+		updates[k] = v
+	}
+	if err := h.DB.Model(&model.Task{}).Where("id = ?", task.ID).Updates(updates).Error; err != nil {
+		log.Printf("[Chat] update task %s to %s failed: %v", task.ID, state, err)
+	}
+}
+
+// finishTaskState 任务结束时记录最终状态：done / cancelled / error
+func (h *ChatHandler) finishTaskState(task *chatTask, err error) {
+	fields := map[string]interface{}{"model": task.Model, "finished_at": time.Now()}
+	state := model.TaskDone
+	if err != nil {
+		state = model.TaskError
+		if errorFinishReason(err) == "cancelled" {
+			state = model.TaskCancelled
+		}
+		fields["error"] = err.Error()
+	}
+	h.setTaskState(task, state, fields)
+}
@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// OpenAI tools / tool_calls 结构
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"` // 仅流式 delta 中使用
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"` // JSON 字符串
+}
+
+// toolChoice 解析后的 tool_choice：auto / none / required / function（指定 Name）
+type toolChoice struct {
+	Mode string
+	Name string
+}
+
+// parseToolChoice 解析 string 或 {"type":"function","function":{"name":...}} 形式的 tool_choice
+func parseToolChoice(raw json.RawMessage, tools []Tool) (toolChoice, *apiError) {
+	invalid := func(msg string) *apiError {
+		return &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "tool_choice", Message: msg}
+	}
+
+	for _, t := range tools {
+		if t.Type != "function" || t.Function.Name == "" {
+			return toolChoice{}, &apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Param: "tools", Message: "each tool must be a function with a name"}
+		}
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return toolChoice{Mode: "auto"}, nil
+	}
+
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto", "none", "required":
+			return toolChoice{Mode: mode}, nil
+		}
+		return toolChoice{}, invalid(fmt.Sprintf("invalid tool_choice %q", mode))
+	}
+
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Type != "function" || named.Function.Name == "" {
+		return toolChoice{}, invalid("tool_choice must be a string or a function object")
+	}
+	if findTool(tools, named.Function.Name) == nil {
+		return toolChoice{}, invalid(fmt.Sprintf("tool_choice references unknown tool %q", named.Function.Name))
+	}
+	return toolChoice{Mode: "function", Name: named.Function.Name}, nil
+}
+
+func findTool(tools []Tool, name string) *Tool {
+	for i := range tools {
+		if tools[i].Function.Name == name {
+			return &tools[i]
+		}
+	}
+	return nil
+}
+
+// toolsEnabled 请求中定义了工具且 tool_choice 不为 none
+func toolsEnabled(req *ChatRequest) bool {
+	return len(req.Tools) > 0 && req.toolChoice.Mode != "none"
+}
+
+const toolCallsFence = "```"
+
+// toolInstructions 生成注入到 prompt 开头的工具定义与调用格式说明
+func toolInstructions(req *ChatRequest) string {
+	if !toolsEnabled(req) {
+		return ""
+	}
+
+	type toolDef struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	}
+	defs := make([]toolDef, 0, len(req.Tools))
+	for _, t := range req.Tools {
+		defs = append(defs, toolDef{Name: t.Function.Name, Description: t.Function.Description, Parameters: t.Function.Parameters})
+	}
+	defsJSON, _ := json.MarshalIndent(defs, "", "  ")
+
+	var b strings.Builder
+	b.WriteString("<tools>\n")
+	b.Write(defsJSON)
+	b.WriteString("\n</tools>\n\n")
+	b.WriteString("You can call the tools defined above (parameters are JSON Schema). ")
+	b.WriteString("To call tools, reply with ONLY a code block tagged tool_calls containing a JSON array, and nothing else:\n\n")
+	b.WriteString(toolCallsFence + "tool_calls\n")
+	b.WriteString(`[{"name": "<tool name>", "arguments": {<arguments as a JSON object>}}]` + "\n")
+	b.WriteString(toolCallsFence + "\n\n")
+	b.WriteString(`Tool results are provided in <message role="tool"> elements. `)
+	switch req.toolChoice.Mode {
+	case "required":
+		b.WriteString("You MUST call at least one tool.")
+	case "function":
+		fmt.Fprintf(&b, "You MUST call the tool %q.", req.toolChoice.Name)
+	default:
+		b.WriteString("If no tool is needed, answer normally without the code block.")
+	}
+	return b.String()
+}
+
+// formatToolCalls 将 assistant 历史中的 tool_calls 还原为与回复相同的代码块格式
+func formatToolCalls(calls []ToolCall) string {
+	type call struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	list := make([]call, 0, len(calls))
+	for _, c := range calls {
+		args := json.RawMessage(c.Function.Arguments)
+		if !json.Valid(args) {
+			args, _ = json.Marshal(c.Function.Arguments)
+		}
+		list = append(list, call{Name: c.Function.Name, Arguments: args})
+	}
+	data, _ := json.Marshal(list)
+	return toolCallsFence + "tool_calls\n" + string(data) + "\n" + toolCallsFence
+}
+
+// fencedBlockPattern 匹配 Markdown 代码块，group 1 为语言标记，group 2 为内容
+// 复制得到的 Markdown 中下划线可能被转义为 tool\_calls
+var fencedBlockPattern = regexp.MustCompile("(?s)```[ \\t]*([A-Za-z_\\\\]*)[ \\t]*\\n(.*?)\\n?[ \\t]*```")
+
+// parseToolCalls 从回复中解析工具调用，返回工具调用与剩余文本
+// 未找到调用且 tool_choice 允许直接回答时返回 nil 调用；格式错误时返回描述问题的 error，用于纠正重试
+func parseToolCalls(text string, tools []Tool, choice toolChoice) ([]ToolCall, string, error) {
+	mustCall := choice.Mode == "required" || choice.Mode == "function"
+
+	var candidate string
+	explicit := false
+	content := text
+	for _, m := range fencedBlockPattern.FindAllStringSubmatchIndex(text, -1) {
+		lang := strings.ReplaceAll(text[m[2]:m[3]], "\\", "")
+		if lang == "tool_calls" {
+			candidate = text[m[4]:m[5]]
+			content = strings.TrimSpace(text[:m[0]] + text[m[1]:])
+			explicit = true
+			break
+		}
+	}
+	if !explicit {
+		// 兼容未使用 tool_calls 标记、直接回复 JSON（或 json 代码块）的情况
+		trimmed := strings.TrimSpace(text)
+		if m := fencedBlockPattern.FindStringSubmatch(trimmed); m != nil && len(m[0]) == len(trimmed) {
+			trimmed = strings.TrimSpace(m[2])
+		}
+		if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+			candidate = trimmed
+			content = ""
+		}
+	}
+
+	if candidate == "" {
+		if mustCall {
+			return nil, "", fmt.Errorf("the reply does not contain a tool_calls code block")
+		}
+		return nil, text, nil
+	}
+
+	calls, err := decodeToolCalls(candidate, tools, choice)
+	if err != nil {
+		if !explicit && !mustCall {
+			// 普通 JSON 回答，不是工具调用
+			return nil, text, nil
+		}
+		return nil, "", err
+	}
+	return calls, content, nil
+}
+
+// decodeToolCalls 解析 [{"name":..., "arguments":{...}}]（或单个对象）并校验工具名与参数
+func decodeToolCalls(data string, tools []Tool, choice toolChoice) ([]ToolCall, error) {
+	type rawCall struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	var raws []rawCall
+	data = strings.TrimSpace(data)
+	if strings.HasPrefix(data, "{") {
+		var single rawCall
+		if err := json.Unmarshal([]byte(data), &single); err != nil {
+			return nil, fmt.Errorf("tool_calls is not valid JSON: %v", err)
+		}
+		raws = []rawCall{single}
+	} else if err := json.Unmarshal([]byte(data), &raws); err != nil {
+		return nil, fmt.Errorf("tool_calls is not a valid JSON array: %v", err)
+	}
+	if len(raws) == 0 {
+		return nil, fmt.Errorf("tool_calls is empty")
+	}
+
+	calls := make([]ToolCall, 0, len(raws))
+	for i, r := range raws {
+		if findTool(tools, r.Name) == nil {
+			return nil, fmt.Errorf("tool_calls[%d]: unknown tool %q", i, r.Name)
+		}
+		if choice.Mode == "function" && r.Name != choice.Name {
+			return nil, fmt.Errorf("tool_calls[%d]: expected tool %q, got %q", i, choice.Name, r.Name)
+		}
+
+		// arguments 可以是对象，也可以是 JSON 字符串
+		args := bytes.TrimSpace(r.Arguments)
+		var s string
+		if json.Unmarshal(args, &s) == nil {
+			args = []byte(s)
+		}
+		args = bytes.TrimSpace(args)
+		if len(args) == 0 {
+			args = []byte("{}")
+		}
+		var compact bytes.Buffer
+		if args[0] != '{' || json.Compact(&compact, args) != nil {
+			return nil, fmt.Errorf("tool_calls[%d]: arguments must be a JSON object", i)
+		}
+
+		calls = append(calls, ToolCall{
+			ID:       "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24],
+			Type:     "function",
+			Function: ToolCallFunction{Name: r.Name, Arguments: compact.String()},
+		})
+	}
+	return calls, nil
+}
+
+// toolCallCorrection 生成工具调用解析失败时的纠正说明
+func toolCallCorrection(err error) string {
+	return fmt.Sprintf("Your previous reply could not be parsed as a tool call: %v. "+
+		"Reply again following the tool call format exactly: only a code block tagged tool_calls containing a JSON array "+
+		`of {"name": ..., "arguments": {...}} objects.`, err)
+}
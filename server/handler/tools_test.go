@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var weatherTools = []Tool{{
+	Type: "function",
+	Function: ToolFunction{
+		Name:       "get_weather",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`),
+	},
+}}
+
+const weatherToolsJSON = `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]`
+
+func donePayloadWithText(text string) []WSMessage {
+	payload, _ := json.Marshal(map[string]string{"text": text, "status": "DONE"})
+	return []WSMessage{{Type: "EVENT_REPLY", Payload: payload}}
+}
+
+func TestParseToolCalls(t *testing.T) {
+	auto := toolChoice{Mode: "auto"}
+	cases := []struct {
+		name    string
+		text    string
+		choice  toolChoice
+		calls   int
+		content string
+		wantErr bool
+	}{
+		{"tagged block", "```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]\n```", auto, 1, "", false},
+		{"escaped tag with text", "Let me check.\n\n```tool\\_calls\n[{\"name\":\"get_weather\",\"arguments\":\"{\\\"city\\\":\\\"Paris\\\"}\"}]\n```", auto, 1, "Let me check.", false},
+		{"bare json object", `{"name":"get_weather","arguments":{"city":"Paris"}}`, auto, 1, "", false},
+		{"plain answer", "It is sunny.", auto, 0, "It is sunny.", false},
+		{"unrelated json", "```json\n{\"temperature\": 20}\n```", auto, 0, "```json\n{\"temperature\": 20}\n```", false},
+		{"unknown tool", "```tool_calls\n[{\"name\":\"get_time\",\"arguments\":{}}]\n```", auto, 0, "", true},
+		{"bad json", "```tool_calls\n[{\"name\":\"get_weather\",\n```", auto, 0, "", true},
+		{"required without call", "It is sunny.", toolChoice{Mode: "required"}, 0, "", true},
+		{"forced other tool", "```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{}}]\n```", toolChoice{Mode: "function", Name: "get_time"}, 0, "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls, content, err := parseToolCalls(tc.text, weatherTools, tc.choice)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(calls) != tc.calls || content != tc.content {
+				t.Errorf("got %d calls, content %q", len(calls), content)
+			}
+			for _, call := range calls {
+				if call.Function.Arguments != `{"city":"Paris"}` || !strings.HasPrefix(call.ID, "call_") {
+					t.Errorf("unexpected call: %+v", call)
+				}
+			}
+		})
+	}
+}
+
+func TestMessagesToXMLToolMessages(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}},
+		{Role: "tool", ToolCallID: "call_1", Content: `{"temp":20}`},
+	}
+	xml, err := messagesToXML(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(xml, `<message role="tool" tool_call_id="call_1">`) {
+		t.Errorf("tool message not rendered: %s", xml)
+	}
+	if !strings.Contains(xml, "```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]\n```") {
+		t.Errorf("assistant tool calls not rendered: %s", xml)
+	}
+}
+
+func TestChatToolCallsNonStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, received := recordExtension(t, server, donePayloadWithText("```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]\n```"))
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Weather in Paris?"}],` + weatherToolsJSON + `}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	choice := resp.Choices[0]
+	if *choice.FinishReason != "tool_calls" {
+		t.Errorf("expected finish_reason tool_calls, got %s", *choice.FinishReason)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Name != "get_weather" {
+		t.Fatalf("unexpected tool calls: %+v", choice.Message.ToolCalls)
+	}
+	if choice.Message.ToolCalls[0].Index != nil {
+		t.Error("non-stream tool calls should not carry an index")
+	}
+
+	// 工具定义注入到 prompt
+	msg := <-received
+	var p SendMessagePayload
+	json.Unmarshal(msg.Payload, &p)
+	if !strings.Contains(p.Prompt, "<tools>") || !strings.Contains(p.Prompt, "get_weather") {
+		t.Errorf("tool definitions not injected: %s", p.Prompt)
+	}
+}
+
+func TestChatToolCallsStream(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	processing, _ := json.Marshal(map[string]string{"text": "tool_calls [{", "status": "PROCESSING"})
+	replies := append([]WSMessage{{Type: "EVENT_REPLY", Payload: processing}},
+		donePayloadWithText("```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}},{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Rome\"}}]\n```")...)
+	conn := simulateExtension(t, server, replies)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","stream":true,"messages":[{"role":"user","content":"Weather?"}],` + weatherToolsJSON + `}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	var content strings.Builder
+	var calls []ToolCall
+	var finishReason string
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+			continue
+		}
+		var chunk ChatResponse
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk)
+		choice := chunk.Choices[0]
+		content.WriteString(choice.Delta.Content)
+		calls = append(calls, choice.Delta.ToolCalls...)
+		if choice.FinishReason != nil {
+			finishReason = *choice.FinishReason
+		}
+	}
+
+	if content.Len() != 0 {
+		t.Errorf("raw reply should not be streamed when tools are enabled, got %q", content.String())
+	}
+	if len(calls) != 2 || *calls[0].Index != 0 || *calls[1].Index != 1 {
+		t.Fatalf("unexpected tool call deltas: %+v", calls)
+	}
+	if calls[1].Function.Arguments != `{"city":"Rome"}` {
+		t.Errorf("unexpected arguments: %s", calls[1].Function.Arguments)
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("expected finish_reason tool_calls, got %s", finishReason)
+	}
+}
+
+func TestChatToolCallsCorrectiveRetry(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn, received := sequenceExtension(t, server, [][]WSMessage{
+		donePayloadWithText("I will call get_weather for Paris."),
+		donePayloadWithText("```tool_calls\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]\n```"),
+	})
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Weather in Paris?"}],"tool_choice":"required",` + weatherToolsJSON + `}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Fatalf("expected tool call after retry, got %s", w.Body.String())
+	}
+
+	// 第二次下发使用同一任务 ID，prompt 附带纠正说明
+	first, second := <-received, <-received
+	if first.ID != second.ID {
+		t.Errorf("retry should reuse task ID: %s vs %s", first.ID, second.ID)
+	}
+	var p SendMessagePayload
+	json.Unmarshal(second.Payload, &p)
+	if !strings.Contains(p.Prompt, "could not be parsed") {
+		t.Errorf("retry prompt missing correction: %s", p.Prompt)
+	}
+}
+
+func TestChatToolCallsRetryExhausted(t *testing.T) {
+	_, _, server, r := setupChatTest(t)
+	defer server.Close()
+
+	conn := simulateExtension(t, server, donePayloadWithText("No tools for me."))
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	reqBody := `{"model":"gemini","messages":[{"role":"user","content":"Weather?"}],"tool_choice":{"type":"function","function":{"name":"get_weather"}},` + weatherToolsJSON + `}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "tool_call_parse_error") {
+		t.Errorf("expected 502 tool_call_parse_error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 未知的 tool_choice → 400
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gemini","messages":[{"role":"user","content":"Hi"}],"tool_choice":{"type":"function","function":{"name":"nope"}},`+weatherToolsJSON+`}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown tool_choice, got %d", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/native"
+)
+
+// Transport 插件连接的传输层，承载同一套 WSMessage JSON 协议
+// 读操作只在 readPump 中进行，写操作由 Client.mu 串行化
+type Transport interface {
+	// Kind 传输类型："websocket" | "native"
+	Kind() string
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	SetReadDeadline(t time.Time) error
+	// Reject 以关闭码与原因结束连接，不支持关闭码的传输直接断开
+	Reject(code int, reason string) error
+	Close() error
+	// MaxMessageSize 单条消息能送达插件的最大字节数，0 表示不限制
+	MaxMessageSize() int
+}
+
+// wsTransport 插件直接通过 WebSocket 连接（默认）
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) Kind() string { return "websocket" }
+
+func (t *wsTransport) ReadMessage() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+func (t *wsTransport) WriteMessage(data []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *wsTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *wsTransport) Reject(code int, reason string) error {
+	return t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+func (t *wsTransport) Close() error { return t.conn.Close() }
+
+func (t *wsTransport) MaxMessageSize() int { return 0 }
+
+// nativeTransport 插件通过 native messaging host 中转，host 与 server 之间为长度前缀 JSON
+type nativeTransport struct {
+	conn      net.Conn
+	closeOnce sync.Once
+}
+
+func (t *nativeTransport) Kind() string { return "native" }
+
+func (t *nativeTransport) ReadMessage() ([]byte, error) {
+	return native.ReadFrame(t.conn)
+}
+
+func (t *nativeTransport) WriteMessage(data []byte) error {
+	return native.WriteFrame(t.conn, data)
+}
+
+func (t *nativeTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *nativeTransport) Reject(code int, reason string) error {
+	return t.Close()
+}
+
+// MaxMessageSize 浏览器限制 host 发给插件的单条消息不超过 1MB
+func (t *nativeTransport) MaxMessageSize() int { return native.MaxHostMessage }
+
+func (t *nativeTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() { err = t.conn.Close() })
+	return err
+}
+
+// nativeAuthTimeout native host 连接后发送 AUTH 消息的期限
+const nativeAuthTimeout = 5 * time.Second
+
+// ServeNative 在 ln 上接受 native messaging host 的连接，每个连接注册为一个 worker，直到 ln 关闭
+func (h *Hub) ServeNative(ln net.Listener) error {
+	log.Printf("[WS] accepting native messaging hosts on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go h.handleNative(conn)
+	}
+}
+
+// handleNative 校验 host 发送的第一条 AUTH 消息后注册 worker
+func (h *Hub) handleNative(conn net.Conn) {
+	t := &nativeTransport{conn: conn}
+	conn.SetReadDeadline(time.Now().Add(nativeAuthTimeout))
+	data, err := t.ReadMessage()
+	if err != nil {
+		log.Printf("[WS] native host %s did not authenticate: %v", conn.RemoteAddr(), err)
+		t.Close()
+		return
+	}
+
+	var msg WSMessage
+	var auth native.AuthPayload
+	if json.Unmarshal(data, &msg) != nil || msg.Type != "AUTH" {
+		log.Printf("[WS] rejected native host %s: expected AUTH message", conn.RemoteAddr())
+		t.Close()
+		return
+	}
+	json.Unmarshal(msg.Payload, &auth)
+	if reason := h.checkToken(auth.Token); reason != "" {
+		log.Printf("[WS] rejected native host %s: %s", conn.RemoteAddr(), reason)
+		t.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	h.serve(t)
+}
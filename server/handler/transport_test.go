@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KodaTao/Gemini-Web-Proxy/server/native"
+)
+
+// startNativeHost 启动 hub 的 native 监听，并以管道模拟浏览器运行 host
+func startNativeHost(t *testing.T, hub *Hub, token string) (browserIn *io.PipeWriter, browserOut *io.PipeReader, hostErr chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go hub.ServeNative(ln)
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	hostErr = make(chan error, 1)
+	go func() {
+		hostErr <- native.RunHost(stdinR, stdoutW, ln.Addr().String(), token)
+		stdoutW.Close()
+	}()
+	t.Cleanup(func() { stdinW.Close() })
+	return stdinW, stdoutR, hostErr
+}
+
+func writeNative(t *testing.T, w io.Writer, msg WSMessage) {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	if err := native.WriteFrame(w, data); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+func TestNativeTransport(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.Token = "ext-secret"
+
+	browserIn, browserOut, _ := startNativeHost(t, hub, "ext-secret")
+	hello, _ := json.Marshal(HelloPayload{Version: "0.2.0", Capabilities: []string{CapCancel}})
+	writeNative(t, browserIn, WSMessage{Type: "EVENT_HELLO", Payload: hello})
+	time.Sleep(200 * time.Millisecond)
+
+	workers := hub.Workers()
+	if len(workers) != 1 || workers[0].Transport != "native" || workers[0].Version != "0.2.0" {
+		t.Fatalf("expected one native worker, got %+v", workers)
+	}
+
+	// server -> 插件
+	if err := hub.SendToExtension(&WSMessage{ID: "task-1", Type: "CMD_SEND_MESSAGE"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	data, err := native.ReadFrame(browserOut)
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	var cmd WSMessage
+	json.Unmarshal(data, &cmd)
+	if cmd.Type != "CMD_SEND_MESSAGE" || cmd.ID != "task-1" {
+		t.Errorf("unexpected command: %s", data)
+	}
+
+	// 插件 -> server
+	reply, _ := json.Marshal(map[string]string{"text": "hi", "status": "DONE"})
+	writeNative(t, browserIn, WSMessage{ReplyTo: "task-1", Type: "EVENT_REPLY", Payload: reply})
+	select {
+	case msg := <-hub.IncomingMessages:
+		if msg.ReplyTo != "task-1" || msg.WorkerID != workers[0].ID {
+			t.Errorf("unexpected incoming message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reply was not relayed")
+	}
+
+	// 浏览器断开后 worker 被移除
+	browserIn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if n := len(hub.Workers()); n != 0 {
+		t.Errorf("expected the worker to be removed, got %d", n)
+	}
+}
+
+func TestNativeTransportRejectsInvalidToken(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.Token = "ext-secret"
+
+	_, _, hostErr := startNativeHost(t, hub, "wrong")
+	select {
+	case err := <-hostErr:
+		if err == nil {
+			t.Error("expected the host to fail when the server rejects it")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("host was not disconnected")
+	}
+	if n := len(hub.Workers()); n != 0 {
+		t.Errorf("expected no workers, got %d", n)
+	}
+}
+
+func TestNativeTransportRequiresConfiguredToken(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.Token = ""
+
+	_, _, hostErr := startNativeHost(t, hub, "")
+	select {
+	case err := <-hostErr:
+		if err == nil {
+			t.Error("expected the host to be rejected without a configured token")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("host was not disconnected")
+	}
+	if n := len(hub.Workers()); n != 0 {
+		t.Errorf("expected no workers, got %d", n)
+	}
+}
+
+func TestNativeTransportRejectsOversizedCommand(t *testing.T) {
+	hub, _, server, r := setupChatTest(t)
+	defer server.Close()
+	hub.cfg.AckTimeout = 1
+
+	browserIn, browserOut, _ := startNativeHost(t, hub, testWSToken)
+	hello, _ := json.Marshal(HelloPayload{Version: "0.2.0", Capabilities: []string{CapAttachments, CapModelSelection, CapAck}})
+	writeNative(t, browserIn, WSMessage{Type: "EVENT_HELLO", Payload: hello})
+	time.Sleep(200 * time.Millisecond)
+
+	forwarded := make(chan []byte, 1)
+	go func() {
+		if data, err := native.ReadFrame(browserOut); err == nil {
+			forwarded <- data
+		}
+	}()
+
+	// base64 后超过 native messaging 1MB 上限的附件：下发前直接返回 413，不等待重投
+	large := base64.StdEncoding.EncodeToString(append(testPNG, make([]byte, 900<<10)...))
+	body := `{"model":"gemini","messages":[{"role":"user","content":[{"type":"text","text":"Describe"},` +
+		`{"type":"image_url","image_url":{"url":"data:image/png;base64,` + large + `"}}]}]}`
+	start := time.Now()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"code":"message_too_large"`) {
+		t.Fatalf("expected 413 message_too_large, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected an immediate rejection, took %s", elapsed)
+	}
+	select {
+	case data := <-forwarded:
+		t.Errorf("oversized command must not reach the browser: %.100s", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+	hub.mu.RLock()
+	pending := len(hub.acks)
+	hub.mu.RUnlock()
+	if pending != 0 {
+		t.Errorf("expected no pending acks, got %d", pending)
+	}
+	if workers := hub.Workers(); len(workers) != 1 || workers[0].TaskID != "" {
+		t.Errorf("expected the native worker to be released, got %+v", workers)
+	}
+}
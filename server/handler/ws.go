@@ -1,13 +1,23 @@
 package handler
 
 import (
+	"cmp"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
@@ -19,20 +29,45 @@ type WSMessage struct {
 	ReplyTo string          `json:"reply_to,omitempty"`
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// AckID 需要插件以 EVENT_ACK 确认的指令投递 ID，重投时保持不变，插件据此去重
+	AckID string `json:"ack_id,omitempty"`
+
+	// WorkerID 标记消息来源的插件连接，仅在 server 内部使用
+	WorkerID string `json:"-"`
 }
 
+// Origin 与 token 在升级前由 authorizeWS 校验
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-// Client 表示一个 WebSocket 客户端连接（插件端）
+// Client 表示一个 WebSocket 客户端连接（插件端），即一个 worker
 type Client struct {
-	conn   *websocket.Conn
+	ID     string
+	conn   Transport
 	send   chan []byte
 	mu     sync.Mutex
 	closed bool
+
+	// 以下字段由 Hub.mu 保护
+	ready       bool   // 插件端上报的状态（idle=true, busy=false）
+	taskID      string // 当前分配给该 worker 的任务 ID，为空表示未被占用
+	connectedAt time.Time
+	lastActive  time.Time
+	tasksTotal  int
+	tasksFailed int
+	degraded    string // 降级原因（rate_limited_by_gemini / login_required），为空表示正常
+	degradedAt  time.Time
+	exhausted   map[string]time.Time // 额度用尽的模式 -> 预计恢复时间
+	hello       *HelloPayload        // 插件通过 EVENT_HELLO 上报的版本与能力，为空表示旧版插件
+	// resumeHold 连接时存在等待恢复的任务，EVENT_RESUME 处理完成或 resumeHoldTimeout 到期前不分配新任务
+	resumeHold bool
 }
 
+// resumeHoldTimeout 存在等待恢复的任务时，新连接等待 EVENT_RESUME 的最长时间
+const resumeHoldTimeout = 3 * time.Second
+
 func (c *Client) Close() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -43,53 +78,415 @@ func (c *Client) Close() {
 	}
 }
 
-// Hub 管理 WebSocket 连接
+// WorkerInfo worker 状态快照，用于列表展示和统计
+type WorkerInfo struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`    // "idle" | "busy"
+	Transport   string     `json:"transport"` // "websocket" | "native"
+	TaskID      string     `json:"task_id,omitempty"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	LastActive  time.Time  `json:"last_active"`
+	TasksTotal  int        `json:"tasks_total"`
+	TasksFailed int        `json:"tasks_failed"`
+	Degraded    string     `json:"degraded,omitempty"` // 降级原因，为空表示正常
+	DegradedAt  *time.Time `json:"degraded_at,omitempty"`
+
+	// QuotaExhausted 额度用尽的模式及预计恢复时间
+	QuotaExhausted map[string]time.Time `json:"quota_exhausted,omitempty"`
+
+	// 以下字段来自 EVENT_HELLO，旧版插件未上报时为空
+	Version      string   `json:"version,omitempty"`
+	Browser      string   `json:"browser,omitempty"`
+	Account      string   `json:"account,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Hub 管理所有插件 WebSocket 连接（worker 池）
 type Hub struct {
-	mu             sync.RWMutex
-	client         *Client
-	cfg            *config.WebSocketConfig
-	extensionReady bool // 插件端是否空闲（idle=true, busy=false）
+	mu      sync.RWMutex
+	clients map[string]*Client
+	cfg     *config.WebSocketConfig
 
 	// 消息回调：插件发来的消息通过此 channel 广播
 	IncomingMessages chan *WSMessage
+
+	// 有 worker 可能变为空闲时发出信号，供请求队列唤醒排队中的请求
+	idleSignal chan struct{}
+
+	// orphans 所在 worker 已断开、等待插件重连恢复的任务，由 mu 保护
+	orphans map[string]*time.Timer
+
+	// acks 已下发、等待插件 EVENT_ACK 确认的指令（ack_id -> 投递状态），由 mu 保护
+	acks map[string]*pendingAck
+
+	// IncomingMessages 已满、投递方被迫等待的次数与累计等待时间
+	blocked     atomic.Int64
+	blockedTime atomic.Int64 // 纳秒
+}
+
+// IncomingMetrics 插件消息队列的背压统计
+type IncomingMetrics struct {
+	Queued         int     `json:"queued"`   // 当前排队待分发的消息数
+	Capacity       int     `json:"capacity"` // 队列容量
+	Blocked        int64   `json:"blocked"`  // 队列已满、读取插件消息被迫等待的次数
+	BlockedSeconds float64 `json:"blocked_seconds"`
+}
+
+// pendingAck 一条等待确认的指令
+type pendingAck struct {
+	client   *Client
+	msg      *WSMessage
+	attempts int // 已投递次数
+	timer    *time.Timer
+}
+
+// 插件能力，由 EVENT_HELLO 上报
+const (
+	CapAttachments    = "attachments"     // 上传图片/文件附件
+	CapCancel         = "cancel"          // 响应 CMD_CANCEL 停止生成
+	CapModelSelection = "model_selection" // 按 mode 切换 Gemini 模型
+	CapConversations  = "conversations"   // 打开/删除指定的 Gemini 对话
+	CapResume         = "resume"          // 重连后恢复进行中的任务
+	CapAck            = "ack"             // 以 EVENT_ACK 确认收到指令
+)
+
+// closeVersionRejected 插件版本低于 min_extension_version 时使用的关闭码，插件收到后不再自动重连
+const closeVersionRejected = 4001
+
+// HelloPayload EVENT_HELLO 的 payload：插件连接后上报的版本、浏览器、账号与能力列表
+type HelloPayload struct {
+	Version      string   `json:"version"`
+	Browser      string   `json:"browser,omitempty"`
+	Account      string   `json:"account,omitempty"` // 当前登录的 Google 账号
+	Capabilities []string `json:"capabilities"`
+}
+
+// ResumePayload EVENT_RESUME 的 payload：重连的插件上报仍在进行中的任务
+type ResumePayload struct {
+	Tasks []string `json:"tasks"`
+}
+
+// ResumeResultPayload CMD_RESUME_RESULT 的 payload：恢复成功与被拒绝的任务 ID
+// 被拒绝的任务已在 server 端结束，插件应停止生成并清理
+type ResumeResultPayload struct {
+	Resumed  []string `json:"resumed"`
+	Rejected []string `json:"rejected"`
 }
 
 func NewHub(cfg *config.WebSocketConfig) *Hub {
 	return &Hub{
+		clients:          make(map[string]*Client),
 		cfg:              cfg,
 		IncomingMessages: make(chan *WSMessage, 100),
+		idleSignal:       make(chan struct{}, 1),
+		orphans:          make(map[string]*time.Timer),
+		acks:             make(map[string]*pendingAck),
+	}
+}
+
+// IdleSignal 返回 worker 空闲通知 channel
+func (h *Hub) IdleSignal() <-chan struct{} {
+	return h.idleSignal
+}
+
+// notifyIdle 非阻塞地发出空闲信号，已有未消费的信号时直接忽略
+func (h *Hub) notifyIdle() {
+	select {
+	case h.idleSignal <- struct{}{}:
+	default:
 	}
 }
 
-// GetClient 获取当前连接的客户端
+// GetClient 获取一个已连接的客户端（最早连接的 worker），无连接时返回 nil
 func (h *Hub) GetClient() *Client {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.client
+	var first *Client
+	for _, c := range h.clients {
+		if first == nil || c.connectedAt.Before(first.connectedAt) {
+			first = c
+		}
+	}
+	return first
 }
 
-// IsExtensionReady 检查插件端是否空闲
+// GetWorker 按 ID 获取 worker
+func (h *Hub) GetWorker(id string) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.clients[id]
+}
+
+// IsExtensionReady 检查是否存在空闲的 worker
 func (h *Hub) IsExtensionReady() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.extensionReady
+	for _, c := range h.clients {
+		if c.isIdle() {
+			return true
+		}
+	}
+	return false
 }
 
-// SetExtensionReady 设置插件端状态
-func (h *Hub) SetExtensionReady(ready bool) {
+// isIdle 插件端空闲且未被分配任务，调用方需持有 Hub.mu
+func (c *Client) isIdle() bool {
+	return c.ready && c.taskID == "" && !c.resumeHold
+}
+
+// SetWorkerReady 设置指定 worker 的插件端状态
+func (h *Hub) SetWorkerReady(id string, ready bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.extensionReady = ready
+	c, ok := h.clients[id]
+	if !ok {
+		return
+	}
+	// 要求最低插件版本时，未完成 EVENT_HELLO 的连接保持不可用
+	if ready && c.hello == nil && h.cfg.MinExtensionVersion != "" {
+		return
+	}
+	c.ready = ready
+	c.lastActive = time.Now()
 	if ready {
-		log.Println("[Hub] extension status: idle")
+		log.Printf("[Hub] worker %s status: idle", id)
+		h.notifyIdle()
+	} else {
+		log.Printf("[Hub] worker %s status: busy", id)
+	}
+}
+
+// SetWorkerDegraded 标记 worker 降级（Gemini 额度用尽或登录失效），reason 为空表示恢复正常
+func (h *Hub) SetWorkerDegraded(id, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.clients[id]
+	if !ok || c.degraded == reason {
+		return
+	}
+	c.degraded = reason
+	if reason != "" {
+		c.degradedAt = time.Now()
+		log.Printf("[Hub] worker %s degraded: %s", id, reason)
 	} else {
-		log.Println("[Hub] extension status: busy")
+		log.Printf("[Hub] worker %s recovered", id)
 	}
 }
 
+// MarkQuotaExhausted 记录 worker 上某模式的额度已用尽，until 之前不再以该模式向其下发任务
+func (h *Hub) MarkQuotaExhausted(id, mode string, until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.clients[id]; ok {
+		c.exhausted[mode] = until
+		log.Printf("[Hub] worker %s quota exhausted for %s until %s", id, mode, until.Format(time.RFC3339))
+	}
+}
+
+// QuotaExhausted 判断 worker 上某模式的额度是否仍处于用尽状态
+func (h *Hub) QuotaExhausted(id, mode string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.clients[id]
+	if !ok {
+		return false
+	}
+	until, ok := c.exhausted[mode]
+	if ok && time.Now().After(until) {
+		delete(c.exhausted, mode)
+		return false
+	}
+	return ok
+}
+
+// AcquireWorker 选取一个空闲且具备 caps 能力的 worker 并分配给任务（优先未降级的，其次最久未使用的）
+// 降级的 worker 仍可被分配，成功完成一次请求即恢复正常
+func (h *Hub) AcquireWorker(taskID string, caps ...string) (*Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.clients) == 0 {
+		return nil, ErrNoClient
+	}
+
+	var picked *Client
+	for _, c := range h.clients {
+		if !c.isIdle() || !c.supports(caps...) {
+			continue
+		}
+		if picked == nil || betterWorker(c, picked) {
+			picked = c
+		}
+	}
+	if picked == nil {
+		return nil, ErrNoIdleWorker
+	}
+
+	picked.taskID = taskID
+	picked.lastActive = time.Now()
+	return picked, nil
+}
+
+// supports 判断 worker 是否具备全部能力，未上报 EVENT_HELLO 的旧版插件视为全部支持
+// 调用方需持有 Hub.mu
+func (c *Client) supports(caps ...string) bool {
+	if c.hello == nil {
+		return true
+	}
+	for _, cap := range caps {
+		if !slices.Contains(c.hello.Capabilities, cap) {
+			return false
+		}
+	}
+	return true
+}
+
+// MissingCapabilities 返回没有任何已连接 worker 具备的能力
+// 无 worker 连接时返回空，由排队逻辑处理
+func (h *Hub) MissingCapabilities(caps ...string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.clients) == 0 {
+		return nil
+	}
+	for _, c := range h.clients {
+		if c.supports(caps...) {
+			return nil
+		}
+	}
+	var missing []string
+	for _, cap := range caps {
+		supported := false
+		for _, c := range h.clients {
+			if c.supports(cap) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			missing = append(missing, cap)
+		}
+	}
+	if len(missing) == 0 {
+		// 每项能力都有 worker 支持，但没有 worker 同时支持全部
+		missing = caps
+	}
+	return missing
+}
+
+// WorkerSupports 判断指定 worker 是否具备某项能力
+func (h *Hub) WorkerSupports(id, cap string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c, ok := h.clients[id]
+	return ok && c.supports(cap)
+}
+
+// betterWorker 判断 a 是否比 b 更适合分配任务
+func betterWorker(a, b *Client) bool {
+	if (a.degraded == "") != (b.degraded == "") {
+		return a.degraded == ""
+	}
+	return a.lastActive.Before(b.lastActive)
+}
+
+// ReleaseWorker 任务结束后释放 worker 并记录统计
+// 插件端的 idle/busy 状态仍以 EVENT_STATUS 为准
+// 任务在断开后已被其他 worker 恢复时，一并释放恢复它的 worker
+func (h *Hub) ReleaseWorker(client *Client, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if taskID := client.taskID; taskID != "" {
+		for _, c := range h.clients {
+			if c.taskID == taskID {
+				c.taskID = ""
+			}
+		}
+		if timer, ok := h.orphans[taskID]; ok {
+			timer.Stop()
+			delete(h.orphans, taskID)
+		}
+	}
+	client.taskID = ""
+	client.lastActive = time.Now()
+	client.tasksTotal++
+	if failed {
+		client.tasksFailed++
+	}
+	h.notifyIdle()
+}
+
+// Workers 返回所有 worker 的状态快照，按连接时间排序
+func (h *Hub) Workers() []WorkerInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	workers := make([]WorkerInfo, 0, len(h.clients))
+	for _, c := range h.clients {
+		status := "busy"
+		if c.isIdle() {
+			status = "idle"
+		}
+		info := WorkerInfo{
+			ID:          c.ID,
+			Status:      status,
+			Transport:   c.conn.Kind(),
+			TaskID:      c.taskID,
+			ConnectedAt: c.connectedAt,
+			LastActive:  c.lastActive,
+			TasksTotal:  c.tasksTotal,
+			TasksFailed: c.tasksFailed,
+			Degraded:    c.degraded,
+		}
+		if c.hello != nil {
+			info.Version = c.hello.Version
+			info.Browser = c.hello.Browser
+			info.Account = c.hello.Account
+			info.Capabilities = c.hello.Capabilities
+		}
+		if c.degraded != "" {
+			degradedAt := c.degradedAt
+			info.DegradedAt = &degradedAt
+		}
+		now := time.Now()
+		for mode, until := range c.exhausted {
+			if now.Before(until) {
+				if info.QuotaExhausted == nil {
+					info.QuotaExhausted = make(map[string]time.Time)
+				}
+				info.QuotaExhausted[mode] = until
+			}
+		}
+		workers = append(workers, info)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ConnectedAt.Before(workers[j].ConnectedAt)
+	})
+	return workers
+}
+
 // SendToExtension 向插件发送消息
+// 若消息 ID 对应的任务已分配给某个 worker，则发给该 worker，否则发给任意已连接的 worker
 func (h *Hub) SendToExtension(msg *WSMessage) error {
-	client := h.GetClient()
+	var client *Client
+	if msg.ID != "" {
+		h.mu.RLock()
+		for _, c := range h.clients {
+			if c.taskID == msg.ID {
+				client = c
+				break
+			}
+		}
+		h.mu.RUnlock()
+	}
+	if client == nil {
+		client = h.GetClient()
+	}
+	return h.SendToClient(client, msg)
+}
+
+// SendToClient 向指定 worker 发送消息
+func (h *Hub) SendToClient(client *Client, msg *WSMessage) error {
 	if client == nil {
 		return ErrNoClient
 	}
@@ -98,6 +495,9 @@ func (h *Hub) SendToExtension(msg *WSMessage) error {
 	if err != nil {
 		return err
 	}
+	if limit := client.conn.MaxMessageSize(); limit > 0 && len(data) > limit {
+		return ErrMessageTooLarge
+	}
 
 	client.mu.Lock()
 	defer client.mu.Unlock()
@@ -113,9 +513,106 @@ func (h *Hub) SendToExtension(msg *WSMessage) error {
 	}
 }
 
+// SendCommand 向 worker 下发需要确认的指令
+// 插件支持 ack 时，ack_timeout 秒内未收到 EVENT_ACK 则重投，重投 ack_retries 次仍未确认时以 extension_unresponsive 通知等待方失败
+func (h *Hub) SendCommand(client *Client, msg *WSMessage) error {
+	if client == nil {
+		return ErrNoClient
+	}
+	if h.cfg.AckTimeout <= 0 || !h.WorkerSupports(client.ID, CapAck) {
+		return h.SendToClient(client, msg)
+	}
+
+	msg.AckID = uuid.New().String()
+	id := msg.AckID
+	h.mu.Lock()
+	h.acks[id] = &pendingAck{
+		client:   client,
+		msg:      msg,
+		attempts: 1,
+		timer:    time.AfterFunc(h.ackTimeout(), func() { h.ackExpired(id) }),
+	}
+	h.mu.Unlock()
+
+	if err := h.SendToClient(client, msg); err != nil {
+		h.handleAck(id)
+		return err
+	}
+	return nil
+}
+
+func (h *Hub) ackTimeout() time.Duration {
+	return time.Duration(h.cfg.AckTimeout) * time.Second
+}
+
+// handleAck 插件确认收到指令，停止重投
+func (h *Hub) handleAck(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.acks[id]; ok {
+		p.timer.Stop()
+		delete(h.acks, id)
+		if p.attempts > 1 {
+			log.Printf("[WS] %s for %s acknowledged by %s after %d attempts", p.msg.Type, p.msg.ID, p.client.ID, p.attempts)
+		}
+	}
+}
+
+// ackExpired 确认超时：未达到重投上限时重新投递，否则放弃并通知等待方
+func (h *Hub) ackExpired(id string) {
+	h.mu.Lock()
+	p, ok := h.acks[id]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	if p.attempts > h.cfg.AckRetries {
+		delete(h.acks, id)
+		h.mu.Unlock()
+		log.Printf("[WS] %s for %s not acknowledged by %s after %d attempts", p.msg.Type, p.msg.ID, p.client.ID, p.attempts)
+		h.failUnacked(p)
+		return
+	}
+	p.attempts++
+	p.timer = time.AfterFunc(h.ackTimeout(), func() { h.ackExpired(id) })
+	h.mu.Unlock()
+
+	log.Printf("[WS] redelivering %s for %s to %s (attempt %d)", p.msg.Type, p.msg.ID, p.client.ID, p.attempts)
+	if err := h.SendToClient(p.client, p.msg); err != nil {
+		log.Printf("[WS] redelivery to %s failed: %v", p.client.ID, err)
+	}
+}
+
+// failUnacked 通知等待方指令未被插件确认；CMD_CANCEL 没有等待方，只记录日志
+func (h *Hub) failUnacked(p *pendingAck) {
+	if p.msg.ID == "" || p.msg.Type == "CMD_CANCEL" {
+		return
+	}
+	payload, _ := json.Marshal(map[string]string{
+		"error": fmt.Sprintf("extension did not acknowledge %s after %d attempts", p.msg.Type, p.attempts),
+		"code":  "extension_unresponsive",
+	})
+	h.emit(&WSMessage{ReplyTo: p.msg.ID, Type: "EVENT_ERROR", Payload: payload, WorkerID: p.client.ID})
+}
+
+// dropAcks worker 断开时放弃其所有待确认指令，任务由断线恢复逻辑处理
+func (h *Hub) dropAcks(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, p := range h.acks {
+		if p.client == client {
+			p.timer.Stop()
+			delete(h.acks, id)
+		}
+	}
+}
+
 var (
 	ErrNoClient       = &HubError{"no extension client connected"}
+	ErrNoIdleWorker   = &HubError{"all extension workers are busy"}
 	ErrSendBufferFull = &HubError{"send buffer full"}
+	// ErrMessageTooLarge 消息超过 worker 传输层的大小上限（native messaging 为 1MB）
+	ErrMessageTooLarge = &HubError{"message exceeds the transport size limit"}
 )
 
 type HubError struct {
@@ -124,54 +621,125 @@ type HubError struct {
 
 func (e *HubError) Error() string { return e.msg }
 
-// HandleWS 处理 WebSocket 连接请求
+// HandleWS 处理 WebSocket 连接请求，每个连接注册为一个独立的 worker
+// 握手未通过 Origin 或 token 校验时拒绝连接，不影响已连接的 worker
 func (h *Hub) HandleWS(c *gin.Context) {
+	if status, reason := h.authorizeWS(c.Request); reason != "" {
+		log.Printf("[WS] rejected connection from %s (origin %q): %s", c.ClientIP(), c.GetHeader("Origin"), reason)
+		c.AbortWithStatusJSON(status, gin.H{"error": reason})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("[WS] upgrade error: %v", err)
 		return
 	}
+	h.serve(&wsTransport{conn: conn})
+}
 
+// serve 将一个已通过校验的插件连接注册为 worker，并阻塞处理其消息直到断开
+func (h *Hub) serve(conn Transport) {
+	// 要求最低插件版本时，新连接在 EVENT_HELLO 校验通过前不接收任务
+	now := time.Now()
 	client := &Client{
-		conn: conn,
-		send: make(chan []byte, 256),
+		ID:          fmt.Sprintf("worker-%s", uuid.New().String()[:8]),
+		conn:        conn,
+		send:        make(chan []byte, 256),
+		ready:       h.cfg.MinExtensionVersion == "",
+		connectedAt: now,
+		lastActive:  now,
+		exhausted:   make(map[string]time.Time),
 	}
 
-	// 替换旧连接
 	h.mu.Lock()
-	if h.client != nil {
-		log.Println("[WS] replacing old client connection")
-		h.client.Close()
-	}
-	h.client = client
-	h.extensionReady = true // 新连接默认空闲
+	// 重连的插件可能携带断开前的任务，先等待其 EVENT_RESUME，避免被排队中的请求抢先占用
+	client.resumeHold = len(h.orphans) > 0
+	h.clients[client.ID] = client
+	total := len(h.clients)
+	idle := client.isIdle()
 	h.mu.Unlock()
+	status := "awaiting hello"
+	switch {
+	case client.resumeHold:
+		status = "awaiting resume"
+		time.AfterFunc(resumeHoldTimeout, func() { h.releaseResumeHold(client) })
+	case idle:
+		status = "idle"
+		h.notifyIdle()
+	}
 
-	log.Println("[WS] extension connected (status: idle)")
+	log.Printf("[WS] extension connected: %s via %s (status: %s, workers: %d)", client.ID, conn.Kind(), status, total)
 
 	go h.writePump(client)
 	go h.pingPump(client)
 	h.readPump(client)
 }
 
+// authorizeWS 校验握手请求的 Origin 与插件 token，返回拒绝的状态码与原因（原因为空表示通过）
+func (h *Hub) authorizeWS(r *http.Request) (int, string) {
+	// 配置了允许列表时，不带 Origin 的连接同样拒绝
+	if origin := r.Header.Get("Origin"); len(h.cfg.AllowedOrigins) > 0 && !originAllowed(origin, h.cfg.AllowedOrigins) {
+		return http.StatusForbidden, "origin not allowed"
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if reason := h.checkToken(token); reason != "" {
+		return http.StatusUnauthorized, reason
+	}
+	return 0, ""
+}
+
+// checkToken 校验插件 token，返回拒绝原因（为空表示通过）；未配置 token 时拒绝所有连接
+func (h *Hub) checkToken(token string) string {
+	if h.cfg.Token == "" {
+		return "extension token is not configured"
+	}
+	if token == "" {
+		return "missing extension token"
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Token)) != 1 {
+		return "invalid extension token"
+	}
+	return ""
+}
+
+// originAllowed 判断 Origin 是否匹配允许列表中的任一模式
+func originAllowed(origin string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // readPump 持续读取插件发来的消息
 func (h *Hub) readPump(client *Client) {
 	defer func() {
 		h.mu.Lock()
-		if h.client == client {
-			h.client = nil
-			h.extensionReady = false
-		}
+		delete(h.clients, client.ID)
+		taskID := client.taskID
+		total := len(h.clients)
 		h.mu.Unlock()
 		client.Close()
-		log.Println("[WS] extension disconnected (status reset)")
+		h.dropAcks(client)
+		log.Printf("[WS] extension disconnected: %s (workers: %d)", client.ID, total)
+
+		// worker 断开时若仍有进行中的任务，等待插件重连恢复，超时后通知等待方失败
+		if taskID != "" {
+			h.orphanTask(taskID, client.ID)
+		}
 	}()
 
 	pongTimeout := time.Duration(h.cfg.PongTimeout) * time.Second
 	pingInterval := time.Duration(h.cfg.PingInterval) * time.Second
 
 	for {
-		_, data, err := client.conn.ReadMessage()
+		data, err := client.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("[WS] read error: %v", err)
@@ -201,15 +769,217 @@ func (h *Hub) readPump(client *Client) {
 			if msg.Payload != nil {
 				json.Unmarshal(msg.Payload, &statusPayload)
 			}
-			h.SetExtensionReady(statusPayload.Status == "idle")
+			h.SetWorkerReady(client.ID, statusPayload.Status == "idle")
 			continue
 		}
 
-		select {
-		case h.IncomingMessages <- &msg:
-		default:
-			log.Println("[WS] incoming message buffer full, dropping message")
+		// 插件主动上报 Gemini 额度用尽或登录失效
+		if msg.Type == "EVENT_DEGRADED" {
+			var degradedPayload struct {
+				Reason string `json:"reason"`
+			}
+			if msg.Payload != nil {
+				json.Unmarshal(msg.Payload, &degradedPayload)
+			}
+			if degradedPayload.Reason != "" {
+				h.SetWorkerDegraded(client.ID, degradedPayload.Reason)
+			}
+			continue
 		}
+
+		// 插件上报版本与能力，版本过低时断开连接
+		if msg.Type == "EVENT_HELLO" {
+			var hello HelloPayload
+			if msg.Payload != nil {
+				json.Unmarshal(msg.Payload, &hello)
+			}
+			if !h.handleHello(client, &hello) {
+				return
+			}
+			continue
+		}
+
+		// 插件确认收到指令
+		if msg.Type == "EVENT_ACK" {
+			var ackPayload struct {
+				AckID string `json:"ack_id"`
+			}
+			if msg.Payload != nil {
+				json.Unmarshal(msg.Payload, &ackPayload)
+			}
+			h.handleAck(ackPayload.AckID)
+			continue
+		}
+
+		// 重连的插件上报断开前未完成的任务
+		if msg.Type == "EVENT_RESUME" {
+			var resumePayload ResumePayload
+			if msg.Payload != nil {
+				json.Unmarshal(msg.Payload, &resumePayload)
+			}
+			h.resumeTasks(client, resumePayload.Tasks)
+			continue
+		}
+
+		msg.WorkerID = client.ID
+		h.emit(&msg)
+	}
+}
+
+// handleHello 记录插件上报的版本与能力，版本低于 min_extension_version 时发送关闭帧并返回 false
+func (h *Hub) handleHello(client *Client, hello *HelloPayload) bool {
+	if required := h.cfg.MinExtensionVersion; required != "" && compareVersions(hello.Version, required) < 0 {
+		log.Printf("[WS] rejected %s: extension version %q is older than the required %s", client.ID, hello.Version, required)
+		reason := fmt.Sprintf("extension version %s is older than the required %s", hello.Version, required)
+		client.conn.Reject(closeVersionRejected, reason)
+		return false
+	}
+	if hello.Capabilities == nil {
+		hello.Capabilities = []string{}
+	}
+
+	h.mu.Lock()
+	first := client.hello == nil
+	client.hello = hello
+	if first && !client.ready && client.taskID == "" && h.cfg.MinExtensionVersion != "" {
+		client.ready = true
+		if client.isIdle() {
+			h.notifyIdle()
+		}
+	}
+	h.mu.Unlock()
+
+	log.Printf("[WS] %s hello: version %s, browser %q, account %q, capabilities %v", client.ID, hello.Version, hello.Browser, hello.Account, hello.Capabilities)
+	return true
+}
+
+// compareVersions 按点分数字比较版本号（如 0.1.0 与 0.2），非数字部分按 0 处理
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return cmp.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// emit 将插件消息交给分发协程，队列已满时阻塞等待而不是丢弃
+// 阻塞期间对应连接暂停读取，背压由 WebSocket 传导到插件
+func (h *Hub) emit(msg *WSMessage) {
+	select {
+	case h.IncomingMessages <- msg:
+		return
+	default:
+	}
+
+	h.blocked.Add(1)
+	log.Printf("[WS] incoming message buffer full, waiting to deliver %s for %s", msg.Type, msg.ReplyTo)
+	start := time.Now()
+	h.IncomingMessages <- msg
+	h.blockedTime.Add(int64(time.Since(start)))
+}
+
+// IncomingMetrics 返回插件消息队列的背压统计
+func (h *Hub) IncomingMetrics() IncomingMetrics {
+	return IncomingMetrics{
+		Queued:         len(h.IncomingMessages),
+		Capacity:       cap(h.IncomingMessages),
+		Blocked:        h.blocked.Load(),
+		BlockedSeconds: time.Duration(h.blockedTime.Load()).Seconds(),
+	}
+}
+
+// orphanTask worker 断开后保留其任务 resume_timeout 秒，期间可由重连的插件恢复
+func (h *Hub) orphanTask(taskID, workerID string) {
+	grace := time.Duration(h.cfg.ResumeTimeout) * time.Second
+	if grace <= 0 {
+		h.failDisconnected(taskID, workerID)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		h.mu.Lock()
+		current, ok := h.orphans[taskID]
+		if ok && current == timer {
+			delete(h.orphans, taskID)
+		}
+		h.mu.Unlock()
+		if ok && current == timer {
+			log.Printf("[WS] task %s was not resumed within %s", taskID, grace)
+			h.failDisconnected(taskID, workerID)
+		}
+	})
+	h.orphans[taskID] = timer
+	log.Printf("[WS] task %s orphaned by %s, waiting %s for the extension to resume it", taskID, workerID, grace)
+}
+
+// failDisconnected 通知等待方任务因插件断开而失败
+func (h *Hub) failDisconnected(taskID, workerID string) {
+	payload, _ := json.Marshal(map[string]string{"error": "extension disconnected", "code": "extension_disconnected"})
+	h.emit(&WSMessage{ReplyTo: taskID, Type: "EVENT_ERROR", Payload: payload, WorkerID: workerID})
+}
+
+// releaseResumeHold 插件未在 resumeHoldTimeout 内上报 EVENT_RESUME，视为没有需要恢复的任务
+func (h *Hub) releaseResumeHold(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !client.resumeHold {
+		return
+	}
+	client.resumeHold = false
+	if client.isIdle() {
+		h.notifyIdle()
+	}
+}
+
+// resumeTasks 将等待恢复的任务重新绑定到重连的 worker，并通过 EVENT_RESUMED 通知等待方
+// 每个 worker 同一时间只处理一个任务，其余任务及未知任务被拒绝
+func (h *Hub) resumeTasks(client *Client, taskIDs []string) {
+	result := ResumeResultPayload{Resumed: []string{}, Rejected: []string{}}
+
+	h.mu.Lock()
+	for _, id := range taskIDs {
+		timer, ok := h.orphans[id]
+		if !ok || client.taskID != "" {
+			result.Rejected = append(result.Rejected, id)
+			continue
+		}
+		timer.Stop()
+		delete(h.orphans, id)
+		client.taskID = id
+		client.ready = false
+		client.lastActive = time.Now()
+		result.Resumed = append(result.Resumed, id)
+	}
+	client.resumeHold = false
+	if client.isIdle() {
+		h.notifyIdle()
+	}
+	h.mu.Unlock()
+
+	for _, id := range result.Resumed {
+		log.Printf("[WS] task %s resumed on %s", id, client.ID)
+		h.emit(&WSMessage{ReplyTo: id, Type: "EVENT_RESUMED", WorkerID: client.ID})
+	}
+	if len(result.Rejected) > 0 {
+		log.Printf("[WS] rejected resume of %v from %s", result.Rejected, client.ID)
+	}
+
+	payload, _ := json.Marshal(result)
+	if err := h.SendToClient(client, &WSMessage{Type: "CMD_RESUME_RESULT", Payload: payload}); err != nil {
+		log.Printf("[WS] failed to send resume result to %s: %v", client.ID, err)
 	}
 }
 
@@ -221,7 +991,7 @@ func (h *Hub) writePump(client *Client) {
 			client.mu.Unlock()
 			return
 		}
-		err := client.conn.WriteMessage(websocket.TextMessage, data)
+		err := client.conn.WriteMessage(data)
 		client.mu.Unlock()
 
 		if err != nil {
@@ -248,7 +1018,7 @@ func (h *Hub) pingPump(client *Client) {
 			client.mu.Unlock()
 			return
 		}
-		err := client.conn.WriteMessage(websocket.TextMessage, data)
+		err := client.conn.WriteMessage(data)
 		client.mu.Unlock()
 
 		if err != nil {
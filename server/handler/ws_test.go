@@ -2,6 +2,7 @@ package handler
 
 import (
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -13,12 +14,16 @@ import (
 	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
 )
 
+// testWSToken 测试 hub 的插件 token
+const testWSToken = "test-token"
+
 func setupTestHub() (*Hub, *httptest.Server) {
 	gin.SetMode(gin.TestMode)
 
 	cfg := &config.WebSocketConfig{
 		PingInterval: 2,
 		PongTimeout:  5,
+		Token:        testWSToken,
 	}
 	hub := NewHub(cfg)
 
@@ -32,7 +37,7 @@ func setupTestHub() (*Hub, *httptest.Server) {
 func dialWS(t *testing.T, server *httptest.Server) *websocket.Conn {
 	t.Helper()
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+testWSToken, nil)
 	if err != nil {
 		t.Fatalf("dial ws failed: %v", err)
 	}
@@ -158,7 +163,7 @@ func TestPingPong(t *testing.T) {
 }
 
 func TestSendToExtensionNoClient(t *testing.T) {
-	cfg := &config.WebSocketConfig{PingInterval: 30, PongTimeout: 10}
+	cfg := &config.WebSocketConfig{PingInterval: 30, PongTimeout: 10, Token: testWSToken}
 	hub := NewHub(cfg)
 
 	err := hub.SendToExtension(&WSMessage{Type: "test"})
@@ -167,29 +172,176 @@ func TestSendToExtensionNoClient(t *testing.T) {
 	}
 }
 
-func TestReplaceOldConnection(t *testing.T) {
+func TestMultipleWorkers(t *testing.T) {
 	hub, server := setupTestHub()
 	defer server.Close()
 
-	// 第一个连接
+	// 两个插件同时连接，均应注册为独立 worker
 	conn1 := dialWS(t, server)
+	defer conn1.Close()
+	conn2 := dialWS(t, server)
+	defer conn2.Close()
 	time.Sleep(100 * time.Millisecond)
 
-	// 第二个连接应替换第一个
+	workers := hub.Workers()
+	if len(workers) != 2 {
+		t.Fatalf("expected 2 workers, got %d", len(workers))
+	}
+	for _, w := range workers {
+		if w.Status != "idle" {
+			t.Errorf("expected worker %s idle, got %s", w.ID, w.Status)
+		}
+	}
+
+	// 旧连接不应被关闭
+	conn1.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := conn1.ReadMessage(); err != nil && !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected old connection to stay open, got %v", err)
+	}
+}
+
+func TestAcquireWorker(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+
+	conn1 := dialWS(t, server)
+	defer conn1.Close()
 	conn2 := dialWS(t, server)
-	time.Sleep(100 * time.Millisecond)
 	defer conn2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	w1, err := hub.AcquireWorker("task-1")
+	if err != nil {
+		t.Fatalf("acquire first worker failed: %v", err)
+	}
+	w2, err := hub.AcquireWorker("task-2")
+	if err != nil {
+		t.Fatalf("acquire second worker failed: %v", err)
+	}
+	if w1.ID == w2.ID {
+		t.Error("expected two different workers")
+	}
 
-	// conn1 应该已被关闭
-	conn1.SetReadDeadline(time.Now().Add(1 * time.Second))
-	_, _, err := conn1.ReadMessage()
-	if err == nil {
-		t.Error("expected old connection to be closed")
+	// 所有 worker 都被占用
+	if _, err := hub.AcquireWorker("task-3"); err != ErrNoIdleWorker {
+		t.Errorf("expected ErrNoIdleWorker, got %v", err)
+	}
+	if hub.IsExtensionReady() {
+		t.Error("expected no idle worker")
 	}
 
-	// 新连接应该可以正常通信
-	msg := &WSMessage{Type: "test"}
-	if err := hub.SendToExtension(msg); err != nil {
-		t.Errorf("send to new client failed: %v", err)
+	// 释放后可再次分配，且统计被记录
+	hub.ReleaseWorker(w1, true)
+	w3, err := hub.AcquireWorker("task-3")
+	if err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+	if w3.ID != w1.ID {
+		t.Errorf("expected released worker %s, got %s", w1.ID, w3.ID)
+	}
+	for _, w := range hub.Workers() {
+		if w.ID == w1.ID && (w.TasksTotal != 1 || w.TasksFailed != 1) {
+			t.Errorf("expected stats 1/1, got %d/%d", w.TasksTotal, w.TasksFailed)
+		}
+	}
+}
+
+func TestWorkerStatusAndRemoval(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+
+	conn := dialWS(t, server)
+	time.Sleep(100 * time.Millisecond)
+
+	// 插件上报 busy
+	status := WSMessage{Type: "EVENT_STATUS", Payload: json.RawMessage(`{"status":"busy"}`)}
+	data, _ := json.Marshal(status)
+	conn.WriteMessage(websocket.TextMessage, data)
+	time.Sleep(100 * time.Millisecond)
+
+	if hub.IsExtensionReady() {
+		t.Error("expected worker to be busy")
+	}
+	if _, err := hub.AcquireWorker("task-1"); err != ErrNoIdleWorker {
+		t.Errorf("expected ErrNoIdleWorker, got %v", err)
+	}
+
+	// 断开后 worker 应被移除
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if len(hub.Workers()) != 0 {
+		t.Errorf("expected 0 workers after disconnect, got %d", len(hub.Workers()))
+	}
+	if hub.GetClient() != nil {
+		t.Error("expected no client after disconnect")
+	}
+}
+
+func TestWSAuthorization(t *testing.T) {
+	hub, server := setupTestHub()
+	defer server.Close()
+	hub.cfg.Token = "ext-secret"
+	hub.cfg.AllowedOrigins = []string{"chrome-extension://*"}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	dial := func(query string, header http.Header) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+query, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	// 已连接的 worker 不受后续被拒绝的连接影响
+	conn, status := dial("?token=ext-secret", http.Header{"Origin": {"chrome-extension://abcdef"}})
+	if conn == nil {
+		t.Fatalf("expected valid token to connect, got %d", status)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	cases := []struct {
+		query  string
+		header http.Header
+		status int
+	}{
+		{"", http.Header{"Origin": {"chrome-extension://abcdef"}}, http.StatusUnauthorized},
+		{"?token=wrong", http.Header{"Origin": {"chrome-extension://abcdef"}}, http.StatusUnauthorized},
+		{"?token=ext-secret", http.Header{"Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+		{"", http.Header{"Authorization": {"Bearer ext-secret"}, "Origin": {"chrome-extension://abcdef"}}, http.StatusSwitchingProtocols},
+		// 配置了 Origin 允许列表时，不带 Origin 的连接即使 token 正确也被拒绝
+		{"?token=ext-secret", nil, http.StatusForbidden},
+		{"", http.Header{"Authorization": {"Bearer ext-secret"}}, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		c, status := dial(tc.query, tc.header)
+		if c != nil {
+			c.Close()
+		}
+		if status != tc.status {
+			t.Errorf("%q %v: expected %d, got %d", tc.query, tc.header, tc.status, status)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := hub.SendToExtension(&WSMessage{Type: "CMD_SEND_MESSAGE"}); err != nil {
+		t.Errorf("existing connection should still work: %v", err)
+	}
+	var msg WSMessage
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "CMD_SEND_MESSAGE" {
+		t.Errorf("expected command on the existing connection, got %+v (%v)", msg, err)
+	}
+
+	// 未配置 token 时拒绝所有连接，而不是放行
+	hub.cfg.Token = ""
+	if c, status := dial("", http.Header{"Origin": {"chrome-extension://abcdef"}}); status != http.StatusUnauthorized {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("expected 401 without a configured token, got %d", status)
 	}
 }
@@ -4,19 +4,26 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/KodaTao/Gemini-Web-Proxy/server/config"
 	"github.com/KodaTao/Gemini-Web-Proxy/server/handler"
 	"github.com/KodaTao/Gemini-Web-Proxy/server/model"
+	"github.com/KodaTao/Gemini-Web-Proxy/server/native"
 )
 
 func main() {
 	// 命令行参数
 	configPath := flag.String("c", "", "config.yaml 文件路径 (不指定则使用默认配置)")
 	apiKey := flag.String("api-key", "", "API Key，设置后客户端需在 Authorization 头中携带 Bearer <key>")
+	wsToken := flag.String("ws-token", "", "插件 Token，插件连接 /ws 时需携带 ?token=<token>；未设置则自动生成")
+	nativeAddr := flag.String("native-addr", "", "native messaging host 连接的本地地址 (如 127.0.0.1:6544)，覆盖配置文件中的 native.listen")
+	nativeHost := flag.Bool("native-host", false, "以 native messaging host 运行 (由浏览器启动)，在插件与 server 之间转发消息")
+	installNative := flag.String("install-native-host", "", "为指定插件 ID 注册 native messaging host 后退出")
 	flag.Parse()
 
 	// 加载配置
@@ -33,13 +40,40 @@ func main() {
 		log.Println("no config file specified, using default config")
 	}
 
-	// 命令行 api-key 优先级高于配置文件
+	// 命令行 api-key / ws-token 优先级高于配置文件
 	if *apiKey != "" {
 		cfg.APIKey = *apiKey
 	}
+	if *wsToken != "" {
+		cfg.WebSocket.Token = *wsToken
+	}
+	if *nativeAddr != "" {
+		cfg.Native.Listen = *nativeAddr
+	}
+
+	// native messaging host 模式：stdout 为与浏览器通信的通道，不能输出其他内容
+	if *nativeHost {
+		if cfg.Native.Listen == "" {
+			log.Fatal("native host: native.listen is not configured")
+		}
+		if err := native.RunHost(os.Stdin, os.Stdout, cfg.Native.Listen, cfg.WebSocket.Token); err != nil {
+			log.Fatalf("native host: %v", err)
+		}
+		return
+	}
+
+	// 插件 token 必须设置，未配置时使用自动生成并保存的 token
+	tokenGenerated, err := cfg.EnsureWSToken()
+	if err != nil {
+		log.Fatalf("failed to generate extension token: %v", err)
+	}
+	if *installNative != "" {
+		installNativeHost(cfg, *configPath, *installNative, tokenGenerated)
+		return
+	}
 
 	// 打印生效配置
-	printConfig(cfg)
+	printConfig(cfg, tokenGenerated)
 
 	// 初始化数据库
 	db, err := model.InitDB(cfg.Database.Path)
@@ -48,19 +82,73 @@ func main() {
 	}
 	log.Println("database initialized")
 
+	// 上次运行中断的任务标记为失败
+	if n, err := model.RecoverTasks(db); err != nil {
+		log.Fatalf("failed to recover tasks: %v", err)
+	} else if n > 0 {
+		log.Printf("marked %d interrupted tasks as failed", n)
+	}
+	if n, err := model.RecoverJobs(db); err != nil {
+		log.Fatalf("failed to recover jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("marked %d interrupted jobs as failed", n)
+	}
+
 	// 初始化 WebSocket Hub 和 TaskManager
 	hub := handler.NewHub(&cfg.WebSocket)
 	taskManager := handler.NewTaskManager()
 	taskManager.StartDispatcher(hub)
 
+	// 可选的 native messaging 传输，与 WebSocket 并存
+	if cfg.Native.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.Native.Listen)
+		if err != nil {
+			log.Fatalf("failed to listen for native hosts on %s: %v", cfg.Native.Listen, err)
+		}
+		go func() {
+			if err := hub.ServeNative(ln); err != nil {
+				log.Printf("native host listener stopped: %v", err)
+			}
+		}()
+	}
+
 	// 初始化 ChatHandler
-	chatHandler := handler.NewChatHandler(hub, taskManager, db, cfg.APIKey)
+	chatHandler := handler.NewChatHandler(hub, taskManager, db, cfg)
+	adminHandler := handler.NewAdminHandler(hub, chatHandler, cfg.APIKey)
+	chatHandler.ResumeJobCallbacks()
+	batchHandler := handler.NewBatchHandler(chatHandler, cfg)
+	batchHandler.Start()
 
 	// 设置路由
 	gin.SetMode(cfg.Server.Mode)
 	r := gin.Default()
 	r.GET("/ws", hub.HandleWS)
 	r.POST("/v1/chat/completions", chatHandler.Handle)
+	r.POST("/v1/messages", chatHandler.HandleMessages)
+	r.DELETE("/v1/conversations/:id", chatHandler.DeleteConversation)
+	r.POST("/v1/jobs", chatHandler.CreateJob)
+	r.GET("/v1/jobs/:id", chatHandler.GetJob)
+	r.POST("/v1/jobs/:id/cancel", chatHandler.CancelJob)
+	r.POST("/v1/files", batchHandler.UploadFile)
+	r.GET("/v1/files", batchHandler.ListFiles)
+	r.GET("/v1/files/:id", batchHandler.GetFile)
+	r.GET("/v1/files/:id/content", batchHandler.GetFileContent)
+	r.DELETE("/v1/files/:id", batchHandler.DeleteFile)
+	r.POST("/v1/batches", batchHandler.CreateBatch)
+	r.GET("/v1/batches", batchHandler.ListBatches)
+	r.GET("/v1/batches/:id", batchHandler.GetBatch)
+	r.POST("/v1/batches/:id/cancel", batchHandler.CancelBatch)
+	r.GET("/v1/models", chatHandler.ListModels)
+	r.GET("/v1/models/:id", chatHandler.GetModel)
+	r.POST("/api/chat", chatHandler.HandleOllamaChat)
+	r.POST("/api/generate", chatHandler.HandleOllamaGenerate)
+	r.GET("/api/tags", chatHandler.ListOllamaTags)
+	r.GET("/admin/workers", adminHandler.ListWorkers)
+	r.GET("/admin/workers/:id", adminHandler.GetWorker)
+	r.GET("/admin/metrics", adminHandler.Metrics)
+	r.GET("/admin/tasks", adminHandler.ListTasks)
+	r.GET("/admin/tasks/:id", adminHandler.GetTask)
+	r.POST("/admin/tasks/:id/cancel", adminHandler.CancelTask)
 
 	// 启动服务
 	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Server.Port)
@@ -70,7 +158,39 @@ func main() {
 	}
 }
 
-func printConfig(cfg *config.Config) {
+// installNativeHost 注册 native messaging host，启动脚本以当前的配置文件与命令行参数运行 host
+func installNativeHost(cfg *config.Config, configPath, extensionID string, tokenGenerated bool) {
+	if cfg.Native.Listen == "" {
+		log.Fatal("native.listen (or -native-addr) must be set so the host knows where to connect")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("failed to locate executable: %v", err)
+	}
+
+	args := []string{"-native-host", "-native-addr=" + cfg.Native.Listen}
+	if configPath != "" {
+		abs, err := filepath.Abs(configPath)
+		if err != nil {
+			log.Fatalf("failed to resolve config path: %v", err)
+		}
+		args = append(args, "-c="+abs)
+	}
+	if configPath == "" || tokenGenerated {
+		// token 不在配置文件中时写入启动脚本：host 的工作目录由浏览器决定，无法可靠地找到 token 文件
+		args = append(args, "-ws-token="+cfg.WebSocket.Token)
+	}
+
+	paths, err := native.Install(exe, extensionID, args)
+	if err != nil {
+		log.Fatalf("failed to install native messaging host: %v", err)
+	}
+	for _, path := range paths {
+		fmt.Fprintf(os.Stderr, "native messaging host %s registered: %s\n", native.HostName, path)
+	}
+}
+
+func printConfig(cfg *config.Config, tokenGenerated bool) {
 	fmt.Fprintln(os.Stderr, "========================================")
 	fmt.Fprintln(os.Stderr, "  Gemini Web Proxy - Effective Config")
 	fmt.Fprintln(os.Stderr, "========================================")
@@ -78,10 +198,26 @@ func printConfig(cfg *config.Config) {
 	fmt.Fprintf(os.Stderr, "  Database Path:    %s\n", cfg.Database.Path)
 	fmt.Fprintf(os.Stderr, "  WS PingInterval:  %ds\n", cfg.WebSocket.PingInterval)
 	fmt.Fprintf(os.Stderr, "  WS PongTimeout:   %ds\n", cfg.WebSocket.PongTimeout)
+	fmt.Fprintf(os.Stderr, "  Queue MaxSize:    %d\n", cfg.Queue.MaxSize)
+	fmt.Fprintf(os.Stderr, "  Queue MaxWait:    %ds\n", cfg.Queue.MaxWait)
+	fmt.Fprintf(os.Stderr, "  Models:           %d\n", len(cfg.Models))
+	fmt.Fprintf(os.Stderr, "  Attachments:      %s (max %dMB)\n", cfg.Attachments.Dir, cfg.Attachments.MaxSize)
 	if cfg.APIKey != "" {
 		fmt.Fprintf(os.Stderr, "  API Key:          %s****\n", cfg.APIKey[:min(4, len(cfg.APIKey))])
 	} else {
 		fmt.Fprintln(os.Stderr, "  API Key:          (disabled, no auth)")
 	}
+	if tokenGenerated {
+		// 自动生成的 token 需要填入插件弹窗，完整打印
+		fmt.Fprintf(os.Stderr, "  WS Token:         %s (saved in %s)\n", cfg.WebSocket.Token, cfg.TokenFile())
+	} else {
+		fmt.Fprintf(os.Stderr, "  WS Token:         %s****\n", cfg.WebSocket.Token[:min(4, len(cfg.WebSocket.Token))])
+	}
+	if cfg.Native.Listen != "" {
+		fmt.Fprintf(os.Stderr, "  Native Listen:    %s\n", cfg.Native.Listen)
+	}
+	if cfg.WebSocket.MinExtensionVersion != "" {
+		fmt.Fprintf(os.Stderr, "  Min Extension:    %s\n", cfg.WebSocket.MinExtensionVersion)
+	}
 	fmt.Fprintln(os.Stderr, "========================================")
 }
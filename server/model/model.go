@@ -7,20 +7,182 @@ import (
 	"gorm.io/gorm"
 )
 
+// Conversation API 侧的一个会话，ID 由客户端指定（X-Conversation-ID 头或 user 字段）
 type Conversation struct {
+	ID                   string    `gorm:"primaryKey" json:"id"`
+	Title                string    `json:"title"`
+	GeminiConversationID string    `gorm:"index" json:"gemini_conversation_id"` // 对应的 Gemini 网页端对话 ID
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+type Message struct {
+	ID                   uint         `gorm:"primaryKey;autoIncrement" json:"id"`
+	ConversationID       string       `gorm:"index" json:"conversation_id"`                  // API 侧会话 ID，一次性对话为空
+	GeminiConversationID string       `gorm:"index" json:"gemini_conversation_id,omitempty"` // model 回复所在的 Gemini 网页端对话 ID
+	TaskID               string       `gorm:"index" json:"task_id,omitempty"`                // 所属任务，关联同一次请求的 user 消息与 model 回复
+	Conversation         Conversation `gorm:"foreignKey:ConversationID" json:"-"`
+	Role                 string       `json:"role"` // "user" or "model"
+	Content              string       `gorm:"type:text" json:"content"`
+	Status               string       `json:"status"`                           // "pending", "sent", "received", "error"
+	Error                string       `gorm:"type:text" json:"error,omitempty"` // status 为 error 时的错误信息
+	Model                string       `json:"model,omitempty"`                  // model 回复实际使用的模型（额度用尽降级后为降级模型）
+	Attachments          []Attachment `gorm:"foreignKey:MessageID" json:"attachments,omitempty"`
+	CreatedAt            time.Time    `json:"created_at"`
+}
+
+// Attachment 随 user 消息发送的附件（图片/文件），内容保存在磁盘上
+type Attachment struct {
 	ID        string    `gorm:"primaryKey" json:"id"`
-	Title     string    `json:"title"`
+	MessageID uint      `gorm:"index" json:"message_id"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	Path      string    `json:"path"` // 磁盘上的文件路径，一次性对话结束后文件被删除、路径清空
 	CreatedAt time.Time `json:"created_at"`
 }
 
-type Message struct {
-	ID             uint         `gorm:"primaryKey;autoIncrement" json:"id"`
-	ConversationID string       `gorm:"index" json:"conversation_id"`
-	Conversation   Conversation `gorm:"foreignKey:ConversationID" json:"-"`
-	Role           string       `json:"role"`   // "user" or "model"
-	Content        string       `gorm:"type:text" json:"content"`
-	Status         string       `json:"status"` // "pending", "sent", "received", "error"
-	CreatedAt      time.Time    `json:"created_at"`
+// 任务状态：queued → dispatched → processing → done / error / cancelled
+const (
+	TaskQueued     = "queued"     // 排队等待空闲 worker
+	TaskDispatched = "dispatched" // 已向插件下发 CMD_SEND_MESSAGE
+	TaskProcessing = "processing" // 已收到插件的增量回复
+	TaskDone       = "done"
+	TaskError      = "error"
+	TaskCancelled  = "cancelled"
+)
+
+// Task 一次 API 请求对应的任务，持久化其状态以便重启后识别中断的任务
+type Task struct {
+	ID             string     `gorm:"primaryKey" json:"id"`
+	ConversationID string     `gorm:"index" json:"conversation_id,omitempty"`
+	Model          string     `json:"model"` // 实际使用的模型，降级后更新
+	WorkerID       string     `json:"worker_id,omitempty"`
+	State          string     `gorm:"index" json:"state"`
+	Error          string     `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Messages       []Message  `gorm:"foreignKey:TaskID" json:"messages,omitempty"`
+}
+
+// RecoverTasks 启动时将上次运行中断的任务及其未完成的 user 消息标记为失败，返回处理的任务数
+func RecoverTasks(db *gorm.DB) (int64, error) {
+	const reason = "server restarted before the task finished"
+	active := []string{TaskQueued, TaskDispatched, TaskProcessing}
+
+	var taskIDs []string
+	if err := db.Model(&Task{}).Where("state IN ?", active).Pluck("id", &taskIDs).Error; err != nil {
+		return 0, err
+	}
+	if len(taskIDs) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Task{}).Where("id IN ?", taskIDs).
+			Updates(map[string]interface{}{"state": TaskError, "error": reason, "finished_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Message{}).Where("task_id IN ? AND status IN ?", taskIDs, []string{"pending", "sent"}).
+			Updates(map[string]interface{}{"status": "error", "error": reason}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(taskIDs)), nil
+}
+
+// Job 状态
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// 回调投递状态
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+// Job 异步 chat completion 任务（POST /v1/jobs），完成后保存 OpenAI 格式的结果或错误
+type Job struct {
+	ID               string     `gorm:"primaryKey" json:"id"`
+	TaskID           string     `gorm:"index" json:"task_id"` // 对应的 Task ID，同时作为结果的 chat.completion ID
+	Model            string     `json:"model"`
+	Status           string     `gorm:"index" json:"status"`
+	Request          string     `gorm:"type:text" json:"-"` // 原始请求 JSON
+	Result           string     `gorm:"type:text" json:"-"` // chat.completion 响应 JSON
+	Error            string     `gorm:"type:text" json:"-"` // OpenAI 格式错误 JSON
+	CallbackURL      string     `json:"callback_url,omitempty"`
+	CallbackStatus   string     `json:"callback_status,omitempty"`
+	CallbackAttempts int        `json:"callback_attempts,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+}
+
+// RecoverJobs 启动时将上次运行中断的异步任务标记为失败，返回处理的任务数
+// 需要回调的任务保持 callback_status=pending，由 handler 重新投递失败结果
+func RecoverJobs(db *gorm.DB) (int64, error) {
+	const errorJSON = `{"error":{"message":"server restarted before the job finished","type":"server_error","code":"server_restarted"}}`
+	result := db.Model(&Job{}).Where("status IN ?", []string{JobQueued, JobRunning}).
+		Updates(map[string]interface{}{"status": JobFailed, "error": errorJSON, "completed_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
+
+// File 通过 /v1/files 上传或由批处理生成的文件，内容保存在磁盘上
+type File struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Filename  string    `json:"filename"`
+	Purpose   string    `json:"purpose"` // batch（上传的输入）/ batch_output（批处理生成的结果）
+	Bytes     int64     `json:"bytes"`
+	Path      string    `json:"-"` // 磁盘上的文件路径
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Batch 状态：validating → in_progress → finalizing → completed，或 failed / expired / cancelling → cancelled
+const (
+	BatchValidating = "validating"
+	BatchFailed     = "failed"
+	BatchInProgress = "in_progress"
+	BatchFinalizing = "finalizing"
+	BatchCompleted  = "completed"
+	BatchExpired    = "expired"
+	BatchCancelling = "cancelling"
+	BatchCancelled  = "cancelled"
+)
+
+// Batch OpenAI Batch API 的批处理任务，按输入文件逐行执行请求
+// 进度以输出/错误文件的行数为准，重启后从下一行继续
+type Batch struct {
+	ID               string `gorm:"primaryKey"`
+	Endpoint         string
+	InputFileID      string
+	CompletionWindow string
+	Status           string `gorm:"index"`
+	OutputFileID     string
+	ErrorFileID      string
+	Errors           string `gorm:"type:text"` // 校验失败时的错误列表 JSON
+	Metadata         string `gorm:"type:text"` // 请求中的 metadata JSON
+	Total            int
+	Completed        int
+	Failed           int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	InProgressAt     *time.Time
+	ExpiresAt        *time.Time
+	FinalizingAt     *time.Time
+	CompletedAt      *time.Time
+	FailedAt         *time.Time
+	ExpiredAt        *time.Time
+	CancellingAt     *time.Time
+	CancelledAt      *time.Time
 }
 
 func InitDB(dbPath string) (*gorm.DB, error) {
@@ -29,9 +191,23 @@ func InitDB(dbPath string) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	if err := db.AutoMigrate(&Conversation{}, &Message{}); err != nil {
+	if err := db.AutoMigrate(&Conversation{}, &Message{}, &Attachment{}, &Task{}, &Job{}, &File{}, &Batch{}); err != nil {
+		return nil, err
+	}
+	if err := migrateMessageConversations(db); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// migrateMessageConversations 迁移旧版本数据：一次性对话的 model 回复曾把 Gemini 对话 ID 写在 conversation_id 中，
+// 将不对应任何 API 侧会话的值移到 gemini_conversation_id
+func migrateMessageConversations(db *gorm.DB) error {
+	return db.Model(&Message{}).
+		Where("conversation_id <> '' AND conversation_id NOT IN (?)", db.Model(&Conversation{}).Select("id")).
+		Updates(map[string]interface{}{
+			"gemini_conversation_id": gorm.Expr("conversation_id"),
+			"conversation_id":        "",
+		}).Error
+}
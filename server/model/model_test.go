@@ -79,3 +79,80 @@ func TestCRUD(t *testing.T) {
 		t.Errorf("expected conversation_id 'test-conv-1', got '%s'", loaded.ConversationID)
 	}
 }
+
+func TestMigrateMessageConversations(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+
+	// 旧版本一次性对话的回复把 Gemini 对话 ID 写在 conversation_id 中
+	db.Create(&Conversation{ID: "chat-1"})
+	db.Create(&Message{ConversationID: "chat-1", Role: "model", Content: "pinned"})
+	db.Create(&Message{ConversationID: "gem-1", Role: "model", Content: "one-shot"})
+	db.Create(&Message{Role: "user", Content: "plain"})
+
+	if _, err := InitDB(dbPath); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	for content, want := range map[string][2]string{
+		"pinned":   {"chat-1", ""},
+		"one-shot": {"", "gem-1"},
+		"plain":    {"", ""},
+	} {
+		var msg Message
+		db.First(&msg, "content = ?", content)
+		if msg.ConversationID != want[0] || msg.GeminiConversationID != want[1] {
+			t.Errorf("%s: expected %q / %q, got %q / %q", content, want[0], want[1], msg.ConversationID, msg.GeminiConversationID)
+		}
+	}
+}
+
+func TestRecoverTasks(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+
+	for _, task := range []Task{
+		{ID: "t-queued", State: TaskQueued},
+		{ID: "t-processing", State: TaskProcessing},
+		{ID: "t-done", State: TaskDone},
+	} {
+		db.Create(&task)
+	}
+	db.Create(&Message{TaskID: "t-processing", Role: "user", Status: "sent"})
+	db.Create(&Message{TaskID: "t-done", Role: "user", Status: "received"})
+
+	n, err := RecoverTasks(db)
+	if err != nil {
+		t.Fatalf("RecoverTasks failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 recovered tasks, got %d", n)
+	}
+
+	var tasks []Task
+	db.Preload("Messages").Order("id").Find(&tasks)
+	for _, task := range tasks {
+		switch task.ID {
+		case "t-queued", "t-processing":
+			if task.State != TaskError || task.Error == "" || task.FinishedAt == nil {
+				t.Errorf("expected %s to be marked failed, got %+v", task.ID, task)
+			}
+		case "t-done":
+			if task.State != TaskDone {
+				t.Errorf("finished task should be untouched, got %s", task.State)
+			}
+		}
+		for _, msg := range task.Messages {
+			if task.ID == "t-processing" && msg.Status != "error" {
+				t.Errorf("expected interrupted message to be marked error, got %s", msg.Status)
+			}
+			if task.ID == "t-done" && msg.Status != "received" {
+				t.Errorf("finished message should be untouched, got %s", msg.Status)
+			}
+		}
+	}
+}
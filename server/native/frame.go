@@ -0,0 +1,48 @@
+package native
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Chrome native messaging 的消息格式：4 字节本机字节序的长度前缀 + UTF-8 JSON
+// host 与 server 之间的本地连接沿用同一格式，host 只需原样转发
+
+// MaxHostMessage host 发往浏览器的单条消息上限（Chrome 限制为 1MB）
+const MaxHostMessage = 1 << 20
+
+// maxFrame 读取单条消息的上限，防止异常长度前缀导致巨量分配（浏览器发往 host 的上限为 64MB）
+const maxFrame = 64 << 20
+
+// ErrFrameTooLarge 消息长度超过上限
+var ErrFrameTooLarge = errors.New("native message too large")
+
+// ReadFrame 读取一条长度前缀消息
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.NativeEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxFrame {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFrame 写入一条长度前缀消息，长度前缀与内容一次写出
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > maxFrame {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(data))
+	}
+	buf := make([]byte, 4+len(data))
+	binary.NativeEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err := w.Write(buf)
+	return err
+}
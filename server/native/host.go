@@ -0,0 +1,130 @@
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// HostName native messaging host 名称，插件通过 chrome.runtime.connectNative(HostName) 连接
+const HostName = "com.kodatao.gemini_web_proxy"
+
+// dialTimeout 连接 server 本地地址的超时
+const dialTimeout = 5 * time.Second
+
+// message 与 server 的 WSMessage 相同的消息结构，host 只在需要时解析
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	AckID   string          `json:"ack_id,omitempty"`
+}
+
+// AuthPayload host 连接 server 后发送的第一条消息（type=AUTH）的 payload
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
+// lockedWriter 串行化多个协程对同一连接的写入
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) writeFrame(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return WriteFrame(l.w, data)
+}
+
+// RunHost 以 native messaging host 运行：连接 server 的本地地址，在浏览器（stdin/stdout）与 server 之间原样转发消息
+// 浏览器关闭端口（stdin EOF）时返回 nil；server 断开或拒绝连接时返回错误，插件随后收到 onDisconnect 并自行重连
+func RunHost(stdin io.Reader, stdout io.Writer, addr, token string) error {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("connect to server %s: %w", addr, err)
+	}
+	defer conn.Close()
+	server := &lockedWriter{w: conn}
+
+	auth, _ := json.Marshal(AuthPayload{Token: token})
+	hello, _ := json.Marshal(message{Type: "AUTH", Payload: auth})
+	if err := server.writeFrame(hello); err != nil {
+		return fmt.Errorf("authenticate with server: %w", err)
+	}
+	log.Printf("[Native] relaying to %s", addr)
+
+	errc := make(chan error, 2)
+
+	// 浏览器 -> server
+	go func() {
+		for {
+			data, err := ReadFrame(stdin)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				errc <- err
+				return
+			}
+			if err := server.writeFrame(data); err != nil {
+				errc <- fmt.Errorf("write to server: %w", err)
+				return
+			}
+		}
+	}()
+
+	// server -> 浏览器：超过浏览器上限的消息无法送达，直接以 EVENT_ERROR 回复 server
+	go func() {
+		for {
+			data, err := ReadFrame(conn)
+			if err != nil {
+				errc <- fmt.Errorf("read from server: %w", err)
+				return
+			}
+			if len(data) > MaxHostMessage {
+				rejectTooLarge(server, data)
+				continue
+			}
+			if err := WriteFrame(stdout, data); err != nil {
+				errc <- fmt.Errorf("write to browser: %w", err)
+				return
+			}
+		}
+	}()
+
+	return <-errc
+}
+
+// rejectTooLarge 代替插件确认并回复无法转发的超长指令，避免 server 重投，让等待方立即失败
+// server 在下发前已按同一上限拦截，这里只是兜底
+func rejectTooLarge(server *lockedWriter, data []byte) {
+	var msg message
+	json.Unmarshal(data, &msg)
+	log.Printf("[Native] dropping %s for %s: %d bytes exceeds the %d byte browser limit", msg.Type, msg.ID, len(data), MaxHostMessage)
+	if msg.AckID != "" {
+		ackPayload, _ := json.Marshal(map[string]string{"ack_id": msg.AckID})
+		ack, _ := json.Marshal(message{ReplyTo: msg.ID, Type: "EVENT_ACK", Payload: ackPayload})
+		if err := server.writeFrame(ack); err != nil {
+			log.Printf("[Native] failed to acknowledge oversized message: %v", err)
+		}
+	}
+	if msg.ID == "" {
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]string{
+		"error": fmt.Sprintf("message of %d bytes exceeds the native messaging limit of %d bytes", len(data), MaxHostMessage),
+		"code":  "message_too_large",
+	})
+	reply, _ := json.Marshal(message{ReplyTo: msg.ID, Type: "EVENT_ERROR", Payload: payload})
+	if err := server.writeFrame(reply); err != nil {
+		log.Printf("[Native] failed to report oversized message: %v", err)
+	}
+}
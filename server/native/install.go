@@ -0,0 +1,129 @@
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// hostManifest Chrome native messaging host manifest
+type hostManifest struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Path           string   `json:"path"`
+	Type           string   `json:"type"`
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// Install 为当前用户注册 native messaging host，返回写入的 manifest 路径
+// manifest 不能携带启动参数，因此在 exe 旁生成启动脚本，以 args 调用 exe
+func Install(exe, extensionID string, args []string) ([]string, error) {
+	if extensionID == "" {
+		return nil, fmt.Errorf("extension ID is required")
+	}
+	exe, err := filepath.Abs(exe)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(exe)
+
+	launcher, err := writeLauncher(dir, exe, args)
+	if err != nil {
+		return nil, fmt.Errorf("write launcher: %w", err)
+	}
+	data, _ := json.MarshalIndent(hostManifest{
+		Name:           HostName,
+		Description:    "Gemini Web Proxy native messaging host",
+		Path:           launcher,
+		Type:           "stdio",
+		AllowedOrigins: []string{fmt.Sprintf("chrome-extension://%s/", extensionID)},
+	}, "", "  ")
+
+	// Windows 通过注册表指向 manifest 文件，其余平台写入浏览器约定的目录
+	if runtime.GOOS == "windows" {
+		path := filepath.Join(dir, HostName+".json")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return nil, err
+		}
+		for _, key := range []string{`HKCU\Software\Google\Chrome\NativeMessagingHosts\`, `HKCU\Software\Microsoft\Edge\NativeMessagingHosts\`} {
+			if out, err := exec.Command("reg", "add", key+HostName, "/ve", "/t", "REG_SZ", "/d", path, "/f").CombinedOutput(); err != nil {
+				return nil, fmt.Errorf("register %s: %v: %s", key, err, out)
+			}
+		}
+		return []string{path}, nil
+	}
+
+	dirs, err := manifestDirs()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(d, HostName+".json")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// manifestDirs 返回已安装浏览器的 NativeMessagingHosts 目录，均未安装时返回 Chrome 的目录
+func manifestDirs() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	var browsers []string
+	if runtime.GOOS == "darwin" {
+		base := filepath.Join(home, "Library", "Application Support")
+		browsers = []string{filepath.Join(base, "Google", "Chrome"), filepath.Join(base, "Chromium"), filepath.Join(base, "Microsoft Edge")}
+	} else {
+		base := filepath.Join(home, ".config")
+		browsers = []string{filepath.Join(base, "google-chrome"), filepath.Join(base, "chromium"), filepath.Join(base, "microsoft-edge")}
+	}
+
+	var dirs []string
+	for _, b := range browsers {
+		if _, err := os.Stat(b); err == nil {
+			dirs = append(dirs, filepath.Join(b, "NativeMessagingHosts"))
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = append(dirs, filepath.Join(browsers[0], "NativeMessagingHosts"))
+	}
+	return dirs, nil
+}
+
+// writeLauncher 在 dir 下生成启动脚本，浏览器启动 host 时追加的参数（扩展 origin 等）原样传给 exe
+// 脚本可能包含插件 token，仅当前用户可读
+func writeLauncher(dir, exe string, args []string) (string, error) {
+	if runtime.GOOS == "windows" {
+		path := filepath.Join(dir, "native-host.bat")
+		quoted := []string{`"` + exe + `"`}
+		for _, arg := range args {
+			quoted = append(quoted, `"`+arg+`"`)
+		}
+		line := fmt.Sprintf("@echo off\r\n%s %%*\r\n", strings.Join(quoted, " "))
+		return path, os.WriteFile(path, []byte(line), 0o700)
+	}
+
+	quoted := []string{shellQuote(exe)}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	path := filepath.Join(dir, "native-host.sh")
+	script := fmt.Sprintf("#!/bin/sh\nexec %s \"$@\"\n", strings.Join(quoted, " "))
+	return path, os.WriteFile(path, []byte(script), 0o700)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
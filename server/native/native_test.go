@@ -0,0 +1,131 @@
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range []string{`{"type":"PING"}`, `{}`, ``} {
+		if err := WriteFrame(&buf, []byte(msg)); err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+	}
+	for _, want := range []string{`{"type":"PING"}`, `{}`, ``} {
+		data, err := ReadFrame(&buf)
+		if err != nil || string(data) != want {
+			t.Errorf("expected %q, got %q (%v)", want, data, err)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("expected EOF after the last frame, got %v", err)
+	}
+
+	// 异常的长度前缀不会触发巨量分配
+	if _, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestRunHostRejectsOversizedMessage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	stdinR, stdinW := io.Pipe()
+	defer stdinW.Close()
+	hostErr := make(chan error, 1)
+	go func() { hostErr <- RunHost(stdinR, io.Discard, ln.Addr().String(), "ext-secret") }()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	var auth message
+	data, _ := ReadFrame(conn)
+	json.Unmarshal(data, &auth)
+	if auth.Type != "AUTH" || !strings.Contains(string(auth.Payload), "ext-secret") {
+		t.Fatalf("expected AUTH with the token first, got %s", data)
+	}
+
+	// 超过浏览器 1MB 上限的指令由 host 直接回复 EVENT_ERROR
+	payload, _ := json.Marshal(map[string]string{"prompt": strings.Repeat("x", MaxHostMessage)})
+	big, _ := json.Marshal(message{ID: "task-1", Type: "CMD_SEND_MESSAGE", Payload: payload, AckID: "ack-1"})
+	WriteFrame(conn, big)
+
+	// 先确认，避免 server 重投同一条超长指令
+	var ack message
+	data, _ = ReadFrame(conn)
+	json.Unmarshal(data, &ack)
+	if ack.Type != "EVENT_ACK" || !strings.Contains(string(ack.Payload), "ack-1") {
+		t.Fatalf("expected EVENT_ACK for the oversized command, got %s", data)
+	}
+
+	var reply message
+	data, err = ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("expected an error reply: %v", err)
+	}
+	json.Unmarshal(data, &reply)
+	if reply.Type != "EVENT_ERROR" || reply.ReplyTo != "task-1" || !strings.Contains(string(reply.Payload), "message_too_large") {
+		t.Errorf("unexpected reply: %s", data)
+	}
+
+	// 浏览器关闭端口后 host 正常退出
+	stdinW.Close()
+	select {
+	case err := <-hostErr:
+		if err != nil {
+			t.Errorf("expected a clean exit, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("host did not exit")
+	}
+}
+
+func TestInstall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("registry based install")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	exe := filepath.Join(t.TempDir(), "server")
+
+	paths, err := Install(exe, "abcdefghijklmnop", []string{"-native-host", "-native-addr=127.0.0.1:6544"})
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], home) {
+		t.Fatalf("expected one manifest under HOME, got %v", paths)
+	}
+
+	var manifest hostManifest
+	data, _ := os.ReadFile(paths[0])
+	json.Unmarshal(data, &manifest)
+	if manifest.Name != HostName || manifest.Type != "stdio" || manifest.AllowedOrigins[0] != "chrome-extension://abcdefghijklmnop/" {
+		t.Errorf("unexpected manifest: %s", data)
+	}
+	script, _ := os.ReadFile(manifest.Path)
+	if !strings.Contains(string(script), "'"+exe+"' '-native-host' '-native-addr=127.0.0.1:6544' \"$@\"") {
+		t.Errorf("unexpected launcher: %s", script)
+	}
+
+	if _, err := Install(exe, "", nil); err == nil {
+		t.Error("expected an error without an extension ID")
+	}
+}